@@ -0,0 +1,321 @@
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//熔断打开时拒绝调用返回的错误
+var ErrOpen = errors.New("circuit breaker is open")
+
+type State int
+
+const (
+	//正常放行，统计窗口内错误率或慢调用比例超过阈值时打开
+	Closed State = iota
+	//拒绝所有调用，OpenTimeout后进入半开
+	Open
+	//放行少量探测调用，全部成功时关闭，任一失败重新打开
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+type Config struct {
+	//统计的滚动窗口，默认10秒，分成Buckets个桶滚动，默认10
+	Window  time.Duration
+	Buckets int
+	//窗口内调用数达到MinRequests后才会打开，默认20
+	MinRequests int
+	//窗口内失败比例达到ErrorRate时打开，默认0.5
+	ErrorRate float64
+	//耗时超过SlowThreshold的调用为慢调用，慢调用比例达到SlowRate时打开，默认0.5；SlowThreshold为0不统计慢调用
+	SlowThreshold time.Duration
+	SlowRate      float64
+	//打开后多久进入半开，默认30秒
+	OpenTimeout time.Duration
+	//半开时放行的探测调用数，默认1
+	HalfOpenRequests int
+	//判断错误是否算失败，默认err != nil
+	IsFailure func(err error) bool
+	//状态变化回调，在持有锁时调用，不要在回调中调用Breaker的方法
+	OnStateChange func(name string, from State, to State)
+}
+
+func (cfg *Config) withDefaults() Config {
+	c := *cfg
+	if c.Window <= 0 {
+		c.Window = 10 * time.Second
+	}
+	if c.Buckets <= 0 {
+		c.Buckets = 10
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 20
+	}
+	if c.ErrorRate <= 0 {
+		c.ErrorRate = 0.5
+	}
+	if c.SlowRate <= 0 {
+		c.SlowRate = 0.5
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = 30 * time.Second
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+	if c.IsFailure == nil {
+		c.IsFailure = func(err error) bool { return err != nil }
+	}
+	return c
+}
+
+//窗口内的一个桶
+type bucket struct {
+	index    int64
+	total    int
+	failures int
+	slow     int
+}
+
+type Breaker struct {
+	name string
+	cfg  Config
+
+	mu         sync.Mutex
+	state      State
+	generation int64
+	openedAt   time.Time
+	bucketDur  time.Duration
+	buckets    []bucket
+
+	//半开时已放行和已成功的探测数
+	probes    int
+	successes int
+}
+
+func NewBreaker(name string, cfg *Config) *Breaker {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	c := cfg.withDefaults()
+
+	bucketDur := c.Window / time.Duration(c.Buckets)
+	if bucketDur <= 0 {
+		bucketDur = time.Millisecond
+	}
+	return &Breaker{
+		name:      name,
+		cfg:       c,
+		bucketDur: bucketDur,
+		buckets:   make([]bucket, c.Buckets),
+	}
+}
+
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+//当前状态，打开超过OpenTimeout时为半开
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refresh(time.Now())
+	return b.state
+}
+
+//是否允许调用，允许时返回的done必须在调用结束后调用一次，传入调用的错误
+//打开或半开的探测数已满时返回ErrOpen
+func (b *Breaker) Allow() (func(err error), error) {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refresh(now)
+	switch b.state {
+	case Open:
+		return nil, ErrOpen
+	case HalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return nil, ErrOpen
+		}
+		b.probes++
+	}
+
+	generation := b.generation
+	return func(err error) {
+		b.done(generation, err, time.Since(now))
+	}, nil
+}
+
+//执行fn，打开时不执行直接返回ErrOpen
+func (b *Breaker) Do(fn func() error) error {
+	done, err := b.Allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn()
+	done(err)
+	return err
+}
+
+func (b *Breaker) done(generation int64, err error, latency time.Duration) {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	//状态变化前放行的调用不再计入
+	if generation != b.generation {
+		return
+	}
+
+	failed := b.cfg.IsFailure(err)
+	slow := b.cfg.SlowThreshold > 0 && latency > b.cfg.SlowThreshold
+
+	switch b.state {
+	case HalfOpen:
+		if failed || slow {
+			b.setState(Open, now)
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.HalfOpenRequests {
+			b.setState(Closed, now)
+		}
+	case Closed:
+		cur := b.bucket(now)
+		cur.total++
+		if failed {
+			cur.failures++
+		}
+		if slow {
+			cur.slow++
+		}
+		b.check(now)
+	}
+}
+
+//窗口内失败或慢调用比例超过阈值时打开
+func (b *Breaker) check(now time.Time) {
+	var total, failures, slow int
+	oldest := now.UnixNano()/int64(b.bucketDur) - int64(len(b.buckets)) + 1
+	for _, bk := range b.buckets {
+		if bk.index < oldest {
+			continue
+		}
+		total += bk.total
+		failures += bk.failures
+		slow += bk.slow
+	}
+
+	if total < b.cfg.MinRequests {
+		return
+	}
+	if float64(failures)/float64(total) >= b.cfg.ErrorRate ||
+		(b.cfg.SlowThreshold > 0 && float64(slow)/float64(total) >= b.cfg.SlowRate) {
+		b.setState(Open, now)
+	}
+}
+
+//now所在的桶，过期的桶清零复用
+func (b *Breaker) bucket(now time.Time) *bucket {
+	index := now.UnixNano() / int64(b.bucketDur)
+	bk := &b.buckets[index%int64(len(b.buckets))]
+	if bk.index != index {
+		*bk = bucket{index: index}
+	}
+	return bk
+}
+
+func (b *Breaker) refresh(now time.Time) {
+	if b.state == Open && now.Sub(b.openedAt) >= b.cfg.OpenTimeout {
+		b.setState(HalfOpen, now)
+	}
+}
+
+func (b *Breaker) setState(state State, now time.Time) {
+	from := b.state
+	b.state = state
+	b.generation++
+	b.probes = 0
+	b.successes = 0
+
+	switch state {
+	case Open:
+		b.openedAt = now
+	case Closed:
+		for i := range b.buckets {
+			b.buckets[i] = bucket{}
+		}
+	}
+
+	if b.cfg.OnStateChange != nil && from != state {
+		b.cfg.OnStateChange(b.name, from, state)
+	}
+}
+
+//按名字区分的一组熔断器，如每个host、每个节点一个，使用相同配置
+type Group struct {
+	cfg *Config
+
+	mu       sync.RWMutex
+	breakers map[string]*Breaker
+}
+
+func NewGroup(cfg *Config) *Group {
+	return &Group{
+		cfg:      cfg,
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+//name的熔断器，不存在时创建
+func (g *Group) Get(name string) *Breaker {
+	g.mu.RLock()
+	b, ok := g.breakers[name]
+	g.mu.RUnlock()
+	if ok {
+		return b
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if b, ok := g.breakers[name]; ok {
+		return b
+	}
+	b = NewBreaker(name, g.cfg)
+	g.breakers[name] = b
+	return b
+}
+
+//所有熔断器的状态
+func (g *Group) States() map[string]State {
+	g.mu.RLock()
+	breakers := make([]*Breaker, 0, len(g.breakers))
+	for _, b := range g.breakers {
+		breakers = append(breakers, b)
+	}
+	g.mu.RUnlock()
+
+	states := make(map[string]State, len(breakers))
+	for _, b := range breakers {
+		states[b.name] = b.State()
+	}
+	return states
+}
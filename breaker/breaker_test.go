@@ -0,0 +1,170 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errFail = errors.New("fail")
+
+//按顺序记录n次调用结果
+func record(b *Breaker, n int, err error) {
+	for i := 0; i < n; i++ {
+		if done, e := b.Allow(); e == nil {
+			done(err)
+		}
+	}
+}
+
+func TestBreakerOpen(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		successes int
+		failures  int
+		want      State
+	}{
+		{"below min requests", Config{MinRequests: 10}, 0, 9, Closed},
+		{"error rate reached", Config{MinRequests: 10, ErrorRate: 0.5}, 5, 5, Open},
+		{"error rate not reached", Config{MinRequests: 10, ErrorRate: 0.5}, 6, 4, Closed},
+		{"all failures", Config{MinRequests: 1}, 0, 1, Open},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBreaker(tt.name, &tt.cfg)
+			record(b, tt.successes, nil)
+			record(b, tt.failures, errFail)
+			if got := b.State(); got != tt.want {
+				t.Fatalf("state = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerSlowCalls(t *testing.T) {
+	b := NewBreaker("slow", &Config{MinRequests: 2, SlowThreshold: time.Millisecond, SlowRate: 0.5})
+	for i := 0; i < 2; i++ {
+		done, err := b.Allow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+		done(nil)
+	}
+	if got := b.State(); got != Open {
+		t.Fatalf("state = %s, want open", got)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe error
+		want  State
+	}{
+		{"probe succeeds", nil, Closed},
+		{"probe fails", errFail, Open},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []State
+			b := NewBreaker("b", &Config{
+				MinRequests: 1,
+				OpenTimeout: 10 * time.Millisecond,
+				OnStateChange: func(name string, from State, to State) {
+					changes = append(changes, to)
+				},
+			})
+			record(b, 1, errFail)
+			if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+				t.Fatalf("Allow() err = %v, want ErrOpen", err)
+			}
+
+			time.Sleep(15 * time.Millisecond)
+			if got := b.State(); got != HalfOpen {
+				t.Fatalf("state = %s, want half-open", got)
+			}
+			done, err := b.Allow()
+			if err != nil {
+				t.Fatal(err)
+			}
+			//半开只放行HalfOpenRequests个探测
+			if _, err := b.Allow(); !errors.Is(err, ErrOpen) {
+				t.Fatalf("second probe err = %v, want ErrOpen", err)
+			}
+			done(tt.probe)
+
+			if got := b.State(); got != tt.want {
+				t.Fatalf("state = %s, want %s", got, tt.want)
+			}
+			want := []State{Open, HalfOpen, tt.want}
+			if len(changes) != len(want) {
+				t.Fatalf("changes = %v, want %v", changes, want)
+			}
+			for i := range want {
+				if changes[i] != want[i] {
+					t.Fatalf("changes = %v, want %v", changes, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerStaleDone(t *testing.T) {
+	b := NewBreaker("b", &Config{MinRequests: 1, OpenTimeout: time.Hour})
+	stale, err := b.Allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record(b, 1, errFail)
+
+	//打开前放行的调用结束时不影响新的状态
+	stale(nil)
+	if got := b.State(); got != Open {
+		t.Fatalf("state = %s, want open", got)
+	}
+}
+
+func TestBreakerIsFailure(t *testing.T) {
+	b := NewBreaker("b", &Config{
+		MinRequests: 1,
+		IsFailure: func(err error) bool {
+			return err != nil && !errors.Is(err, context.Canceled)
+		},
+	})
+	if err := b.Do(func() error { return context.Canceled }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Do() err = %v", err)
+	}
+	if got := b.State(); got != Closed {
+		t.Fatalf("state = %s, want closed", got)
+	}
+	b.Do(func() error { return errFail })
+	if err := b.Do(func() error { return nil }); !errors.Is(err, ErrOpen) {
+		t.Fatalf("Do() err = %v, want ErrOpen", err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	g := NewGroup(&Config{MinRequests: 1})
+	if g.Get("a") != g.Get("a") {
+		t.Fatal("Get returned different breakers for the same name")
+	}
+	record(g.Get("a"), 1, errFail)
+	record(g.Get("b"), 1, nil)
+
+	states := g.States()
+	if states["a"] != Open || states["b"] != Closed || len(states) != 2 {
+		t.Fatalf("states = %v", states)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	tests := map[State]string{Closed: "closed", Open: "open", HalfOpen: "half-open", State(9): "state(9)"}
+	for s, want := range tests {
+		if got := s.String(); got != want {
+			t.Fatalf("String() = %q, want %q", got, want)
+		}
+	}
+}
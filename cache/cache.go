@@ -7,3 +7,11 @@ type Cache interface {
 	Decr(string, uint64) (uint64, error)
 	Incr(string, uint64) (uint64, error)
 }
+
+// 支持不存在才设置的cache，用于去重和分布式锁
+type NXCache interface {
+	Cache
+	SetNX(string, []byte, int32) (bool, error)
+	//值等于给定值时才删除，返回是否删除，用于只释放自己持有的锁
+	CompareAndDelete(string, []byte) (bool, error)
+}
@@ -1,9 +1,12 @@
 package cache
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 
 	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/yybirdcf/golib/breaker"
 	"github.com/yybirdcf/golib/utils"
 )
 
@@ -11,6 +14,8 @@ type MemCache struct {
 	servers []string
 	mcs     map[string]*memcache.Client
 	nodes   *utils.HashRing
+
+	breakers *breaker.Group
 }
 
 func NewMemCache(servers []string) *MemCache {
@@ -37,20 +42,58 @@ func (m *MemCache) genRing(servers []string, num int) {
 	m.nodes = nodes
 }
 
-func (m *MemCache) node(key string) (*memcache.Client, error) {
-	if c, ok := m.mcs[m.nodes.GetNode(key)]; ok {
-		return c, nil
+//开启节点熔断，每个节点一个熔断器，熔断的节点直接返回breaker.ErrOpen，需要在使用前调用
+//IsFailure默认不把未命中、未存储等结果算作失败
+func (m *MemCache) SetBreaker(cfg *breaker.Config) {
+	c := *cfg
+	if c.IsFailure == nil {
+		c.IsFailure = isMemcacheFailure
+	}
+	m.breakers = breaker.NewGroup(&c)
+}
+
+//节点的熔断状态，未开启熔断时返回nil
+func (m *MemCache) BreakerStates() map[string]breaker.State {
+	if m.breakers == nil {
+		return nil
+	}
+	return m.breakers.States()
+}
+
+func isMemcacheFailure(err error) bool {
+	switch err {
+	case nil, memcache.ErrCacheMiss, memcache.ErrNotStored, memcache.ErrCASConflict, memcache.ErrMalformedKey:
+		return false
 	}
-	return nil, errors.New("memcache node not found")
+	return true
+}
+
+//key所在的节点，返回的done需要传入调用结果
+func (m *MemCache) node(key string) (*memcache.Client, func(error), error) {
+	server := m.nodes.GetNode(key)
+	c, ok := m.mcs[server]
+	if !ok {
+		return nil, nil, errors.New("memcache node not found")
+	}
+
+	if m.breakers == nil {
+		return c, func(error) {}, nil
+	}
+	done, err := m.breakers.Get(server).Allow()
+	if err != nil {
+		return nil, nil, fmt.Errorf("memcache %s: %w", server, err)
+	}
+	return c, done, nil
 }
 
 func (m *MemCache) Get(key string) ([]byte, error) {
-	node, err := m.node(key)
+	node, done, err := m.node(key)
 	if err != nil {
 		return nil, err
 	}
 
 	item, err := node.Get(key)
+	done(err)
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +103,7 @@ func (m *MemCache) Get(key string) ([]byte, error) {
 
 //过期时间秒数，0表示不过期
 func (m *MemCache) Set(key string, value []byte, expiration int32) error {
-	node, err := m.node(key)
+	node, done, err := m.node(key)
 	if err != nil {
 		return err
 	}
@@ -71,32 +114,90 @@ func (m *MemCache) Set(key string, value []byte, expiration int32) error {
 		Expiration: expiration,
 	}
 
-	return node.Set(item)
+	err = node.Set(item)
+	done(err)
+	return err
+}
+
+//key不存在时才设置，设置成功返回true，过期时间秒数，0表示不过期
+func (m *MemCache) SetNX(key string, value []byte, expiration int32) (bool, error) {
+	node, done, err := m.node(key)
+	if err != nil {
+		return false, err
+	}
+
+	item := &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Expiration: expiration,
+	}
+
+	err = node.Add(item)
+	done(err)
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//memcache没有带cas的删除，值相等时用cas写入一个立即过期的值
+func (m *MemCache) CompareAndDelete(key string, value []byte) (bool, error) {
+	node, done, err := m.node(key)
+	if err != nil {
+		return false, err
+	}
+
+	item, err := node.Get(key)
+	if err == nil {
+		if !bytes.Equal(item.Value, value) {
+			done(nil)
+			return false, nil
+		}
+		item.Expiration = -1
+		err = node.CompareAndSwap(item)
+	}
+	done(err)
+	if err == memcache.ErrCacheMiss || err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func (m *MemCache) Del(key string) error {
-	node, err := m.node(key)
+	node, done, err := m.node(key)
 	if err != nil {
 		return err
 	}
 
-	return node.Delete(key)
+	err = node.Delete(key)
+	done(err)
+	return err
 }
 
 func (m *MemCache) Decr(key string, delta uint64) (uint64, error) {
-	node, err := m.node(key)
+	node, done, err := m.node(key)
 	if err != nil {
 		return 0, err
 	}
 
-	return node.Decrement(key, delta)
+	v, err := node.Decrement(key, delta)
+	done(err)
+	return v, err
 }
 
 func (m *MemCache) Incr(key string, delta uint64) (uint64, error) {
-	node, err := m.node(key)
+	node, done, err := m.node(key)
 	if err != nil {
 		return 0, err
 	}
 
-	return node.Increment(key, delta)
+	v, err := node.Increment(key, delta)
+	done(err)
+	return v, err
 }
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/yybirdcf/golib/breaker"
 	"github.com/yybirdcf/golib/utils"
 )
 
@@ -20,6 +21,8 @@ type RedisCache struct {
 	servers []RedisConfig
 	rcs     map[string]*redis.Pool
 	nodes   *utils.HashRing
+
+	breakers *breaker.Group
 }
 
 func NewRedisCache(servers []RedisConfig) *RedisCache {
@@ -69,76 +72,100 @@ func (r *RedisCache) genRing(servers []RedisConfig) {
 	r.nodes = nodes
 }
 
-func (r *RedisCache) node(key string) (*redis.Pool, error) {
-	if c, ok := r.rcs[r.nodes.GetNode(key)]; ok {
-		return c, nil
+//开启节点熔断，每个节点一个熔断器，熔断的节点直接返回breaker.ErrOpen，需要在使用前调用
+//IsFailure默认不把redis返回的错误回复（如类型错误）算作失败
+func (r *RedisCache) SetBreaker(cfg *breaker.Config) {
+	c := *cfg
+	if c.IsFailure == nil {
+		c.IsFailure = func(err error) bool {
+			_, ok := err.(redis.Error)
+			return err != nil && !ok
+		}
 	}
-	return nil, errors.New("redis node not found")
+	r.breakers = breaker.NewGroup(&c)
 }
 
-func (r *RedisCache) Get(key string) ([]byte, error) {
-	node, err := r.node(key)
-	if err != nil {
-		return nil, err
+//节点的熔断状态，未开启熔断时返回nil
+func (r *RedisCache) BreakerStates() map[string]breaker.State {
+	if r.breakers == nil {
+		return nil
+	}
+	return r.breakers.States()
+}
+
+func (r *RedisCache) do(key string, cmd string, args ...interface{}) (interface{}, error) {
+	srv := r.nodes.GetNode(key)
+	pool, ok := r.rcs[srv]
+	if !ok {
+		return nil, errors.New("redis node not found")
+	}
+
+	done := func(error) {}
+	if r.breakers != nil {
+		var err error
+		if done, err = r.breakers.Get(srv).Allow(); err != nil {
+			return nil, fmt.Errorf("redis %s: %w", srv, err)
+		}
 	}
 
-	conn := node.Get()
+	conn := pool.Get()
 	defer conn.Close()
 
-	return redis.Bytes(conn.Do("GET", key))
+	reply, err := conn.Do(cmd, args...)
+	done(err)
+	return reply, err
+}
+
+func (r *RedisCache) Get(key string) ([]byte, error) {
+	return redis.Bytes(r.do(key, "GET", key))
 }
 
 //过期时间秒数，0表示不过期
 func (r *RedisCache) Set(key string, value []byte, expiration int32) error {
-	node, err := r.node(key)
-	if err != nil {
-		return err
-	}
-
-	conn := node.Get()
-	defer conn.Close()
-
+	var err error
 	if expiration == 0 {
-		_, err = conn.Do("SET", key, value)
+		_, err = r.do(key, "SET", key, value)
 	} else {
-		_, err = conn.Do("SET", key, value, "EX", expiration)
+		_, err = r.do(key, "SET", key, value, "EX", expiration)
 	}
 	return err
 }
 
 func (r *RedisCache) Del(key string) error {
-	node, err := r.node(key)
-	if err != nil {
-		return err
-	}
-
-	conn := node.Get()
-	defer conn.Close()
-
-	_, err = conn.Do("DEL", key)
+	_, err := r.do(key, "DEL", key)
 	return err
 }
 
 func (r *RedisCache) Decr(key string, delta uint64) (uint64, error) {
-	node, err := r.node(key)
-	if err != nil {
-		return 0, err
-	}
-
-	conn := node.Get()
-	defer conn.Close()
-
-	return redis.Uint64(conn.Do("DECRBY", key, delta))
+	return redis.Uint64(r.do(key, "DECRBY", key, delta))
 }
 
 func (r *RedisCache) Incr(key string, delta uint64) (uint64, error) {
-	node, err := r.node(key)
+	return redis.Uint64(r.do(key, "INCRBY", key, delta))
+}
+
+//key不存在时才设置，设置成功返回true，过期时间秒数，0表示不过期
+func (r *RedisCache) SetNX(key string, value []byte, expiration int32) (bool, error) {
+	var reply interface{}
+	var err error
+	if expiration == 0 {
+		reply, err = r.do(key, "SET", key, value, "NX")
+	} else {
+		reply, err = r.do(key, "SET", key, value, "EX", expiration, "NX")
+	}
 	if err != nil {
-		return 0, err
+		return false, err
 	}
+	return reply != nil, nil
+}
 
-	conn := node.Get()
-	defer conn.Close()
+//GET和DEL在一个脚本里原子执行
+const compareAndDeleteScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) end return 0`
 
-	return redis.Uint64(conn.Do("INCRBY", key, delta))
+func (r *RedisCache) CompareAndDelete(key string, value []byte) (bool, error) {
+	n, err := redis.Int(r.do(key, "EVAL", compareAndDeleteScript, 1, key, value))
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
 }
@@ -1,10 +1,12 @@
 package clog
 
 import (
+	"context"
 	"flag"
 	"sync"
 
 	"github.com/natefinch/lumberjack"
+	"github.com/yybirdcf/golib/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -94,3 +96,43 @@ func Warnf(format string, args ...interface{}) {
 func Errorf(format string, args ...interface{}) {
 	logger.Errorf(format, args...)
 }
+
+// withContext 附带ctx中的trace_id和span_id
+func withContext(ctx context.Context) *zap.SugaredLogger {
+	if sc, ok := trace.FromContext(ctx); ok && sc.IsValid() {
+		return logger.With("trace_id", sc.TraceID, "span_id", sc.SpanID)
+	}
+	return logger
+}
+
+func InfoCtx(ctx context.Context, args ...interface{}) {
+	withContext(ctx).Info(args...)
+}
+
+func DebugCtx(ctx context.Context, args ...interface{}) {
+	withContext(ctx).Debug(args...)
+}
+
+func WarnCtx(ctx context.Context, args ...interface{}) {
+	withContext(ctx).Warn(args...)
+}
+
+func ErrorCtx(ctx context.Context, args ...interface{}) {
+	withContext(ctx).Error(args...)
+}
+
+func InfofCtx(ctx context.Context, format string, args ...interface{}) {
+	withContext(ctx).Infof(format, args...)
+}
+
+func DebugfCtx(ctx context.Context, format string, args ...interface{}) {
+	withContext(ctx).Debugf(format, args...)
+}
+
+func WarnfCtx(ctx context.Context, format string, args ...interface{}) {
+	withContext(ctx).Warnf(format, args...)
+}
+
+func ErrorfCtx(ctx context.Context, format string, args ...interface{}) {
+	withContext(ctx).Errorf(format, args...)
+}
@@ -0,0 +1,159 @@
+//在所有库上执行schema迁移
+//
+//	migrate -config dbs.json -dir migrations status
+//	migrate -config dbs.json -dir migrations [-to 3] [-dry-run] up
+//	migrate -config dbs.json -dir migrations [-steps 1] [-dry-run] down
+//
+//配置示例，-db只迁移其中一个库：
+//
+//	{
+//	  "driver": "mysql",
+//	  "dbs": {"db0": "user:pass@tcp(127.0.0.1:3306)/db0", "db1": "user:pass@tcp(127.0.0.1:3306)/db1"}
+//	}
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/yybirdcf/golib/database"
+	"github.com/yybirdcf/golib/migrate"
+	"github.com/yybirdcf/golib/sys"
+)
+
+type config struct {
+	Driver string            `json:"driver"`
+	DBs    map[string]string `json:"dbs"`
+}
+
+func loadConfig(path string, only string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{Driver: "mysql"}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s err: %v", path, err)
+	}
+
+	if only != "" {
+		dsn, ok := cfg.DBs[only]
+		if !ok {
+			return nil, fmt.Errorf("%s can not found", only)
+		}
+		cfg.DBs = map[string]string{only: dsn}
+	}
+	return cfg, nil
+}
+
+func printStatus(status map[string][]migrate.Status) {
+	names := make([]string, 0, len(status))
+	for name := range status {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DB\tVERSION\tNAME\tAPPLIED AT")
+	for _, name := range names {
+		for _, s := range status[name] {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", name, s.Version, s.Name, appliedAt)
+		}
+	}
+	w.Flush()
+}
+
+func printDone(action string, done map[string][]int64) {
+	names := make([]string, 0, len(done))
+	for name := range done {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%s %s: %v\n", name, action, done[name])
+	}
+}
+
+func run(cmd string, cfgPath string, only string, dir string, dryRun bool, to int64, steps int) error {
+	cfg, err := loadConfig(cfgPath, only)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := migrate.LoadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(migrations) == 0 {
+		return fmt.Errorf("no migrations found in %s", dir)
+	}
+
+	manager := database.NewDBManager()
+	for name, dsn := range cfg.DBs {
+		err := manager.AddDB(name, &database.MRDBConfig{
+			DN:        cfg.Driver,
+			MasterDSN: dsn,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := sys.SetupQuitSignal()
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	migrator := migrate.NewMigrator(migrations, &migrate.Config{DryRun: dryRun})
+	switch cmd {
+	case "status":
+		status, err := migrator.StatusAll(ctx, manager)
+		printStatus(status)
+		return err
+	case "up":
+		done, err := migrator.UpAll(ctx, manager, to)
+		printDone("up", done)
+		return err
+	case "down":
+		done, err := migrator.DownAll(ctx, manager, steps)
+		printDone("down", done)
+		return err
+	}
+	return fmt.Errorf("unknown command %q, use up, down or status", cmd)
+}
+
+func main() {
+	cfgPath := flag.String("config", "dbs.json", "db config file")
+	only := flag.String("db", "", "only migrate this db")
+	dir := flag.String("dir", "migrations", "migration files directory")
+	dryRun := flag.Bool("dry-run", false, "print sql without executing")
+	to := flag.Int64("to", 0, "up to this version, 0 for latest")
+	steps := flag.Int("steps", 1, "number of versions to roll back")
+	flag.Parse()
+
+	cmd := flag.Arg(0)
+	if cmd == "" {
+		cmd = "status"
+	}
+
+	if err := run(cmd, *cfgPath, *only, *dir, *dryRun, *to, *steps); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
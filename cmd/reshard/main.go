@@ -0,0 +1,183 @@
+//在线迁移分片表
+//
+//	reshard -config reshard.json            复制并校验，中断后重新执行从进度处继续
+//	reshard -config reshard.json -verify    只校验不复制
+//
+//配置示例：
+//
+//	{
+//	  "driver": "mysql",
+//	  "dbs": {"db0": "user:pass@tcp(127.0.0.1:3306)/db0", "db1": "user:pass@tcp(127.0.0.1:3306)/db1"},
+//	  "table": "orders",
+//	  "key_column": "user_id",
+//	  "pk_column": "id",
+//	  "from": {"type": "modulo", "dbs": ["db0"], "tables": 4},
+//	  "to": {"type": "modulo", "dbs": ["db0", "db1"], "tables": 4},
+//	  "batch_size": 1000,
+//	  "pause": "10ms",
+//	  "checkpoint": "orders.checkpoint.json"
+//	}
+//
+//运行前所有应用实例都要调用DBManager.BeginReshard开始双写，
+//复制和校验完成后，所有应用实例一起调用DBManager.FinishReshard切换到新的分片策略
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/yybirdcf/golib/database"
+	"github.com/yybirdcf/golib/sys"
+	"github.com/yybirdcf/golib/utils"
+)
+
+type strategyConfig struct {
+	//modulo、hashring、range
+	Type string `json:"type"`
+	//modulo的db，按顺序
+	DBs []string `json:"dbs"`
+	//hashring的db + 权重
+	Nodes map[string]int `json:"nodes"`
+	//hashring的虚拟节点数
+	Spots int `json:"spots"`
+	//每个db的分表数，modulo、hashring使用
+	Tables int `json:"tables"`
+	//range的范围表
+	Ranges []database.RangeShard `json:"ranges"`
+}
+
+type config struct {
+	Driver     string            `json:"driver"`
+	DBs        map[string]string `json:"dbs"`
+	Table      string            `json:"table"`
+	KeyColumn  string            `json:"key_column"`
+	PKColumn   string            `json:"pk_column"`
+	From       strategyConfig    `json:"from"`
+	To         strategyConfig    `json:"to"`
+	BatchSize  int               `json:"batch_size"`
+	Pause      string            `json:"pause"`
+	Checkpoint string            `json:"checkpoint"`
+}
+
+func newStrategy(cfg strategyConfig) (database.ShardingStrategy, error) {
+	switch cfg.Type {
+	case "modulo":
+		return database.NewModuloSharding(cfg.DBs, cfg.Tables), nil
+	case "hashring":
+		ring := utils.NewHashRing(cfg.Spots)
+		ring.AddNodes(cfg.Nodes)
+		return database.NewHashRingSharding(ring, cfg.Tables), nil
+	case "range":
+		return database.NewRangeSharding(cfg.Ranges)
+	}
+	return nil, fmt.Errorf("unknown sharding type %q", cfg.Type)
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{Driver: "mysql"}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s err: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func run(path string, verify bool) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	from, err := newStrategy(cfg.From)
+	if err != nil {
+		return err
+	}
+	to, err := newStrategy(cfg.To)
+	if err != nil {
+		return err
+	}
+
+	var pause time.Duration
+	if cfg.Pause != "" {
+		if pause, err = time.ParseDuration(cfg.Pause); err != nil {
+			return err
+		}
+	}
+
+	var checkpoint database.CheckpointStore
+	if cfg.Checkpoint != "" {
+		if checkpoint, err = database.NewFileCheckpoint(cfg.Checkpoint); err != nil {
+			return err
+		}
+	}
+
+	manager := database.NewDBManager()
+	for name, dsn := range cfg.DBs {
+		err := manager.AddDB(name, &database.MRDBConfig{
+			DN:        cfg.Driver,
+			MasterDSN: dsn,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	resharder, err := database.NewResharder(manager, &database.ReshardConfig{
+		Table:      cfg.Table,
+		KeyColumn:  cfg.KeyColumn,
+		PKColumn:   cfg.PKColumn,
+		From:       from,
+		To:         to,
+		BatchSize:  cfg.BatchSize,
+		Pause:      pause,
+		Checkpoint: checkpoint,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quit := sys.SetupQuitSignal()
+	go func() {
+		<-quit
+		cancel()
+	}()
+
+	var report *database.ReshardReport
+	if verify {
+		report, err = resharder.Verify(ctx)
+	} else {
+		report, err = resharder.Run(ctx)
+	}
+
+	fmt.Printf("chunks: %d, rows: %d, copied: %d, repaired: %d, mismatched: %d\n",
+		report.Chunks, report.Rows, report.Copied, report.Repaired, report.Mismatched)
+	if err != nil {
+		return err
+	}
+	if report.Mismatched > 0 {
+		return fmt.Errorf("%d rows mismatched", report.Mismatched)
+	}
+	return nil
+}
+
+func main() {
+	path := flag.String("config", "reshard.json", "reshard config file")
+	verify := flag.Bool("verify", false, "only verify checksums, do not copy")
+	flag.Parse()
+
+	if err := run(*path, *verify); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
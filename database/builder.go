@@ -0,0 +1,531 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//占位符风格
+type Placeholder int
+
+const (
+	//mysql、sqlite的?
+	Question Placeholder = iota
+	//postgres的$1、$2
+	Dollar
+)
+
+//根据驱动名选择占位符，postgres、pgx、pq用$1，其他用?
+func PlaceholderFor(driverName string) Placeholder {
+	switch driverName {
+	case "postgres", "pgx", "pq":
+		return Dollar
+	}
+	return Question
+}
+
+//把sql中的?换成p风格的占位符，跳过引号中的?
+func Rebind(p Placeholder, query string) string {
+	if p == Question {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+//生成sql和参数，sql中的占位符为p风格
+type Builder interface {
+	ToSQL(p Placeholder) (string, []interface{})
+}
+
+type condition struct {
+	expr string
+	args []interface{}
+}
+
+//条件中的?对应的参数为切片时展开，用于IN (?)
+//空切片时IN ()不合法，x IN (?)改写为恒假的1 = 0，x NOT IN (?)改写为恒真的1 = 1，
+//x为列名、函数调用或括号表达式；其他位置的空切片按NULL处理
+func expandArgs(expr string, args []interface{}) (string, []interface{}) {
+	expanded := make([]interface{}, 0, len(args))
+	b := make([]byte, 0, len(expr))
+	argIdx := 0
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			b = append(b, c)
+			continue
+		}
+		if c == '\'' || c == '"' || c == '`' {
+			quote = c
+		}
+		if c != '?' || argIdx >= len(args) {
+			b = append(b, c)
+			continue
+		}
+
+		arg := args[argIdx]
+		argIdx++
+		v := reflect.ValueOf(arg)
+		if arg == nil || v.Kind() != reflect.Slice || v.Type().Elem().Kind() == reflect.Uint8 {
+			b = append(b, '?')
+			expanded = append(expanded, arg)
+			continue
+		}
+
+		if v.Len() == 0 {
+			start, not, ok := inOperandStart(b)
+			end := closeParen(expr, i+1)
+			if !ok || end < 0 {
+				b = append(b, "NULL"...)
+				continue
+			}
+			b = b[:start]
+			if not {
+				b = append(b, "1 = 1"...)
+			} else {
+				b = append(b, "1 = 0"...)
+			}
+			i = end
+			continue
+		}
+		b = append(b, placeholders(v.Len())...)
+		for j := 0; j < v.Len(); j++ {
+			expanded = append(expanded, v.Index(j).Interface())
+		}
+	}
+	return string(b), append(expanded, args[argIdx:]...)
+}
+
+//b以x [NOT] IN (结尾时返回x的开始位置和是否为NOT IN
+func inOperandStart(b []byte) (int, bool, bool) {
+	i := skipSpaceBack(b, len(b))
+	if i == 0 || b[i-1] != '(' {
+		return 0, false, false
+	}
+	i = skipSpaceBack(b, i-1)
+	if i < 3 || !strings.EqualFold(string(b[i-2:i]), "IN") || !isSpace(b[i-3]) {
+		return 0, false, false
+	}
+	i = skipSpaceBack(b, i-2)
+
+	not := false
+	if i >= 4 && strings.EqualFold(string(b[i-3:i]), "NOT") && isSpace(b[i-4]) {
+		not = true
+		i = skipSpaceBack(b, i-3)
+	}
+
+	end := i
+	if i > 0 && b[i-1] == ')' {
+		depth := 0
+		for i > 0 {
+			i--
+			if b[i] == ')' {
+				depth++
+			} else if b[i] == '(' {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		if depth != 0 {
+			return 0, false, false
+		}
+	}
+	//列名、带表名或引号的列名、函数名
+	for i > 0 && isIdentByte(b[i-1]) {
+		i--
+	}
+	if i == end {
+		return 0, false, false
+	}
+	return i, not, true
+}
+
+//expr从i开始跳过空白后是)时返回它的位置，否则返回-1
+func closeParen(expr string, i int) int {
+	for i < len(expr) && isSpace(expr[i]) {
+		i++
+	}
+	if i < len(expr) && expr[i] == ')' {
+		return i
+	}
+	return -1
+}
+
+func skipSpaceBack(b []byte, i int) int {
+	for i > 0 && isSpace(b[i-1]) {
+		i--
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c == '`' || c == '"' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func buildWhere(b *strings.Builder, args []interface{}, where []condition) []interface{} {
+	if len(where) == 0 {
+		return args
+	}
+
+	b.WriteString(" WHERE ")
+	for i, cond := range where {
+		if i > 0 {
+			b.WriteString(" AND ")
+		}
+		expr, condArgs := expandArgs(cond.expr, cond.args)
+		if len(where) > 1 {
+			b.WriteString("(" + expr + ")")
+		} else {
+			b.WriteString(expr)
+		}
+		args = append(args, condArgs...)
+	}
+	return args
+}
+
+type SelectBuilder struct {
+	columns []string
+	from    string
+	joins   []condition
+	where   []condition
+	groupBy []string
+	having  []condition
+	orderBy []string
+	limit   int
+	offset  int
+	suffix  string
+}
+
+//SELECT columns，不传列时为*
+func NewSelect(columns ...string) *SelectBuilder {
+	return &SelectBuilder{columns: columns}
+}
+
+func (s *SelectBuilder) From(table string) *SelectBuilder {
+	s.from = table
+	return s
+}
+
+//JOIN子句，如Join("JOIN orders o ON o.user_id = u.id")
+func (s *SelectBuilder) Join(join string, args ...interface{}) *SelectBuilder {
+	s.joins = append(s.joins, condition{expr: join, args: args})
+	return s
+}
+
+//多次调用用AND连接，参数为切片时展开，如Where("id IN (?)", ids)
+func (s *SelectBuilder) Where(expr string, args ...interface{}) *SelectBuilder {
+	s.where = append(s.where, condition{expr: expr, args: args})
+	return s
+}
+
+func (s *SelectBuilder) GroupBy(columns ...string) *SelectBuilder {
+	s.groupBy = append(s.groupBy, columns...)
+	return s
+}
+
+func (s *SelectBuilder) Having(expr string, args ...interface{}) *SelectBuilder {
+	s.having = append(s.having, condition{expr: expr, args: args})
+	return s
+}
+
+func (s *SelectBuilder) OrderBy(columns ...string) *SelectBuilder {
+	s.orderBy = append(s.orderBy, columns...)
+	return s
+}
+
+func (s *SelectBuilder) Limit(limit int) *SelectBuilder {
+	s.limit = limit
+	return s
+}
+
+//没有设置Limit时，?占位符的驱动（mysql、sqlite）会补上LIMIT最大值
+func (s *SelectBuilder) Offset(offset int) *SelectBuilder {
+	s.offset = offset
+	return s
+}
+
+//追加在最后，如FOR UPDATE
+func (s *SelectBuilder) Suffix(suffix string) *SelectBuilder {
+	s.suffix = suffix
+	return s
+}
+
+func (s *SelectBuilder) ToSQL(p Placeholder) (string, []interface{}) {
+	var b strings.Builder
+	var args []interface{}
+
+	b.WriteString("SELECT ")
+	if len(s.columns) == 0 {
+		b.WriteString("*")
+	} else {
+		b.WriteString(strings.Join(s.columns, ", "))
+	}
+	b.WriteString(" FROM " + s.from)
+
+	for _, join := range s.joins {
+		expr, joinArgs := expandArgs(join.expr, join.args)
+		b.WriteString(" " + expr)
+		args = append(args, joinArgs...)
+	}
+
+	args = buildWhere(&b, args, s.where)
+
+	if len(s.groupBy) > 0 {
+		b.WriteString(" GROUP BY " + strings.Join(s.groupBy, ", "))
+	}
+	for i, cond := range s.having {
+		if i == 0 {
+			b.WriteString(" HAVING ")
+		} else {
+			b.WriteString(" AND ")
+		}
+		expr, condArgs := expandArgs(cond.expr, cond.args)
+		b.WriteString(expr)
+		args = append(args, condArgs...)
+	}
+	if len(s.orderBy) > 0 {
+		b.WriteString(" ORDER BY " + strings.Join(s.orderBy, ", "))
+	}
+	if s.limit > 0 {
+		b.WriteString(" LIMIT " + strconv.Itoa(s.limit))
+	} else if s.offset > 0 && p == Question {
+		//mysql、sqlite的OFFSET必须跟在LIMIT后面，用最大值表示不限制
+		b.WriteString(" LIMIT 9223372036854775807")
+	}
+	if s.offset > 0 {
+		b.WriteString(" OFFSET " + strconv.Itoa(s.offset))
+	}
+	if s.suffix != "" {
+		b.WriteString(" " + s.suffix)
+	}
+
+	return Rebind(p, b.String()), args
+}
+
+type InsertBuilder struct {
+	table   string
+	columns []string
+	rows    [][]interface{}
+	verb    string
+	suffix  string
+}
+
+func NewInsert(table string) *InsertBuilder {
+	return &InsertBuilder{table: table, verb: "INSERT"}
+}
+
+func (s *InsertBuilder) Columns(columns ...string) *InsertBuilder {
+	s.columns = columns
+	return s
+}
+
+//一行的值，多次调用插入多行
+func (s *InsertBuilder) Values(values ...interface{}) *InsertBuilder {
+	s.rows = append(s.rows, values)
+	return s
+}
+
+//INSERT IGNORE、REPLACE等，默认INSERT
+func (s *InsertBuilder) Verb(verb string) *InsertBuilder {
+	s.verb = verb
+	return s
+}
+
+//追加在最后，如ON DUPLICATE KEY UPDATE ...、RETURNING id
+func (s *InsertBuilder) Suffix(suffix string) *InsertBuilder {
+	s.suffix = suffix
+	return s
+}
+
+func (s *InsertBuilder) ToSQL(p Placeholder) (string, []interface{}) {
+	var b strings.Builder
+	args := make([]interface{}, 0, len(s.rows)*len(s.columns))
+
+	b.WriteString(s.verb + " INTO " + s.table + " (" + strings.Join(s.columns, ", ") + ") VALUES ")
+	for i, row := range s.rows {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(" + placeholders(len(row)) + ")")
+		args = append(args, row...)
+	}
+	if s.suffix != "" {
+		b.WriteString(" " + s.suffix)
+	}
+
+	return Rebind(p, b.String()), args
+}
+
+type UpdateBuilder struct {
+	table string
+	sets  []condition
+	where []condition
+}
+
+func NewUpdate(table string) *UpdateBuilder {
+	return &UpdateBuilder{table: table}
+}
+
+//SET column = value
+func (s *UpdateBuilder) Set(column string, value interface{}) *UpdateBuilder {
+	s.sets = append(s.sets, condition{expr: column + " = ?", args: []interface{}{value}})
+	return s
+}
+
+//SET表达式，如SetExpr("count = count + ?", 1)
+func (s *UpdateBuilder) SetExpr(expr string, args ...interface{}) *UpdateBuilder {
+	s.sets = append(s.sets, condition{expr: expr, args: args})
+	return s
+}
+
+func (s *UpdateBuilder) Where(expr string, args ...interface{}) *UpdateBuilder {
+	s.where = append(s.where, condition{expr: expr, args: args})
+	return s
+}
+
+func (s *UpdateBuilder) ToSQL(p Placeholder) (string, []interface{}) {
+	var b strings.Builder
+	var args []interface{}
+
+	b.WriteString("UPDATE " + s.table + " SET ")
+	for i, set := range s.sets {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(set.expr)
+		args = append(args, set.args...)
+	}
+	args = buildWhere(&b, args, s.where)
+
+	return Rebind(p, b.String()), args
+}
+
+type DeleteBuilder struct {
+	table string
+	where []condition
+}
+
+func NewDelete(table string) *DeleteBuilder {
+	return &DeleteBuilder{table: table}
+}
+
+func (s *DeleteBuilder) Where(expr string, args ...interface{}) *DeleteBuilder {
+	s.where = append(s.where, condition{expr: expr, args: args})
+	return s
+}
+
+func (s *DeleteBuilder) ToSQL(p Placeholder) (string, []interface{}) {
+	var b strings.Builder
+	b.WriteString("DELETE FROM " + s.table)
+	args := buildWhere(&b, nil, s.where)
+
+	return Rebind(p, b.String()), args
+}
+
+//MRDB驱动的占位符风格
+func (mrDB *MRDB) Placeholder() Placeholder {
+	return mrDB.placeholder
+}
+
+//在主库执行构造的sql
+func (mrDB *MRDB) ExecBuild(ctx context.Context, b Builder) (sql.Result, error) {
+	query, args := b.ToSQL(mrDB.placeholder)
+	return mrDB.ExecContext(ctx, query, args...)
+}
+
+//查询构造的sql到结构体切片
+func (mrDB *MRDB) SelectBuild(ctx context.Context, dest interface{}, b Builder) error {
+	query, args := b.ToSQL(mrDB.placeholder)
+	return mrDB.Select(ctx, dest, query, args...)
+}
+
+//查询构造的sql的一行到结构体，没有行时返回sql.ErrNoRows
+func (mrDB *MRDB) GetBuild(ctx context.Context, dest interface{}, b Builder) error {
+	query, args := b.ToSQL(mrDB.placeholder)
+	return mrDB.Get(ctx, dest, query, args...)
+}
+
+//批量插入的默认每批行数
+const DefaultBulkChunkSize = 500
+
+//单条sql的占位符上限，mysql和postgres都是65535
+const maxPlaceholders = 65535
+
+//批量插入，每chunkSize行一条INSERT，占位符超过上限时自动减小每批行数，返回影响的总行数
+//每行的值个数必须和列数相同，否则不插入任何行直接返回错误
+//中途失败时已插入的批不会回滚，需要原子性时在事务里按批调用NewInsert
+func (mrDB *MRDB) BulkInsert(ctx context.Context, table string, columns []string, rows [][]interface{}, chunkSize int) (int64, error) {
+	if len(columns) == 0 {
+		return 0, errors.New("bulk insert needs columns")
+	}
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return 0, fmt.Errorf("bulk insert row %d has %d values, want %d", i, len(row), len(columns))
+		}
+	}
+	if chunkSize <= 0 {
+		chunkSize = DefaultBulkChunkSize
+	}
+	if chunkSize*len(columns) > maxPlaceholders {
+		chunkSize = maxPlaceholders / len(columns)
+	}
+
+	var total int64
+	for start := 0; start < len(rows); start += chunkSize {
+		end := start + chunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		b := NewInsert(table).Columns(columns...)
+		for _, row := range rows[start:end] {
+			b.Values(row...)
+		}
+
+		res, err := mrDB.ExecBuild(ctx, b)
+		if err != nil {
+			return total, err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			total += n
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     Placeholder
+		query string
+		want  string
+	}{
+		{"question unchanged", Question, "SELECT * FROM t WHERE a = ? AND b = ?", "SELECT * FROM t WHERE a = ? AND b = ?"},
+		{"dollar", Dollar, "SELECT * FROM t WHERE a = ? AND b = ?", "SELECT * FROM t WHERE a = $1 AND b = $2"},
+		{"single quote", Dollar, "SELECT '?' FROM t WHERE a = ?", "SELECT '?' FROM t WHERE a = $1"},
+		{"double quote", Dollar, `SELECT "a?" FROM t WHERE a = ?`, `SELECT "a?" FROM t WHERE a = $1`},
+		{"backquote", Dollar, "SELECT `a?` FROM t WHERE a = ?", "SELECT `a?` FROM t WHERE a = $1"},
+		{"no placeholder", Dollar, "SELECT 1", "SELECT 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Rebind(tt.p, tt.query); got != tt.want {
+				t.Fatalf("Rebind() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		args     []interface{}
+		wantExpr string
+		wantArgs []interface{}
+	}{
+		{"scalar", "id = ?", []interface{}{1}, "id = ?", []interface{}{1}},
+		{"slice", "id IN (?)", []interface{}{[]int{1, 2, 3}}, "id IN (?, ?, ?)", []interface{}{1, 2, 3}},
+		{"empty in", "id IN (?)", []interface{}{[]string{}}, "1 = 0", []interface{}{}},
+		{"empty not in", "a = ? AND u.id not in ( ? ) AND b = ?", []interface{}{1, []int{}, 2}, "a = ? AND 1 = 1 AND b = ?", []interface{}{1, 2}},
+		{"empty in function", "LOWER(`name`) IN (?)", []interface{}{[]string{}}, "1 = 0", []interface{}{}},
+		{"empty not in tuple", "(a, b) NOT IN (?)", []interface{}{[]int{}}, "1 = 1", []interface{}{}},
+		{"empty slice not in IN", "FIELD(id, ?) > 0", []interface{}{[]int{}}, "FIELD(id, NULL) > 0", []interface{}{}},
+		{"bytes not expanded", "data = ?", []interface{}{[]byte("ab")}, "data = ?", []interface{}{[]byte("ab")}},
+		{"nil", "a = ?", []interface{}{nil}, "a = ?", []interface{}{nil}},
+		{"quoted placeholder", "a = '?' AND id IN (?)", []interface{}{[]int{1, 2}}, "a = '?' AND id IN (?, ?)", []interface{}{1, 2}},
+		{"mixed", "a = ? AND id IN (?) AND b = ?", []interface{}{"x", []int64{7, 8}, "y"}, "a = ? AND id IN (?, ?) AND b = ?", []interface{}{"x", int64(7), int64(8), "y"}},
+		{"extra args kept", "a = ?", []interface{}{1, 2}, "a = ?", []interface{}{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, args := expandArgs(tt.expr, tt.args)
+			if expr != tt.wantExpr {
+				t.Fatalf("expr = %q, want %q", expr, tt.wantExpr)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Fatalf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestBuilders(t *testing.T) {
+	tests := []struct {
+		name     string
+		b        Builder
+		p        Placeholder
+		wantSQL  string
+		wantArgs []interface{}
+	}{
+		{
+			"select all",
+			NewSelect().From("users"),
+			Question,
+			"SELECT * FROM users",
+			nil,
+		},
+		{
+			"select full",
+			NewSelect("u.id", "COUNT(*)").From("users u").
+				Join("JOIN orders o ON o.user_id = u.id AND o.status = ?", 1).
+				Where("u.id IN (?)", []int{1, 2}).Where("u.name = ?", "a").
+				GroupBy("u.id").Having("COUNT(*) > ?", 2).
+				OrderBy("u.id DESC").Limit(10).Offset(20).Suffix("FOR UPDATE"),
+			Dollar,
+			"SELECT u.id, COUNT(*) FROM users u JOIN orders o ON o.user_id = u.id AND o.status = $1 WHERE (u.id IN ($2, $3)) AND (u.name = $4) GROUP BY u.id HAVING COUNT(*) > $5 ORDER BY u.id DESC LIMIT 10 OFFSET 20 FOR UPDATE",
+			[]interface{}{1, 1, 2, "a", 2},
+		},
+		{
+			"offset without limit mysql",
+			NewSelect("id").From("t").Offset(5),
+			Question,
+			"SELECT id FROM t LIMIT 9223372036854775807 OFFSET 5",
+			nil,
+		},
+		{
+			"offset without limit postgres",
+			NewSelect("id").From("t").Offset(5),
+			Dollar,
+			"SELECT id FROM t OFFSET 5",
+			nil,
+		},
+		{
+			"insert rows",
+			NewInsert("t").Columns("a", "b").Values(1, 2).Values(3, 4).Suffix("RETURNING id"),
+			Dollar,
+			"INSERT INTO t (a, b) VALUES ($1, $2), ($3, $4) RETURNING id",
+			[]interface{}{1, 2, 3, 4},
+		},
+		{
+			"insert ignore",
+			NewInsert("t").Verb("INSERT IGNORE").Columns("a").Values(1),
+			Question,
+			"INSERT IGNORE INTO t (a) VALUES (?)",
+			[]interface{}{1},
+		},
+		{
+			"update",
+			NewUpdate("t").Set("a", 1).SetExpr("c = c + ?", 2).Where("id = ?", 3),
+			Question,
+			"UPDATE t SET a = ?, c = c + ? WHERE id = ?",
+			[]interface{}{1, 2, 3},
+		},
+		{
+			"delete empty in",
+			NewDelete("t").Where("id IN (?)", []int{}),
+			Question,
+			"DELETE FROM t WHERE 1 = 0",
+			nil,
+		},
+		{
+			"select empty not in",
+			NewSelect().From("t").Where("id NOT IN (?)", []int64{}).Where("a = ?", 1),
+			Dollar,
+			"SELECT * FROM t WHERE (1 = 1) AND (a = $1)",
+			[]interface{}{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := tt.b.ToSQL(tt.p)
+			if query != tt.wantSQL {
+				t.Fatalf("sql = %q, want %q", query, tt.wantSQL)
+			}
+			if len(args) != len(tt.wantArgs) || (len(args) > 0 && !reflect.DeepEqual(args, tt.wantArgs)) {
+				t.Fatalf("args = %#v, want %#v", args, tt.wantArgs)
+			}
+		})
+	}
+}
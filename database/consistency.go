@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+)
+
+type masterKey struct{}
+
+type sessionKey struct{}
+
+//ctx中的读请求强制走主库
+func WithMaster(ctx context.Context) context.Context {
+	return context.WithValue(ctx, masterKey{}, true)
+}
+
+func useMaster(ctx context.Context) bool {
+	v, _ := ctx.Value(masterKey{}).(bool)
+	return v
+}
+
+//读写一致性会话，记录会话内最后一次写的时间和GTID
+//跨请求的会话可以把LastWrite、GTID存到cookie或缓存里，下次用Restore恢复
+//只有ExecContext和WithTx的写会更新会话，BeginTx返回的*sql.Tx、Prepare的*sql.Stmt上的写
+//不会记录，需要在提交后调用MarkWrite
+type Session struct {
+	mu        sync.RWMutex
+	lastWrite time.Time
+	gtid      string
+	//已确认执行到gtid的从库，之后的读直接使用，不再等待
+	confirmed map[*conn]bool
+}
+
+func NewSession() *Session {
+	return &Session{}
+}
+
+//把会话放入ctx，MRDB在ctx上的写会更新会话，读会根据会话选择主库或已追上的从库
+func WithSession(ctx context.Context, s *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+func (s *Session) LastWrite() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastWrite
+}
+
+func (s *Session) GTID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.gtid
+}
+
+func (s *Session) Restore(lastWrite time.Time, gtid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastWrite = lastWrite
+	s.gtid = gtid
+	s.confirmed = nil
+}
+
+func (s *Session) wrote(gtid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastWrite = time.Now()
+	if gtid != "" && gtid != s.gtid {
+		s.gtid = gtid
+		s.confirmed = nil
+	}
+}
+
+func (s *Session) confirm(c *conn, gtid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gtid != gtid {
+		return
+	}
+	if s.confirmed == nil {
+		s.confirmed = make(map[*conn]bool)
+	}
+	s.confirmed[c] = true
+}
+
+func (s *Session) isConfirmed(c *conn) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.confirmed[c]
+}
+
+//在BeginTx的事务等不经过ExecContext、WithTx的写提交后调用，更新ctx中的会话
+func (mrDB *MRDB) MarkWrite(ctx context.Context) {
+	mrDB.afterWrite(ctx)
+}
+
+//写成功后更新ctx中的会话，开启GTID等待时记录主库已执行的GTID集合
+func (mrDB *MRDB) afterWrite(ctx context.Context) {
+	s := SessionFromContext(ctx)
+	if s == nil {
+		return
+	}
+
+	var gtid string
+	if mrDB.gtidWait > 0 {
+		if err := mrDB.masterDB().QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_executed").Scan(&gtid); err != nil {
+			clog.Errorf("get master gtid_executed err: %v", err)
+		}
+	}
+	s.wrote(gtid)
+}
+
+//ctx下可读的从库，返回空时走主库
+//1.WithMaster强制主库
+//2.会话有GTID且开启GTID等待时，只返回已追上该GTID的从库，优先用已确认过的从库，
+//  否则同时等待所有从库，返回最先追上的一个，最多等待GTIDWaitTimeout
+//3.会话在MasterPinDuration内写过时走主库
+func (mrDB *MRDB) readConnsContext(ctx context.Context) []*conn {
+	if useMaster(ctx) {
+		return nil
+	}
+
+	s := SessionFromContext(ctx)
+	if s == nil {
+		return mrDB.readConns()
+	}
+
+	if gtid := s.GTID(); gtid != "" && mrDB.gtidWait > 0 {
+		conns := mrDB.readConns()
+		for _, c := range conns {
+			if s.isConfirmed(c) {
+				return []*conn{c}
+			}
+		}
+		if c := mrDB.waitAnyGTID(ctx, conns, gtid); c != nil {
+			s.confirm(c, gtid)
+			return []*conn{c}
+		}
+		return nil
+	}
+
+	if mrDB.masterPin > 0 && time.Since(s.LastWrite()) < mrDB.masterPin {
+		return nil
+	}
+	return mrDB.readConns()
+}
+
+//同时等待所有从库执行到gtid，返回最先追上的从库，有一个追上后取消其他的等待
+func (mrDB *MRDB) waitAnyGTID(ctx context.Context, conns []*conn, gtid string) *conn {
+	if len(conns) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	deadline := time.Now().Add(mrDB.gtidWait)
+	caught := make(chan *conn, len(conns))
+	for _, c := range conns {
+		go func(c *conn) {
+			if mrDB.waitGTID(ctx, c, gtid, deadline) {
+				caught <- c
+			} else {
+				caught <- nil
+			}
+		}(c)
+	}
+
+	for range conns {
+		if c := <-caught; c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+//在deadline前等待从库执行到gtid，超时或出错返回false
+func (mrDB *MRDB) waitGTID(ctx context.Context, c *conn, gtid string, deadline time.Time) bool {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return false
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline.Add(time.Second))
+	defer cancel()
+
+	var timeout int64
+	err := c.db.QueryRowContext(ctx, "SELECT WAIT_FOR_EXECUTED_GTID_SET(?, ?)", gtid, remaining.Seconds()).Scan(&timeout)
+	if err != nil {
+		//其他从库先追上时取消的等待不记录
+		if ctx.Err() == nil {
+			clog.Errorf("wait for gtid on %s err: %v", c.label, err)
+		}
+		return false
+	}
+	return timeout == 0
+}
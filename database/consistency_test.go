@@ -0,0 +1,221 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+const testGTID = "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"
+
+//主库返回testGTID，从库按wait处理WAIT_FOR_EXECUTED_GTID_SET，其他查询返回一行
+func newTestSessionDB(t *testing.T, cfg *MRDBConfig, waits ...fakedb.QueryFunc) (*MRDB, *recordHook) {
+	master, ms := fakedb.NewServer(t, "master")
+	ms.SetHandlers(func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+		if strings.Contains(query, "gtid_executed") {
+			return fakedb.NewRows([]string{"gtid"}, []driver.Value{testGTID}), nil
+		}
+		return fakedb.NewRows([]string{"v"}, []driver.Value{int64(1)}), nil
+	}, nil)
+
+	cfg.DN = fakedb.Driver
+	cfg.MasterDSN = master
+	for i, wait := range waits {
+		dsn, s := fakedb.NewServer(t, fmt.Sprintf("replica%d", i))
+		wait := wait
+		s.SetHandlers(func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+			if strings.Contains(query, "WAIT_FOR_EXECUTED_GTID_SET") {
+				if args[0] != testGTID {
+					t.Errorf("wait gtid = %v", args[0])
+				}
+				return wait(ctx, query, args)
+			}
+			return fakedb.NewRows([]string{"v"}, []driver.Value{int64(1)}), nil
+		}, nil)
+		cfg.ReadDSNs = append(cfg.ReadDSNs, dsn)
+	}
+
+	var calls []string
+	hook := &recordHook{name: "record", calls: &calls}
+	cfg.Hooks = []Hook{hook}
+	db, err := NewMRDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, hook
+}
+
+//最后一次查询走的连接
+func lastQueryTarget(t *testing.T, db *MRDB, hook *recordHook, ctx context.Context) string {
+	t.Helper()
+	rows, err := db.QueryContext(ctx, "SELECT v FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	return hook.events[len(hook.events)-1].Target
+}
+
+//从库在lag后追上，和WAIT_FOR_EXECUTED_GTID_SET一样超过参数的秒数返回1
+func replicaLag(lag time.Duration) fakedb.QueryFunc {
+	return func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+		wait, result := lag, int64(0)
+		if timeout := time.Duration(args[1].(float64) * float64(time.Second)); timeout < lag {
+			wait, result = timeout, 1
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		return fakedb.NewRows([]string{"r"}, []driver.Value{result}), nil
+	}
+}
+
+func TestSessionMasterPin(t *testing.T) {
+	db, hook := newTestSessionDB(t, &MRDBConfig{MasterPinDuration: 50 * time.Millisecond}, replicaLag(0))
+
+	s := NewSession()
+	ctx := WithSession(context.Background(), s)
+	if got := lastQueryTarget(t, db, hook, ctx); got != "replica-0" {
+		t.Fatalf("read before write on %s", got)
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE t SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.LastWrite().IsZero() || s.GTID() != "" {
+		t.Fatalf("session = %v, %q", s.LastWrite(), s.GTID())
+	}
+	if got := lastQueryTarget(t, db, hook, ctx); got != "master" {
+		t.Fatalf("read after write on %s, want master", got)
+	}
+	//不带会话的读不受影响
+	if got := lastQueryTarget(t, db, hook, context.Background()); got != "replica-0" {
+		t.Fatalf("read without session on %s", got)
+	}
+
+	//超过MasterPinDuration后回到从库
+	time.Sleep(60 * time.Millisecond)
+	if got := lastQueryTarget(t, db, hook, ctx); got != "replica-0" {
+		t.Fatalf("read after pin expired on %s", got)
+	}
+}
+
+func TestSessionWithTx(t *testing.T) {
+	db, hook := newTestSessionDB(t, &MRDBConfig{MasterPinDuration: time.Minute}, replicaLag(0))
+
+	s := NewSession()
+	ctx := WithSession(context.Background(), s)
+	err := db.WithTxContext(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "UPDATE t SET v = 1")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LastWrite().IsZero() {
+		t.Fatal("WithTx did not mark the session")
+	}
+	if got := lastQueryTarget(t, db, hook, ctx); got != "master" {
+		t.Fatalf("read after tx on %s, want master", got)
+	}
+
+	//回滚的事务不更新会话
+	s2 := NewSession()
+	db.WithTx(WithSession(context.Background(), s2), nil, func(tx *sql.Tx) error {
+		return sql.ErrNoRows
+	})
+	if !s2.LastWrite().IsZero() {
+		t.Fatal("rolled back tx marked the session")
+	}
+}
+
+func TestSessionGTIDWait(t *testing.T) {
+	var slowCalls int32
+	//卡住的从库，直到等待被取消
+	slow := func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+		atomic.AddInt32(&slowCalls, 1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	db, hook := newTestSessionDB(t, &MRDBConfig{GTIDWaitTimeout: 2 * time.Second, MasterPinDuration: time.Minute}, slow, replicaLag(10*time.Millisecond))
+
+	s := NewSession()
+	ctx := WithSession(context.Background(), s)
+	if _, err := db.ExecContext(ctx, "UPDATE t SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if s.GTID() != testGTID {
+		t.Fatalf("session gtid = %q", s.GTID())
+	}
+
+	//同时等待，不会先等完落后的从库；开启GTID等待时忽略MasterPinDuration
+	start := time.Now()
+	if got := lastQueryTarget(t, db, hook, ctx); got != "replica-1" {
+		t.Fatalf("read on %s, want replica-1", got)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("read waited %v", d)
+	}
+	if atomic.LoadInt32(&slowCalls) != 1 {
+		t.Fatalf("slow replica waited %d times", slowCalls)
+	}
+
+	//已确认的从库不再等待
+	if got := lastQueryTarget(t, db, hook, ctx); got != "replica-1" {
+		t.Fatalf("second read on %s", got)
+	}
+	if atomic.LoadInt32(&slowCalls) != 1 {
+		t.Fatalf("slow replica waited %d times after confirm", slowCalls)
+	}
+}
+
+func TestSessionGTIDTimeout(t *testing.T) {
+	db, hook := newTestSessionDB(t, &MRDBConfig{GTIDWaitTimeout: 50 * time.Millisecond}, replicaLag(time.Minute), replicaLag(time.Minute))
+
+	s := NewSession()
+	ctx := WithSession(context.Background(), s)
+	if _, err := db.ExecContext(ctx, "UPDATE t SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	//所有从库超时走主库，等待时间不按从库数累加
+	start := time.Now()
+	if got := lastQueryTarget(t, db, hook, ctx); got != "master" {
+		t.Fatalf("read on %s, want master", got)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Fatalf("read waited %v, want GTIDWaitTimeout", d)
+	}
+
+	//WithMaster优先于会话
+	if got := lastQueryTarget(t, db, hook, WithMaster(ctx)); got != "master" {
+		t.Fatalf("WithMaster read on %s", got)
+	}
+}
+
+func TestSessionGTIDWaitError(t *testing.T) {
+	failed := func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+		return nil, errors.New("gtid_mode is off")
+	}
+	db, hook := newTestSessionDB(t, &MRDBConfig{GTIDWaitTimeout: time.Second}, failed)
+
+	//等待出错按未追上处理，走主库
+	ctx := WithSession(context.Background(), NewSession())
+	if _, err := db.ExecContext(ctx, "UPDATE t SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastQueryTarget(t, db, hook, ctx); got != "master" {
+		t.Fatalf("read on %s, want master", got)
+	}
+}
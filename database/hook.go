@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+	"github.com/yybirdcf/golib/trace"
+)
+
+const (
+	OpExec     = "exec"
+	OpQuery    = "query"
+	OpQueryRow = "query_row"
+	OpPrepare  = "prepare"
+	OpBegin    = "begin"
+	OpCommit   = "commit"
+	OpRollback = "rollback"
+)
+
+//一次sql调用
+type QueryEvent struct {
+	Op    string
+	Query string
+	Args  []interface{}
+	//连接，master、replica-0...
+	Target string
+	//DBManager中的db name，单独使用MRDB时为空
+	Shard string
+
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+//sql调用的钩子，Before返回的ctx会用于这次调用和After
+//MRDB的Exec、Query、QueryRow、Prepare、Begin和WithTx的提交回滚会调用钩子，
+//事务内的sql要经过钩子需要用WithHookedTx或HookTx包装的*Tx执行，
+//直接在*sql.Tx和Prepare返回的*sql.Stmt上执行的sql不经过钩子
+type Hook interface {
+	Before(ctx context.Context, e *QueryEvent) context.Context
+	After(ctx context.Context, e *QueryEvent)
+}
+
+func (mrDB *MRDB) before(ctx context.Context, op string, c *conn, query string, args []interface{}) (context.Context, *QueryEvent) {
+	if len(mrDB.hooks) == 0 {
+		return ctx, nil
+	}
+
+	e := &QueryEvent{
+		Op:     op,
+		Query:  query,
+		Args:   args,
+		Target: c.label,
+		Shard:  mrDB.name,
+		Start:  time.Now(),
+	}
+	for _, h := range mrDB.hooks {
+		ctx = h.Before(ctx, e)
+	}
+	return ctx, e
+}
+
+func (mrDB *MRDB) after(ctx context.Context, e *QueryEvent, err error) {
+	if e == nil {
+		return
+	}
+
+	e.Duration = time.Since(e.Start)
+	e.Err = err
+	for i := len(mrDB.hooks) - 1; i >= 0; i-- {
+		mrDB.hooks[i].After(ctx, e)
+	}
+}
+
+//慢查询日志，耗时超过threshold时通过clog输出
+type SlowLogHook struct {
+	threshold time.Duration
+	//输出sql参数，参数可能包含用户数据，默认不输出
+	LogArgs bool
+
+	warnf func(ctx context.Context, format string, args ...interface{})
+}
+
+func NewSlowLogHook(threshold time.Duration) *SlowLogHook {
+	return &SlowLogHook{threshold: threshold, warnf: clog.WarnfCtx}
+}
+
+func (h *SlowLogHook) Before(ctx context.Context, e *QueryEvent) context.Context {
+	return ctx
+}
+
+func (h *SlowLogHook) After(ctx context.Context, e *QueryEvent) {
+	if e.Duration < h.threshold {
+		return
+	}
+	if h.LogArgs {
+		h.warnf(ctx, "slow sql %s %s on %s/%s: %s, args: %v, err: %v", e.Op, e.Duration, e.Shard, e.Target, e.Query, e.Args, e.Err)
+		return
+	}
+	h.warnf(ctx, "slow sql %s %s on %s/%s: %s, args: %d, err: %v", e.Op, e.Duration, e.Shard, e.Target, e.Query, len(e.Args), e.Err)
+}
+
+//为每次sql调用开始一个span，ctx中没有trace时不开始新的trace
+//span结束时以debug级别输出，日志带trace_id和span_id
+type TraceHook struct{}
+
+func (TraceHook) Before(ctx context.Context, e *QueryEvent) context.Context {
+	if _, ok := trace.FromContext(ctx); !ok {
+		return ctx
+	}
+	ctx, _ = trace.StartSpan(ctx)
+	return ctx
+}
+
+func (TraceHook) After(ctx context.Context, e *QueryEvent) {
+	if _, ok := trace.FromContext(ctx); !ok {
+		return
+	}
+	clog.DebugfCtx(ctx, "sql span %s %s on %s/%s: %s, err: %v", e.Op, e.Duration, e.Shard, e.Target, e.Query, e.Err)
+}
+
+//sql耗时直方图，按db、连接、操作统计
+type LatencyHook struct {
+	mu      sync.RWMutex
+	buckets []float64
+	series  map[latencyKey]*latencySeries
+}
+
+type latencyKey struct {
+	shard  string
+	target string
+	op     string
+}
+
+type latencySeries struct {
+	count    int64
+	errors   int64
+	sumNanos int64
+	buckets  []int64
+}
+
+//默认分桶，单位秒
+var DefaultQueryBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+func NewLatencyHook(buckets []float64) *LatencyHook {
+	if len(buckets) == 0 {
+		buckets = DefaultQueryBuckets
+	}
+	return &LatencyHook{
+		buckets: buckets,
+		series:  make(map[latencyKey]*latencySeries),
+	}
+}
+
+func (h *LatencyHook) Before(ctx context.Context, e *QueryEvent) context.Context {
+	return ctx
+}
+
+func (h *LatencyHook) After(ctx context.Context, e *QueryEvent) {
+	s := h.get(latencyKey{shard: e.Shard, target: e.Target, op: e.Op})
+
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.sumNanos, int64(e.Duration))
+	if e.Err != nil {
+		atomic.AddInt64(&s.errors, 1)
+	}
+
+	seconds := e.Duration.Seconds()
+	for i, le := range h.buckets {
+		if seconds <= le {
+			atomic.AddInt64(&s.buckets[i], 1)
+		}
+	}
+}
+
+func (h *LatencyHook) get(key latencyKey) *latencySeries {
+	h.mu.RLock()
+	s, ok := h.series[key]
+	h.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[key]; ok {
+		return s
+	}
+	s = &latencySeries{buckets: make([]int64, len(h.buckets))}
+	h.series[key] = s
+	return s
+}
+
+//以prometheus文本格式输出sql耗时直方图和错误数
+func (h *LatencyHook) WritePrometheus(w io.Writer) error {
+	h.mu.RLock()
+	keys := make([]latencyKey, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	h.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.shard != b.shard {
+			return a.shard < b.shard
+		}
+		if a.target != b.target {
+			return a.target < b.target
+		}
+		return a.op < b.op
+	})
+
+	fmt.Fprintln(w, "# TYPE db_query_seconds histogram")
+	for _, key := range keys {
+		s := h.get(key)
+		labels := fmt.Sprintf("db=%q,conn=%q,op=%q", key.shard, key.target, key.op)
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "db_query_seconds_bucket{%s,le=%q} %d\n", labels, strconv.FormatFloat(le, 'g', -1, 64), atomic.LoadInt64(&s.buckets[i]))
+		}
+		count := atomic.LoadInt64(&s.count)
+		fmt.Fprintf(w, "db_query_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, count)
+		fmt.Fprintf(w, "db_query_seconds_sum{%s} %g\n", labels, time.Duration(atomic.LoadInt64(&s.sumNanos)).Seconds())
+		fmt.Fprintf(w, "db_query_seconds_count{%s} %d\n", labels, count)
+	}
+
+	fmt.Fprintln(w, "# TYPE db_query_errors counter")
+	for _, key := range keys {
+		s := h.get(key)
+		_, err := fmt.Fprintf(w, "db_query_errors{db=%q,conn=%q,op=%q} %d\n", key.shard, key.target, key.op, atomic.LoadInt64(&s.errors))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/internal/fakedb"
+	"github.com/yybirdcf/golib/trace"
+)
+
+type hookCtxKey struct{}
+
+//记录调用顺序和事件的钩子
+type recordHook struct {
+	name   string
+	calls  *[]string
+	events []QueryEvent
+}
+
+func (h *recordHook) Before(ctx context.Context, e *QueryEvent) context.Context {
+	*h.calls = append(*h.calls, "before "+h.name+" "+e.Op)
+	return context.WithValue(ctx, hookCtxKey{}, h.name)
+}
+
+func (h *recordHook) After(ctx context.Context, e *QueryEvent) {
+	//After收到的是Before返回的ctx
+	*h.calls = append(*h.calls, fmt.Sprintf("after %s %s %v", h.name, e.Op, ctx.Value(hookCtxKey{})))
+	h.events = append(h.events, *e)
+}
+
+func TestHooks(t *testing.T) {
+	var calls []string
+	first := &recordHook{name: "first", calls: &calls}
+	second := &recordHook{name: "second", calls: &calls}
+
+	manager := NewDBManager()
+	dsn, s := fakedb.NewServer(t, "db0")
+	if err := manager.AddDB("db0", &MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn, Hooks: []Hook{first, second}}); err != nil {
+		t.Fatal(err)
+	}
+	db := manager.DBs()["db0"].MRDB()
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("UPDATE t SET v = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"before first exec", "before second exec", "after second exec second", "after first exec second"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+	e := first.events[0]
+	if e.Query != "UPDATE t SET v = ?" || !reflect.DeepEqual(e.Args, []interface{}{1}) || e.Target != "master" || e.Shard != "db0" || e.Err != nil || e.Start.IsZero() {
+		t.Fatalf("event = %+v", e)
+	}
+
+	rows, err := db.Query("SELECT v FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	var v interface{}
+	db.QueryRow("SELECT v FROM t").Scan(&v)
+
+	//直接在*sql.Tx上执行的sql不经过钩子，只有开始和提交回滚
+	db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE t SET v = 2")
+		return err
+	})
+	//*Tx上执行的sql经过钩子
+	err = db.WithHookedTx(context.Background(), nil, func(ctx context.Context, tx *Tx) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE t SET v = 4"); err != nil {
+			return err
+		}
+		rows, err := tx.Query("SELECT v FROM t")
+		if err != nil {
+			return err
+		}
+		rows.Close()
+		return tx.QueryRowContext(ctx, "SELECT v FROM t").Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	boom := errors.New("boom")
+	db.WithTx(context.Background(), nil, func(tx *sql.Tx) error { return boom })
+
+	s.SetErr(boom)
+	db.Exec("UPDATE t SET v = 3")
+
+	var got []string
+	for _, e := range first.events {
+		got = append(got, fmt.Sprintf("%s %s %v", e.Op, e.Target, e.Err))
+	}
+	want = []string{
+		"exec master <nil>",
+		"query replica-0 <nil>",
+		"query_row replica-0 <nil>",
+		"begin master <nil>",
+		"commit master <nil>",
+		"begin master <nil>",
+		"exec master <nil>",
+		"query master <nil>",
+		"query_row master <nil>",
+		"commit master <nil>",
+		"begin master <nil>",
+		"rollback master <nil>",
+		"exec master boom",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
+
+func TestSlowLogHook(t *testing.T) {
+	var logs []string
+	h := NewSlowLogHook(100 * time.Millisecond)
+	h.warnf = func(ctx context.Context, format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	e := &QueryEvent{Op: OpQuery, Query: "SELECT * FROM users WHERE phone = ?", Args: []interface{}{"13800000000"}, Target: "master", Shard: "db0"}
+	e.Duration = 99 * time.Millisecond
+	h.After(context.Background(), e)
+	if len(logs) != 0 {
+		t.Fatalf("logged fast query: %v", logs)
+	}
+
+	//默认只输出参数个数
+	e.Duration = 100 * time.Millisecond
+	h.After(context.Background(), e)
+	if len(logs) != 1 || strings.Contains(logs[0], "13800000000") || !strings.Contains(logs[0], "args: 1,") || !strings.Contains(logs[0], "on db0/master: SELECT") {
+		t.Fatalf("logs = %v", logs)
+	}
+
+	h.LogArgs = true
+	h.After(context.Background(), e)
+	if len(logs) != 2 || !strings.Contains(logs[1], "args: [13800000000]") {
+		t.Fatalf("logs = %v", logs)
+	}
+}
+
+func TestLatencyHook(t *testing.T) {
+	h := NewLatencyHook([]float64{0.01, 0.1})
+	ctx := context.Background()
+	h.After(ctx, &QueryEvent{Op: OpQuery, Target: "replica-0", Shard: "db0", Duration: 5 * time.Millisecond})
+	h.After(ctx, &QueryEvent{Op: OpQuery, Target: "replica-0", Shard: "db0", Duration: 50 * time.Millisecond, Err: errors.New("boom")})
+	h.After(ctx, &QueryEvent{Op: OpExec, Target: "master", Shard: "db0", Duration: time.Second})
+
+	var sb strings.Builder
+	if err := h.WritePrometheus(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE db_query_seconds histogram
+db_query_seconds_bucket{db="db0",conn="master",op="exec",le="0.01"} 0
+db_query_seconds_bucket{db="db0",conn="master",op="exec",le="0.1"} 0
+db_query_seconds_bucket{db="db0",conn="master",op="exec",le="+Inf"} 1
+db_query_seconds_sum{db="db0",conn="master",op="exec"} 1
+db_query_seconds_count{db="db0",conn="master",op="exec"} 1
+db_query_seconds_bucket{db="db0",conn="replica-0",op="query",le="0.01"} 1
+db_query_seconds_bucket{db="db0",conn="replica-0",op="query",le="0.1"} 2
+db_query_seconds_bucket{db="db0",conn="replica-0",op="query",le="+Inf"} 2
+db_query_seconds_sum{db="db0",conn="replica-0",op="query"} 0.055
+db_query_seconds_count{db="db0",conn="replica-0",op="query"} 2
+# TYPE db_query_errors counter
+db_query_errors{db="db0",conn="master",op="exec"} 0
+db_query_errors{db="db0",conn="replica-0",op="query"} 1
+`
+	if got := sb.String(); got != want {
+		t.Fatalf("WritePrometheus() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestTraceHook(t *testing.T) {
+	var h TraceHook
+	e := &QueryEvent{Op: OpExec}
+
+	//没有trace时不开始新的trace
+	ctx := h.Before(context.Background(), e)
+	if _, ok := trace.FromContext(ctx); ok {
+		t.Fatal("Before() started a trace")
+	}
+
+	parent, sc := trace.StartSpan(context.Background())
+	ctx = h.Before(parent, e)
+	child, ok := trace.FromContext(ctx)
+	if !ok || child.TraceID != sc.TraceID || child.SpanID == sc.SpanID {
+		t.Fatalf("span = %+v, parent = %+v", child, sc)
+	}
+	h.After(ctx, e)
+}
@@ -0,0 +1,308 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//结构体字段和列的映射，按db tag：
+//	`db:"name"`     列名
+//	`db:"-"`        忽略
+//	`db:"id,auto"`  自增列，InsertStructs时不写入
+//没有tag的字段列名为字段名的下划线形式，如UserID对应user_id；匿名结构体字段展开
+type structField struct {
+	column string
+	index  []int
+	auto   bool
+}
+
+type structMap struct {
+	fields  []structField
+	columns map[string]*structField
+}
+
+var structMaps sync.Map
+
+func getStructMap(t reflect.Type) *structMap {
+	if m, ok := structMaps.Load(t); ok {
+		return m.(*structMap)
+	}
+
+	m := &structMap{columns: make(map[string]*structField)}
+	collectFields(t, nil, m)
+	for i := range m.fields {
+		f := &m.fields[i]
+		if _, ok := m.columns[f.column]; !ok {
+			m.columns[f.column] = f
+		}
+	}
+
+	actual, _ := structMaps.LoadOrStore(t, m)
+	return actual.(*structMap)
+}
+
+func collectFields(t reflect.Type, index []int, m *structMap) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("db")
+		if tag == "-" {
+			continue
+		}
+
+		idx := append(append([]int(nil), index...), i)
+		if f.Anonymous && tag == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				//未导出类型的结构体指针无法分配，同encoding/json忽略
+				if f.PkgPath != "" {
+					continue
+				}
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				collectFields(ft, idx, m)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			//未导出
+			continue
+		}
+
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		if name == "" {
+			name = snakeCase(f.Name)
+		}
+
+		m.fields = append(m.fields, structField{
+			column: name,
+			index:  idx,
+			auto:   opts == "auto",
+		})
+	}
+}
+
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			//UserID -> user_id，HTTPServer -> http_server
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+//字段的地址，嵌入的结构体指针为nil时分配
+func fieldAddr(v reflect.Value, index []int) interface{} {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v.Addr().Interface()
+}
+
+func fieldValue(v reflect.Value, index []int) (interface{}, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return nil, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v.Interface(), true
+}
+
+//把当前行扫描到结构体指针，没有对应字段的列丢弃
+func ScanStruct(rows *sql.Rows, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("scan dest must be a pointer to struct, got %T", dest)
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	return scanStruct(rows, columns, v.Elem())
+}
+
+func scanStruct(rows *sql.Rows, columns []string, v reflect.Value) error {
+	m := getStructMap(v.Type())
+	dest := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if f, ok := m.columns[column]; ok {
+			dest[i] = fieldAddr(v, f.index)
+		} else {
+			dest[i] = new(interface{})
+		}
+	}
+	return rows.Scan(dest...)
+}
+
+//把所有行扫描到结构体切片指针，如*[]User、*[]*User；元素不是结构体时按单列扫描，如*[]int64
+//会关闭rows
+func ScanAll(rows *sql.Rows, dest interface{}) error {
+	defer rows.Close()
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("scan dest must be a pointer to slice, got %T", dest)
+	}
+
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		elem := reflect.New(elemType)
+		if elemType.Kind() == reflect.Struct && !isScanner(elemType) {
+			err = scanStruct(rows, columns, elem.Elem())
+		} else {
+			err = rows.Scan(elem.Interface())
+		}
+		if err != nil {
+			return err
+		}
+
+		if isPtr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+	}
+	return rows.Err()
+}
+
+//扫描第一行到结构体指针或单列的指针，没有行时返回sql.ErrNoRows，会关闭rows
+func ScanOne(rows *sql.Rows, dest interface{}) error {
+	defer rows.Close()
+
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr {
+		return fmt.Errorf("scan dest must be a pointer, got %T", dest)
+	}
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	var err error
+	if v.Elem().Kind() == reflect.Struct && !isScanner(v.Elem().Type()) {
+		err = ScanStruct(rows, dest)
+	} else {
+		err = rows.Scan(dest)
+	}
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+//time.Time、sql.NullString等自己实现扫描的结构体按单列扫描
+func isScanner(t reflect.Type) bool {
+	return reflect.PtrTo(t).Implements(scannerType) || t.PkgPath() == "time"
+}
+
+//查询到结构体切片，按MRDB的规则选择从库或主库
+func (mrDB *MRDB) Select(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	rows, err := mrDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return ScanAll(rows, dest)
+}
+
+//查询一行到结构体，没有行时返回sql.ErrNoRows
+func (mrDB *MRDB) Get(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	rows, err := mrDB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	return ScanOne(rows, dest)
+}
+
+//结构体的列和值，跳过auto列
+func structValues(v reflect.Value) ([]string, []interface{}) {
+	m := getStructMap(v.Type())
+	columns := make([]string, 0, len(m.fields))
+	values := make([]interface{}, 0, len(m.fields))
+	for _, f := range m.fields {
+		if f.auto {
+			continue
+		}
+		value, ok := fieldValue(v, f.index)
+		if !ok {
+			value = nil
+		}
+		columns = append(columns, f.column)
+		values = append(values, value)
+	}
+	return columns, values
+}
+
+//批量插入结构体切片，每chunkSize行一条INSERT，返回影响的总行数
+func (mrDB *MRDB) InsertStructs(ctx context.Context, table string, slice interface{}, chunkSize int) (int64, error) {
+	v := reflect.ValueOf(slice)
+	if v.Kind() != reflect.Slice {
+		return 0, fmt.Errorf("insert structs need a slice, got %T", slice)
+	}
+	if v.Len() == 0 {
+		return 0, nil
+	}
+
+	var columns []string
+	rows := make([][]interface{}, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			return 0, errors.New("insert structs need a slice of struct")
+		}
+
+		cols, values := structValues(elem)
+		if columns == nil {
+			columns = cols
+		}
+		rows = append(rows, values)
+	}
+
+	return mrDB.BulkInsert(ctx, table, columns, rows, chunkSize)
+}
@@ -0,0 +1,223 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+type MapperAudit struct {
+	CreatedAt time.Time
+}
+
+type mapperUser struct {
+	ID       int64  `db:"id,auto"`
+	UserName string
+	Email    string `db:"mail"`
+	Secret   string `db:"-"`
+	note     string
+	*MapperAudit
+}
+
+type mapperHidden struct {
+	Hidden string
+}
+
+//未导出类型的嵌入结构体指针不映射
+type mapperUserHidden struct {
+	ID int64
+	*mapperHidden
+}
+
+func newMapperDB(t *testing.T) (*MRDB, *fakedb.Server) {
+	dsn, s := fakedb.NewServer(t, "master")
+	db, err := NewMRDB(&MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, s
+}
+
+func TestSnakeCase(t *testing.T) {
+	tests := map[string]string{
+		"ID":         "id",
+		"UserID":     "user_id",
+		"UserName":   "user_name",
+		"HTTPServer": "http_server",
+		"CreatedAt":  "created_at",
+		"name":       "name",
+	}
+	for name, want := range tests {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestScanAll(t *testing.T) {
+	db, s := newMapperDB(t)
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	//多余的列丢弃，嵌入的结构体指针按需分配
+	s.SetRows([]string{"id", "user_name", "mail", "created_at", "extra"},
+		[]driver.Value{int64(1), "alice", "a@x.com", created, "x"},
+		[]driver.Value{int64(2), "bob", "b@x.com", created, "y"},
+	)
+
+	var users []mapperUser
+	if err := db.Select(context.Background(), &users, "SELECT * FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[1].ID != 2 || users[1].UserName != "bob" || users[1].Email != "b@x.com" || !users[1].CreatedAt.Equal(created) {
+		t.Fatalf("users = %+v", users)
+	}
+
+	var ptrs []*mapperUser
+	if err := db.Select(context.Background(), &ptrs, "SELECT * FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 2 || ptrs[0].UserName != "alice" {
+		t.Fatalf("ptrs = %+v", ptrs)
+	}
+
+	//不是结构体的元素按单列扫描
+	s.SetRows([]string{"id"}, []driver.Value{int64(7)}, []driver.Value{int64(8)})
+	var ids []int64
+	if err := db.Select(context.Background(), &ids, "SELECT id FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int64{7, 8}) {
+		t.Fatalf("ids = %v", ids)
+	}
+
+	var times []time.Time
+	s.SetRows([]string{"created_at"}, []driver.Value{created})
+	if err := db.Select(context.Background(), &times, "SELECT created_at FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 1 || !times[0].Equal(created) {
+		t.Fatalf("times = %v", times)
+	}
+
+	s.SetRows([]string{"id", "hidden"}, []driver.Value{int64(3), "h"})
+	var hidden []mapperUserHidden
+	if err := db.Select(context.Background(), &hidden, "SELECT id, hidden FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	if len(hidden) != 1 || hidden[0].ID != 3 || hidden[0].mapperHidden != nil {
+		t.Fatalf("hidden = %+v", hidden)
+	}
+
+	if err := db.Select(context.Background(), users, "SELECT * FROM users"); err == nil {
+		t.Fatal("Select() into non pointer should fail")
+	}
+}
+
+func TestScanOne(t *testing.T) {
+	db, s := newMapperDB(t)
+	s.SetRows([]string{"id", "user_name"}, []driver.Value{int64(1), "alice"}, []driver.Value{int64(2), "bob"})
+
+	//只取第一行
+	var u mapperUser
+	if err := db.Get(context.Background(), &u, "SELECT id, user_name FROM users"); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 1 || u.UserName != "alice" || u.MapperAudit != nil {
+		t.Fatalf("user = %+v", u)
+	}
+
+	s.SetRows([]string{"n"}, []driver.Value{int64(3)})
+	var n int64
+	if err := db.Get(context.Background(), &n, "SELECT COUNT(*) FROM users"); err != nil || n != 3 {
+		t.Fatalf("Get() = %d, %v", n, err)
+	}
+
+	s.SetRows([]string{"id"})
+	if err := db.Get(context.Background(), &u, "SELECT id FROM users"); err != sql.ErrNoRows {
+		t.Fatalf("Get() without rows = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestScanStruct(t *testing.T) {
+	db, s := newMapperDB(t)
+	s.SetRows([]string{"id", "mail"}, []driver.Value{int64(5), "e@x.com"})
+
+	rows, err := db.QueryContext(context.Background(), "SELECT id, mail FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		t.Fatal(rows.Err())
+	}
+
+	var id int64
+	if err := ScanStruct(rows, &id); err == nil {
+		t.Fatal("ScanStruct() into non struct should fail")
+	}
+	var u mapperUser
+	if err := ScanStruct(rows, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != 5 || u.Email != "e@x.com" {
+		t.Fatalf("user = %+v", u)
+	}
+}
+
+func TestInsertStructs(t *testing.T) {
+	db, s := newMapperDB(t)
+	var queries []string
+	var args [][]driver.Value
+	s.SetHandlers(nil, func(ctx context.Context, query string, a []driver.Value) (driver.Result, error) {
+		queries = append(queries, query)
+		args = append(args, a)
+		return driver.RowsAffected(len(a) / 3), nil
+	})
+
+	created := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	users := []*mapperUser{
+		{ID: 9, UserName: "a", Email: "a@x.com", Secret: "s", MapperAudit: &MapperAudit{CreatedAt: created}},
+		{UserName: "b", Email: "b@x.com"},
+		{UserName: "c", Email: "c@x.com"},
+	}
+	//auto和db:"-"的列不写入，嵌入的结构体指针为nil时写入NULL
+	n, err := db.InsertStructs(context.Background(), "users", users, 2)
+	if err != nil || n != 3 {
+		t.Fatalf("InsertStructs() = %d, %v", n, err)
+	}
+	want := []string{
+		"INSERT INTO users (user_name, mail, created_at) VALUES (?, ?, ?), (?, ?, ?)",
+		"INSERT INTO users (user_name, mail, created_at) VALUES (?, ?, ?)",
+	}
+	if !reflect.DeepEqual(queries, want) {
+		t.Fatalf("queries = %q", queries)
+	}
+	if !reflect.DeepEqual(args[0], []driver.Value{"a", "a@x.com", created, "b", "b@x.com", nil}) {
+		t.Fatalf("args = %v", args[0])
+	}
+
+	if n, err := db.InsertStructs(context.Background(), "users", []mapperUser{}, 0); err != nil || n != 0 {
+		t.Fatalf("InsertStructs() empty = %d, %v", n, err)
+	}
+	if _, err := db.InsertStructs(context.Background(), "users", []int{1}, 0); err == nil {
+		t.Fatal("InsertStructs() of non struct should fail")
+	}
+}
+
+func TestBulkInsertRowLength(t *testing.T) {
+	db, s := newMapperDB(t)
+
+	//值个数不对时一行都不插入
+	rows := [][]interface{}{{1, "a"}, {2}}
+	if _, err := db.BulkInsert(context.Background(), "t", []string{"id", "name"}, rows, 1); err == nil {
+		t.Fatal("BulkInsert() with short row should fail")
+	}
+	if execs := s.ExecLog(); len(execs) != 0 {
+		t.Fatalf("execs = %q", execs)
+	}
+}
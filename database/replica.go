@@ -0,0 +1,265 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/yybirdcf/golib/breaker"
+	"github.com/yybirdcf/golib/clog"
+	"github.com/yybirdcf/golib/wait"
+)
+
+//检测从库复制延迟
+type LagFunc func(ctx context.Context, db *sql.DB) (time.Duration, error)
+
+//从库状态
+type ReplicaStatus struct {
+	Index   int
+	Healthy bool
+	Lag     time.Duration
+	//未开启熔断时为Closed
+	Breaker breaker.State
+}
+
+//mysql从库延迟，SHOW REPLICA STATUS（8.0.22以上）或SHOW SLAVE STATUS
+//不是从库时返回0，复制中断时返回错误
+func MySQLReplicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	lag, err := showReplicaLag(ctx, db, "SHOW REPLICA STATUS", "Seconds_Behind_Source")
+	if err == nil {
+		return lag, nil
+	}
+	return showReplicaLag(ctx, db, "SHOW SLAVE STATUS", "Seconds_Behind_Master")
+}
+
+func showReplicaLag(ctx context.Context, db *sql.DB, query string, column string) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	if !rows.Next() {
+		//不是从库
+		return 0, rows.Err()
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+
+	for i, name := range columns {
+		if name != column {
+			continue
+		}
+		if values[i] == nil {
+			return 0, errors.New("replication is not running")
+		}
+		seconds, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, fmt.Errorf("%s not found in %s", column, query)
+}
+
+//基于心跳表的延迟检测，主库定期更新表中的ts字段（DATETIME/TIMESTAMP），如pt-heartbeat
+func HeartbeatLag(table string) LagFunc {
+	query := fmt.Sprintf("SELECT UNIX_TIMESTAMP(NOW(6)) - UNIX_TIMESTAMP(MAX(ts)) FROM %s", table)
+	return func(ctx context.Context, db *sql.DB) (time.Duration, error) {
+		var seconds sql.NullFloat64
+		if err := db.QueryRowContext(ctx, query).Scan(&seconds); err != nil {
+			return 0, err
+		}
+		if !seconds.Valid {
+			return 0, errors.New("heartbeat table is empty")
+		}
+		return time.Duration(seconds.Float64 * float64(time.Second)), nil
+	}
+}
+
+func (c *conn) isHealthy() bool {
+	return atomic.LoadInt32(&c.healthy) == 1
+}
+
+func (c *conn) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&c.healthy, v)
+}
+
+func newReplicaBreaker(label string, cfg *breaker.Config) *breaker.Breaker {
+	c := *cfg
+	if c.IsFailure == nil {
+		c.IsFailure = IsReplicaFailure
+	}
+	if c.OnStateChange == nil {
+		c.OnStateChange = func(name string, from breaker.State, to breaker.State) {
+			clog.Warnf("%s breaker %s -> %s", name, from, to)
+		}
+	}
+	return breaker.NewBreaker(label, &c)
+}
+
+//从库熔断默认的失败判断，只算连接、驱动错误和不是调用方造成的超时
+//sql语法、约束等mysql返回的错误以及调用方ctx取消或超时不算
+func IsReplicaFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ce *callerCtxError
+	if errors.As(err, &ce) {
+		return false
+	}
+	if _, ok := mysqlErrorNumber(err); ok {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+//调用方ctx已结束时的错误，不是从库的问题
+type callerCtxError struct {
+	err error
+}
+
+func (e *callerCtxError) Error() string {
+	return e.err.Error()
+}
+
+func (e *callerCtxError) Unwrap() error {
+	return e.err
+}
+
+//熔断器是否放行，放行时返回的done需要传入调用结果
+//调用方ctx已结束时的错误包装成callerCtxError，IsFailure可以用errors.As区分
+func (c *conn) allow(ctx context.Context) (func(error), bool) {
+	if c.breaker == nil {
+		return func(error) {}, true
+	}
+	done, err := c.breaker.Allow()
+	if err != nil {
+		return nil, false
+	}
+	return func(err error) {
+		if err != nil && ctx.Err() != nil {
+			err = &callerCtxError{err: err}
+		}
+		done(err)
+	}, true
+}
+
+func (c *conn) breakerState() breaker.State {
+	if c.breaker == nil {
+		return breaker.Closed
+	}
+	return c.breaker.State()
+}
+
+//从当前轮询位置开始的健康且未熔断的从库
+func (mrDB *MRDB) readConns() []*conn {
+	n := len(mrDB.reads)
+	idx := uint64(mrDB.readDBIndex())
+
+	conns := make([]*conn, 0, n)
+	for i := 0; i < n; i++ {
+		c := mrDB.reads[(idx+uint64(i))%uint64(n)]
+		if c.isHealthy() && c.breakerState() != breaker.Open {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+//从库状态，Index为ReadDSNs中的下标
+func (mrDB *MRDB) ReplicaStatus() []ReplicaStatus {
+	status := make([]ReplicaStatus, 0, len(mrDB.reads))
+	for i, c := range mrDB.reads {
+		status = append(status, ReplicaStatus{
+			Index:   i,
+			Healthy: c.isHealthy(),
+			Lag:     time.Duration(atomic.LoadInt64(&c.lag)),
+			Breaker: c.breakerState(),
+		})
+	}
+	return status
+}
+
+func (mrDB *MRDB) runHealthCheck() {
+	wait.Until(func() {
+		//上一轮检查还没结束时跳过
+		if !atomic.CompareAndSwapInt32(&mrDB.checking, 0, 1) {
+			return
+		}
+		defer atomic.StoreInt32(&mrDB.checking, 0)
+
+		for i, c := range mrDB.reads {
+			mrDB.checkReplica(i, c)
+		}
+	}, mrDB.interval, mrDB.stopCh)
+}
+
+//ping从库并检测延迟，不可用或延迟超过MaxLag的从库移出轮询
+func (mrDB *MRDB) checkReplica(index int, c *conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), mrDB.interval)
+	defer cancel()
+
+	if err := c.db.PingContext(ctx); err != nil {
+		if c.isHealthy() {
+			clog.Errorf("replica %d ping err: %v", index, err)
+			//连接断开后服务端的预编译语句已失效
+			if c.stmts != nil {
+				c.stmts.purge()
+			}
+		}
+		c.setHealthy(false)
+		return
+	}
+
+	if mrDB.maxLag > 0 {
+		lag, err := mrDB.lagFunc(ctx, c.db)
+		if err != nil {
+			if c.isHealthy() {
+				clog.Errorf("replica %d check lag err: %v", index, err)
+			}
+			c.setHealthy(false)
+			return
+		}
+
+		atomic.StoreInt64(&c.lag, int64(lag))
+		if lag > mrDB.maxLag {
+			if c.isHealthy() {
+				clog.Warnf("replica %d lag %s exceeds %s", index, lag, mrDB.maxLag)
+			}
+			c.setHealthy(false)
+			return
+		}
+	}
+
+	c.setHealthy(true)
+}
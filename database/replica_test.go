@@ -0,0 +1,182 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/yybirdcf/golib/breaker"
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+//从fakedb.Server读取配置的延迟秒数
+func fakeLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	var seconds int64
+	if err := db.QueryRowContext(ctx, "SELECT lag").Scan(&seconds); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func TestNewMRDBMaxLagRequiresHealthCheck(t *testing.T) {
+	dsn, _ := fakedb.NewServer(t, "master")
+	_, err := NewMRDB(&MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn, MaxLag: time.Second})
+	if err == nil {
+		t.Fatal("expected error when MaxLag is set without HealthCheckInterval")
+	}
+}
+
+func TestNewMRDBUnhealthyReplica(t *testing.T) {
+	master, _ := fakedb.NewServer(t, "master")
+	replica, rs := fakedb.NewServer(t, "replica")
+	rs.SetDown(true)
+
+	if _, err := NewMRDB(&MRDBConfig{DN: fakedb.Driver, MasterDSN: master, ReadDSNs: []string{replica}}); err == nil {
+		t.Fatal("expected ping error without health check")
+	}
+
+	mrDB, err := NewMRDB(&MRDBConfig{DN: fakedb.Driver, MasterDSN: master, ReadDSNs: []string{replica}, HealthCheckInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mrDB.Close()
+	if mrDB.ReplicaStatus()[0].Healthy {
+		t.Fatal("replica should start unhealthy")
+	}
+}
+
+func TestCheckReplica(t *testing.T) {
+	master, _ := fakedb.NewServer(t, "master")
+	replica, rs := fakedb.NewServer(t, "replica")
+
+	mrDB, err := NewMRDB(&MRDBConfig{DN: fakedb.Driver, MasterDSN: master, ReadDSNs: []string{replica}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mrDB.Close()
+	//不启动后台检查，直接调用checkReplica
+	mrDB.interval = time.Second
+	mrDB.maxLag = 5 * time.Second
+	mrDB.lagFunc = fakeLag
+
+	lagRows := func(seconds int64) {
+		rs.SetRows([]string{"lag"}, []driver.Value{seconds})
+	}
+
+	tests := []struct {
+		name    string
+		setup   func()
+		healthy bool
+		lag     time.Duration
+	}{
+		{"healthy", func() { lagRows(1) }, true, time.Second},
+		{"lag exceeds", func() { lagRows(10) }, false, 10 * time.Second},
+		{"lag recovers", func() { lagRows(5) }, true, 5 * time.Second},
+		{"ping fails", func() { rs.SetDown(true) }, false, 5 * time.Second},
+		{"ping recovers", func() { rs.SetDown(false) }, true, 5 * time.Second},
+		{"lag check fails", func() { rs.SetErr(errors.New("replication is not running")) }, false, 5 * time.Second},
+		{"lag check recovers", func() { rs.SetErr(nil); lagRows(0) }, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			mrDB.checkReplica(0, mrDB.reads[0])
+
+			status := mrDB.ReplicaStatus()[0]
+			if status.Healthy != tt.healthy {
+				t.Fatalf("healthy = %v, want %v", status.Healthy, tt.healthy)
+			}
+			if status.Lag != tt.lag {
+				t.Fatalf("lag = %s, want %s", status.Lag, tt.lag)
+			}
+			if n := len(mrDB.readConns()); tt.healthy != (n == 1) {
+				t.Fatalf("readConns = %d, healthy %v", n, tt.healthy)
+			}
+		})
+	}
+}
+
+func TestIsReplicaFailure(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{driver.ErrBadConn, true},
+		{mysql.ErrInvalidConn, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{context.DeadlineExceeded, true},
+		{&mysql.MySQLError{Number: 1064, Message: "syntax error"}, false},
+		{&mysql.MySQLError{Number: 1062, Message: "duplicate entry"}, false},
+		{context.Canceled, false},
+		{&callerCtxError{err: context.DeadlineExceeded}, false},
+	}
+	for _, c := range cases {
+		if got := IsReplicaFailure(c.err); got != c.want {
+			t.Errorf("IsReplicaFailure(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestReplicaBreaker(t *testing.T) {
+	master, _ := fakedb.NewServer(t, "master")
+	replica, rs := fakedb.NewServer(t, "replica")
+
+	mrDB, err := NewMRDB(&MRDBConfig{
+		DN:             fakedb.Driver,
+		MasterDSN:      master,
+		ReadDSNs:       []string{replica},
+		ReplicaBreaker: &breaker.Config{MinRequests: 2, ErrorRate: 0.5, OpenTimeout: time.Hour},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mrDB.Close()
+	query := func(ctx context.Context) {
+		if rows, err := mrDB.QueryContext(ctx, "SELECT v FROM t"); err == nil {
+			rows.Close()
+		}
+	}
+	state := func() breaker.State {
+		return mrDB.ReplicaStatus()[0].Breaker
+	}
+
+	//sql错误是调用方的问题
+	rs.SetErr(&mysql.MySQLError{Number: 1064, Message: "syntax error"})
+	query(context.Background())
+	query(context.Background())
+	if s := state(); s != breaker.Closed {
+		t.Fatalf("breaker after syntax errors = %s", s)
+	}
+
+	//调用方ctx超时或取消
+	rs.SetErr(nil)
+	rs.SetHandlers(func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	query(ctx)
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	query(canceled)
+	if s := state(); s != breaker.Closed {
+		t.Fatalf("breaker after caller timeouts = %s", s)
+	}
+
+	//连接错误打开熔断，前面4次算成功，失败比例达到0.5
+	rs.SetHandlers(nil, nil)
+	rs.SetErr(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")})
+	for i := 0; i < 4; i++ {
+		query(context.Background())
+	}
+	if s := state(); s != breaker.Open {
+		t.Fatalf("breaker after connection errors = %s", s)
+	}
+}
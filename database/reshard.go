@@ -0,0 +1,632 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+)
+
+//迁移进度，key为源分片，value为已迁移并校验通过的最大主键，带类型编码，如int64:100
+type CheckpointStore interface {
+	Load(key string) (string, bool, error)
+	Save(key string, pk string) error
+}
+
+//内存中的进度，进程退出后丢失
+type MemoryCheckpoint struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func NewMemoryCheckpoint() *MemoryCheckpoint {
+	return &MemoryCheckpoint{data: make(map[string]string)}
+}
+
+func (c *MemoryCheckpoint) Load(key string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pk, ok := c.data[key]
+	return pk, ok, nil
+}
+
+func (c *MemoryCheckpoint) Save(key string, pk string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = pk
+	return nil
+}
+
+//保存到json文件的进度，中断后重新执行从上次的位置继续
+type FileCheckpoint struct {
+	mu   sync.Mutex
+	path string
+	data map[string]string
+}
+
+func NewFileCheckpoint(path string) (*FileCheckpoint, error) {
+	c := &FileCheckpoint{
+		path: path,
+		data: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &c.data); err != nil {
+		return nil, fmt.Errorf("parse checkpoint %s err: %v", path, err)
+	}
+	return c, nil
+}
+
+func (c *FileCheckpoint) Load(key string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pk, ok := c.data[key]
+	return pk, ok, nil
+}
+
+//先写临时文件再rename，避免中断时文件损坏
+func (c *FileCheckpoint) Save(key string, pk string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.data[key] = pk
+	data, err := json.MarshalIndent(c.data, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+type ReshardConfig struct {
+	//逻辑表名，物理表名为表名 + Shard.Suffix
+	Table string
+	//分片key所在的列
+	KeyColumn string
+	//按批迁移的有序唯一列，默认KeyColumn
+	PKColumn string
+
+	From ShardingStrategy
+	To   ShardingStrategy
+	//源分片和目标分片，为空时From、To需要实现ShardLister
+	Sources []Shard
+	Targets []Shard
+
+	//每批行数，默认1000
+	BatchSize int
+	//每批之间的间隔，用于限流
+	Pause time.Duration
+	//每批校验不一致时修复后重新校验的次数，默认3
+	VerifyRetries int
+	//迁移进度，默认内存
+	Checkpoint CheckpointStore
+}
+
+//迁移结果
+type ReshardReport struct {
+	Chunks     int
+	Rows       int
+	Copied     int
+	Repaired   int
+	Mismatched int
+}
+
+//在线迁移，把表从From策略的分片按批复制到To策略的分片，每批按行校验摘要
+//迁移期间应用通过DBManager.BeginReshard + ExecShard双写，复制和校验完成后调用FinishReshard切换
+//BeginReshard、FinishReshard只修改调用的进程，每个应用实例都要调用，见BeginReshard
+//复制使用REPLACE INTO，目前只支持mysql
+type Resharder struct {
+	manager *DBManager
+	cfg     ReshardConfig
+}
+
+func NewResharder(manager *DBManager, cfg *ReshardConfig) (*Resharder, error) {
+	r := &Resharder{
+		manager: manager,
+		cfg:     *cfg,
+	}
+
+	if r.cfg.Table == "" || r.cfg.KeyColumn == "" {
+		return nil, errors.New("reshard table and key column are required")
+	}
+	if r.cfg.From == nil || r.cfg.To == nil {
+		return nil, errors.New("reshard from and to strategies are required")
+	}
+	if r.cfg.PKColumn == "" {
+		r.cfg.PKColumn = r.cfg.KeyColumn
+	}
+	if r.cfg.BatchSize <= 0 {
+		r.cfg.BatchSize = 1000
+	}
+	if r.cfg.VerifyRetries <= 0 {
+		r.cfg.VerifyRetries = 3
+	}
+	if r.cfg.Checkpoint == nil {
+		r.cfg.Checkpoint = NewMemoryCheckpoint()
+	}
+
+	var err error
+	if r.cfg.Sources, err = listStrategyShards(r.cfg.Sources, r.cfg.From); err != nil {
+		return nil, err
+	}
+	if r.cfg.Targets, err = listStrategyShards(r.cfg.Targets, r.cfg.To); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func listStrategyShards(shards []Shard, s ShardingStrategy) ([]Shard, error) {
+	if len(shards) > 0 {
+		return shards, nil
+	}
+	if lister, ok := s.(ShardLister); ok {
+		return lister.Shards(), nil
+	}
+	return nil, errors.New("sharding strategy can not list shards, set sources and targets")
+}
+
+//复制并校验所有源分片，从进度处继续
+func (r *Resharder) Run(ctx context.Context) (*ReshardReport, error) {
+	return r.run(ctx, true)
+}
+
+//只校验不复制，返回不一致的行数，不更新进度
+func (r *Resharder) Verify(ctx context.Context) (*ReshardReport, error) {
+	return r.run(ctx, false)
+}
+
+func (r *Resharder) run(ctx context.Context, repair bool) (*ReshardReport, error) {
+	report := &ReshardReport{}
+	for _, source := range r.cfg.Sources {
+		if err := r.runSource(ctx, source, repair, report); err != nil {
+			return report, fmt.Errorf("reshard %s.%s err: %w", source.DB, source.Table(r.cfg.Table), err)
+		}
+	}
+	return report, nil
+}
+
+func (r *Resharder) checkpointKey(source Shard) string {
+	return r.cfg.Table + "/" + source.DB + "/" + source.Table(r.cfg.Table)
+}
+
+func (r *Resharder) runSource(ctx context.Context, source Shard, repair bool, report *ReshardReport) error {
+	db, err := r.manager.getDB(source.DB)
+	if err != nil {
+		return err
+	}
+
+	key := r.checkpointKey(source)
+	var last interface{}
+	var started bool
+	if repair {
+		saved, ok, err := r.cfg.Checkpoint.Load(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if last, err = decodePK(saved); err != nil {
+				return fmt.Errorf("checkpoint %s err: %w", key, err)
+			}
+			started = true
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk, err := r.nextChunk(ctx, db, source, last, started)
+		if err != nil {
+			return err
+		}
+		if len(chunk.rows) == 0 {
+			return nil
+		}
+
+		report.Chunks++
+		report.Rows += len(chunk.rows)
+
+		if repair {
+			if err := r.copyRows(ctx, source, chunk.columns, chunk.rows); err != nil {
+				return err
+			}
+			report.Copied += len(chunk.rows)
+		}
+
+		if err := r.verifyChunk(ctx, db, source, chunk, repair, report); err != nil {
+			return err
+		}
+
+		last, started = chunk.hi, true
+		if repair {
+			saved, err := encodePK(last)
+			if err != nil {
+				return err
+			}
+			if err := r.cfg.Checkpoint.Save(key, saved); err != nil {
+				return err
+			}
+		}
+
+		if r.cfg.Pause > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(r.cfg.Pause):
+			}
+		}
+	}
+}
+
+type reshardChunk struct {
+	columns []string
+	rows    [][]interface{}
+	//主键按扫描出的类型绑定参数
+	lo, hi interface{}
+}
+
+//源分片主键大于last的下一批，读主库
+func (r *Resharder) nextChunk(ctx context.Context, db *DB, source Shard, last interface{}, started bool) (*reshardChunk, error) {
+	query := fmt.Sprintf("SELECT * FROM %s", quoteIdent(source.Table(r.cfg.Table)))
+	var args []interface{}
+	if started {
+		query += fmt.Sprintf(" WHERE %s > ?", quoteIdent(r.cfg.PKColumn))
+		args = append(args, last)
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", quoteIdent(r.cfg.PKColumn), r.cfg.BatchSize)
+
+	columns, rows, err := queryAll(ctx, db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	chunk := &reshardChunk{columns: columns, rows: rows}
+	if len(rows) > 0 {
+		pk := columnIndex(columns, r.cfg.PKColumn)
+		if pk < 0 {
+			return nil, fmt.Errorf("column %s not found", r.cfg.PKColumn)
+		}
+		chunk.lo = rows[0][pk]
+		chunk.hi = rows[len(rows)-1][pk]
+	}
+	return chunk, nil
+}
+
+//源分片中主键在[lo, hi]之间的行
+func (r *Resharder) sourceRows(ctx context.Context, db *DB, source Shard, lo, hi interface{}) ([]string, [][]interface{}, error) {
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s BETWEEN ? AND ?", quoteIdent(source.Table(r.cfg.Table)), quoteIdent(r.cfg.PKColumn))
+	return queryAll(ctx, db, query, lo, hi)
+}
+
+//目标分片中主键在[lo, hi]之间、且按新旧策略都属于source和target的行
+func (r *Resharder) targetRows(ctx context.Context, source Shard, target Shard, lo, hi interface{}) ([]string, [][]interface{}, error) {
+	db, err := r.manager.getDB(target.DB)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s BETWEEN ? AND ?", quoteIdent(target.Table(r.cfg.Table)), quoteIdent(r.cfg.PKColumn))
+	columns, rows, err := queryAll(ctx, db, query, lo, hi)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyIdx := columnIndex(columns, r.cfg.KeyColumn)
+	if keyIdx < 0 {
+		return nil, nil, fmt.Errorf("column %s not found", r.cfg.KeyColumn)
+	}
+
+	filtered := rows[:0]
+	for _, row := range rows {
+		key := valueString(row[keyIdx])
+		from, err := r.cfg.From.Locate(key)
+		if err != nil || from != source {
+			continue
+		}
+		to, err := r.cfg.To.Locate(key)
+		if err != nil || to != target {
+			continue
+		}
+		filtered = append(filtered, row)
+	}
+	return columns, filtered, nil
+}
+
+//按新策略把行写入目标分片，目标就是源分片的行不用复制
+func (r *Resharder) copyRows(ctx context.Context, source Shard, columns []string, rows [][]interface{}) error {
+	keyIdx := columnIndex(columns, r.cfg.KeyColumn)
+	if keyIdx < 0 {
+		return fmt.Errorf("column %s not found", r.cfg.KeyColumn)
+	}
+
+	groups := make(map[Shard][][]interface{})
+	for _, row := range rows {
+		target, err := r.cfg.To.Locate(valueString(row[keyIdx]))
+		if err != nil {
+			return err
+		}
+		if target == source {
+			continue
+		}
+		groups[target] = append(groups[target], row)
+	}
+
+	for target, rows := range groups {
+		db, err := r.manager.getDB(target.DB)
+		if err != nil {
+			return err
+		}
+		if err := replaceRows(ctx, db, target.Table(r.cfg.Table), columns, rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//比较源分片和目标分片中同一批的行摘要，repair时修复后重新校验
+func (r *Resharder) verifyChunk(ctx context.Context, db *DB, source Shard, chunk *reshardChunk, repair bool, report *ReshardReport) error {
+	for attempt := 0; ; attempt++ {
+		columns, rows, err := r.sourceRows(ctx, db, source, chunk.lo, chunk.hi)
+		if err != nil {
+			return err
+		}
+		pkIdx := columnIndex(columns, r.cfg.PKColumn)
+		if pkIdx < 0 {
+			return fmt.Errorf("column %s not found", r.cfg.PKColumn)
+		}
+
+		want := make(map[string]string, len(rows))
+		wantRows := make(map[string][]interface{}, len(rows))
+		for _, row := range rows {
+			pk := valueString(row[pkIdx])
+			want[pk] = rowDigest(columns, row)
+			wantRows[pk] = row
+		}
+
+		var missing [][]interface{}
+		extra := make(map[Shard][]interface{})
+		got := make(map[string]bool, len(rows))
+		for _, target := range r.cfg.Targets {
+			tcolumns, trows, err := r.targetRows(ctx, source, target, chunk.lo, chunk.hi)
+			if err != nil {
+				return err
+			}
+			tpkIdx := columnIndex(tcolumns, r.cfg.PKColumn)
+			for _, row := range trows {
+				pk := valueString(row[tpkIdx])
+				digest, ok := want[pk]
+				if !ok {
+					//源分片已删除
+					extra[target] = append(extra[target], row[tpkIdx])
+					continue
+				}
+				got[pk] = true
+				if digest != rowDigest(tcolumns, row) {
+					missing = append(missing, wantRows[pk])
+				}
+			}
+		}
+		for pk, row := range wantRows {
+			if !got[pk] {
+				missing = append(missing, row)
+			}
+		}
+
+		mismatched := len(missing)
+		for _, pks := range extra {
+			mismatched += len(pks)
+		}
+		if mismatched == 0 {
+			return nil
+		}
+
+		if !repair {
+			report.Mismatched += mismatched
+			clog.Warnf("reshard %s chunk [%v, %v] of %s has %d mismatched rows", r.cfg.Table, chunk.lo, chunk.hi, source.DB, mismatched)
+			return nil
+		}
+		if attempt >= r.cfg.VerifyRetries {
+			report.Mismatched += mismatched
+			return fmt.Errorf("chunk [%v, %v] still has %d mismatched rows after %d repairs", chunk.lo, chunk.hi, mismatched, attempt)
+		}
+
+		if err := r.copyRows(ctx, source, columns, missing); err != nil {
+			return err
+		}
+		for target, pks := range extra {
+			if err := r.deleteRows(ctx, target, pks); err != nil {
+				return err
+			}
+		}
+		report.Repaired += mismatched
+	}
+}
+
+func (r *Resharder) deleteRows(ctx context.Context, target Shard, pks []interface{}) error {
+	db, err := r.manager.getDB(target.DB)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)", quoteIdent(target.Table(r.cfg.Table)), quoteIdent(r.cfg.PKColumn), placeholders(len(pks)))
+	_, err = db.MRDB().ExecContext(ctx, query, pks...)
+	return err
+}
+
+//整数列按列类型转成int64、uint64，mysql不带参数的查询走文本协议，整数扫描出来是[]byte
+//用字符串和BIGINT比较时mysql按浮点数比较，超过2^53的主键会丢失精度
+func queryAll(ctx context.Context, db *DB, query string, args ...interface{}) ([]string, [][]interface{}, error) {
+	rows, err := db.MRDB().QueryContext(WithMaster(ctx), query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		for i, v := range values {
+			if values[i], err = typedInt(v, types[i].DatabaseTypeName()); err != nil {
+				return nil, nil, fmt.Errorf("column %s err: %w", columns[i], err)
+			}
+		}
+		result = append(result, values)
+	}
+	return columns, result, rows.Err()
+}
+
+func replaceRows(ctx context.Context, db *DB, table string, columns []string, rows [][]interface{}) error {
+	quoted := make([]string, 0, len(columns))
+	for _, c := range columns {
+		quoted = append(quoted, quoteIdent(c))
+	}
+
+	values := make([]string, 0, len(rows))
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	for _, row := range rows {
+		values = append(values, "("+placeholders(len(columns))+")")
+		args = append(args, row...)
+	}
+
+	query := fmt.Sprintf("REPLACE INTO %s (%s) VALUES %s", quoteIdent(table), strings.Join(quoted, ", "), strings.Join(values, ", "))
+	_, err := db.MRDB().ExecContext(ctx, query, args...)
+	return err
+}
+
+//行摘要，按列名排序，与列的顺序无关
+func rowDigest(columns []string, row []interface{}) string {
+	idx := make([]int, len(columns))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return columns[idx[i]] < columns[idx[j]] })
+
+	var buf bytes.Buffer
+	for _, i := range idx {
+		buf.WriteString(columns[i])
+		buf.WriteByte(0)
+		if row[i] == nil {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(2)
+			buf.WriteString(valueString(row[i]))
+		}
+		buf.WriteByte(0)
+	}
+
+	sum := sha1.Sum(buf.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+func typedInt(v interface{}, dbType string) (interface{}, error) {
+	b, ok := v.([]byte)
+	if !ok || !strings.Contains(dbType, "INT") {
+		return v, nil
+	}
+	if strings.HasPrefix(dbType, "UNSIGNED") {
+		return strconv.ParseUint(string(b), 10, 64)
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+//进度中的主键编码为 类型:值，恢复时按原类型绑定
+func encodePK(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case int64:
+		return "int64:" + strconv.FormatInt(v, 10), nil
+	case uint64:
+		return "uint64:" + strconv.FormatUint(v, 10), nil
+	case string:
+		return "string:" + v, nil
+	case []byte:
+		return "string:" + string(v), nil
+	case time.Time:
+		return "time:" + v.UTC().Format(time.RFC3339Nano), nil
+	}
+	return "", fmt.Errorf("unsupported primary key type %T", v)
+}
+
+func decodePK(s string) (interface{}, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("primary key %q without type", s)
+	}
+	value := s[i+1:]
+	switch s[:i] {
+	case "int64":
+		return strconv.ParseInt(value, 10, 64)
+	case "uint64":
+		return strconv.ParseUint(value, 10, 64)
+	case "string":
+		return value, nil
+	case "time":
+		return time.Parse(time.RFC3339Nano, value)
+	}
+	return nil, fmt.Errorf("primary key %q with unknown type", s)
+}
+
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func columnIndex(columns []string, column string) int {
+	for i, c := range columns {
+		if c == column {
+			return i
+		}
+	}
+	return -1
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
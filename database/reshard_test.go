@@ -0,0 +1,392 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+//fakedb.Server上的一张(id, name)表，只认识Resharder生成的语句
+type fakeTable struct {
+	mu   sync.Mutex
+	rows map[int64]string
+	//丢弃接下来的几次REPLACE，模拟复制后又被覆盖
+	dropReplaces int
+	//像mysql文本协议一样把id作为[]byte返回，列类型BIGINT
+	textIDs bool
+}
+
+func newFakeTable(s *fakedb.Server, rows map[int64]string) *fakeTable {
+	tb := &fakeTable{rows: rows}
+	if tb.rows == nil {
+		tb.rows = make(map[int64]string)
+	}
+	s.SetHandlers(tb.query, tb.exec)
+	return tb
+}
+
+func (tb *fakeTable) snapshot() map[int64]string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	rows := make(map[int64]string, len(tb.rows))
+	for id, name := range tb.rows {
+		rows[id] = name
+	}
+	return rows
+}
+
+//写入时字符串按整数精确转换
+func argInt(v driver.Value) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case string, []byte:
+		id, err := strconv.ParseInt(valueString(v), 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		return id
+	}
+	panic(fmt.Sprintf("unexpected arg %T", v))
+}
+
+//和mysql一样，BIGINT与字符串比较时都转成浮点数
+func compareID(id int64, v driver.Value) int {
+	switch v := v.(type) {
+	case int64:
+		switch {
+		case id < v:
+			return -1
+		case id > v:
+			return 1
+		}
+		return 0
+	case string, []byte:
+		f, err := strconv.ParseFloat(valueString(v), 64)
+		if err != nil {
+			panic(err)
+		}
+		switch {
+		case float64(id) < f:
+			return -1
+		case float64(id) > f:
+			return 1
+		}
+		return 0
+	}
+	panic(fmt.Sprintf("unexpected arg %T", v))
+}
+
+func (tb *fakeTable) query(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	match := func(id int64) bool { return true }
+	switch {
+	case strings.Contains(query, " BETWEEN ? AND ?"):
+		match = func(id int64) bool { return compareID(id, args[0]) >= 0 && compareID(id, args[1]) <= 0 }
+	case strings.Contains(query, " > ?"):
+		match = func(id int64) bool { return compareID(id, args[0]) > 0 }
+	}
+	limit := -1
+	if i := strings.Index(query, " LIMIT "); i >= 0 {
+		limit, _ = strconv.Atoi(query[i+len(" LIMIT "):])
+	}
+
+	var ids []int64
+	for id := range tb.rows {
+		if match(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if limit >= 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	rows := make([][]driver.Value, 0, len(ids))
+	for _, id := range ids {
+		if tb.textIDs {
+			rows = append(rows, []driver.Value{[]byte(strconv.FormatInt(id, 10)), []byte(tb.rows[id])})
+		} else {
+			rows = append(rows, []driver.Value{id, tb.rows[id]})
+		}
+	}
+	return fakedb.NewTypedRows([]string{"id", "name"}, []string{"BIGINT", "VARCHAR"}, rows...), nil
+}
+
+func (tb *fakeTable) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "REPLACE INTO "):
+		if tb.dropReplaces > 0 {
+			tb.dropReplaces--
+			return driver.RowsAffected(0), nil
+		}
+		for i := 0; i+1 < len(args); i += 2 {
+			tb.rows[argInt(args[i])] = valueString(args[i+1])
+		}
+	case strings.HasPrefix(query, "DELETE FROM "):
+		for _, arg := range args {
+			for id := range tb.rows {
+				if compareID(id, arg) == 0 {
+					delete(tb.rows, id)
+				}
+			}
+		}
+	default:
+		return nil, errors.New("unexpected exec: " + query)
+	}
+	return driver.RowsAffected(int64(len(args))), nil
+}
+
+//db0上的t按id奇偶拆到db0和db1
+func newTestResharder(t *testing.T, source map[int64]string, target map[int64]string, cfg *ReshardConfig) (*Resharder, *fakeTable, *fakeTable) {
+	manager, servers := newTestManager(t, "db0", "db1")
+	db0 := newFakeTable(servers["db0"], source)
+	db1 := newFakeTable(servers["db1"], target)
+
+	cfg.Table = "t"
+	cfg.KeyColumn = "id"
+	cfg.From = NewModuloSharding([]string{"db0"}, 1)
+	cfg.To = NewModuloSharding([]string{"db0", "db1"}, 1)
+	r, err := NewResharder(manager, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, db0, db1
+}
+
+func TestResharderRun(t *testing.T) {
+	cp := NewMemoryCheckpoint()
+	r, db0, db1 := newTestResharder(t, map[int64]string{1: "a", 2: "b", 3: "c", 4: "d", 5: "e"}, nil, &ReshardConfig{BatchSize: 2, Checkpoint: cp})
+
+	report, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ReshardReport{Chunks: 3, Rows: 5, Copied: 5}
+	if *report != want {
+		t.Fatalf("report = %+v, want %+v", *report, want)
+	}
+	//留在源分片的行不复制
+	if got := db1.snapshot(); !reflect.DeepEqual(got, map[int64]string{1: "a", 3: "c", 5: "e"}) {
+		t.Fatalf("db1 = %v", got)
+	}
+	if len(db0.snapshot()) != 5 {
+		t.Fatalf("db0 = %v", db0.snapshot())
+	}
+	if pk, ok, _ := cp.Load("t/db0/t"); !ok || pk != "int64:5" {
+		t.Fatalf("checkpoint = %q, %v", pk, ok)
+	}
+}
+
+//保存一次进度后取消ctx，模拟迁移中断
+type cancelCheckpoint struct {
+	CheckpointStore
+	cancel context.CancelFunc
+}
+
+func (c *cancelCheckpoint) Save(key string, pk string) error {
+	err := c.CheckpointStore.Save(key, pk)
+	c.cancel()
+	return err
+}
+
+func TestResharderResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reshard.json")
+	fc, err := NewFileCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := map[int64]string{1: "a", 2: "b", 3: "c", 4: "d", 5: "e"}
+	ctx, cancel := context.WithCancel(context.Background())
+	r, _, db1 := newTestResharder(t, source, nil, &ReshardConfig{BatchSize: 2, Checkpoint: &cancelCheckpoint{fc, cancel}})
+	if _, err := r.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if got := db1.snapshot(); !reflect.DeepEqual(got, map[int64]string{1: "a"}) {
+		t.Fatalf("db1 after first chunk = %v", got)
+	}
+
+	//重新加载文件，从第一批之后继续
+	fc, err = NewFileCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pk, ok, _ := fc.Load("t/db0/t"); !ok || pk != "int64:2" {
+		t.Fatalf("checkpoint = %q, %v", pk, ok)
+	}
+	r, _, db1 = newTestResharder(t, source, nil, &ReshardConfig{BatchSize: 2, Checkpoint: fc})
+	report, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks != 2 || report.Rows != 3 {
+		t.Fatalf("report = %+v", *report)
+	}
+	if got := db1.snapshot(); !reflect.DeepEqual(got, map[int64]string{3: "c", 5: "e"}) {
+		t.Fatalf("db1 after resume = %v", got)
+	}
+	if fc, err = NewFileCheckpoint(path); err != nil {
+		t.Fatal(err)
+	}
+	if pk, _, _ := fc.Load("t/db0/t"); pk != "int64:5" {
+		t.Fatalf("checkpoint after resume = %q", pk)
+	}
+}
+
+func TestResharderLargePK(t *testing.T) {
+	//2^53以上的整数转成浮点数会丢失精度，主键按字符串绑定时会跳过或重复行
+	const base = int64(1) << 53
+	source := map[int64]string{base - 1: "a", base: "b", base + 1: "c", base + 2: "d", base + 3: "e"}
+	cp := NewMemoryCheckpoint()
+	r, db0, db1 := newTestResharder(t, source, nil, &ReshardConfig{BatchSize: 1, Checkpoint: cp})
+	db0.textIDs = true
+	db1.textIDs = true
+
+	report, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Chunks != 5 || report.Rows != 5 || report.Mismatched != 0 {
+		t.Fatalf("report = %+v", *report)
+	}
+	want := map[int64]string{base - 1: "a", base + 1: "c", base + 3: "e"}
+	if got := db1.snapshot(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("db1 = %v", got)
+	}
+	if pk, _, _ := cp.Load("t/db0/t"); pk != "int64:9007199254740995" {
+		t.Fatalf("checkpoint = %q", pk)
+	}
+
+	//从进度恢复时按int64绑定
+	cp.Save("t/db0/t", "int64:9007199254740992")
+	db1.rows = make(map[int64]string)
+	if _, err := r.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := db1.snapshot(); !reflect.DeepEqual(got, map[int64]string{base + 1: "c", base + 3: "e"}) {
+		t.Fatalf("db1 after resume = %v", got)
+	}
+
+	//旧格式的进度没有类型
+	cp.Save("t/db0/t", "9007199254740992")
+	if _, err := r.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "without type") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestResharderVerifyAndRepair(t *testing.T) {
+	source := map[int64]string{1: "a", 2: "b", 4: "d"}
+	//1摘要不一致，3在源分片已删除
+	target := map[int64]string{1: "old", 3: "x"}
+
+	r, db0, db1 := newTestResharder(t, source, target, &ReshardConfig{})
+	report, err := r.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mismatched != 2 || report.Copied != 0 {
+		t.Fatalf("Verify() report = %+v", *report)
+	}
+	if got := db1.snapshot(); !reflect.DeepEqual(got, target) {
+		t.Fatalf("Verify() changed db1: %v", got)
+	}
+
+	//复制的行被覆盖，校验时重新复制，并删除多余的行
+	db1.dropReplaces = 1
+	report, err = r.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Repaired != 2 || report.Mismatched != 0 {
+		t.Fatalf("Run() report = %+v", *report)
+	}
+	if got := db1.snapshot(); !reflect.DeepEqual(got, map[int64]string{1: "a"}) {
+		t.Fatalf("db1 = %v", got)
+	}
+	if got := db0.snapshot(); !reflect.DeepEqual(got, source) {
+		t.Fatalf("db0 = %v", got)
+	}
+}
+
+func TestResharderRepairExhausted(t *testing.T) {
+	cp := NewMemoryCheckpoint()
+	r, _, db1 := newTestResharder(t, map[int64]string{1: "a"}, nil, &ReshardConfig{VerifyRetries: 2, Checkpoint: cp})
+	db1.dropReplaces = 100
+
+	report, err := r.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "after 2 repairs") {
+		t.Fatalf("err = %v", err)
+	}
+	if report.Mismatched != 1 {
+		t.Fatalf("report = %+v", *report)
+	}
+	if _, ok, _ := cp.Load("t/db0/t"); ok {
+		t.Fatal("checkpoint saved for mismatched chunk")
+	}
+}
+
+func TestExecShardDualWrite(t *testing.T) {
+	manager, servers := newTestManager(t, "db0", "db1")
+	manager.RegisterStrategy("t", NewModuloSharding([]string{"db0"}, 1))
+	if err := manager.BeginReshard("t", NewModuloSharding([]string{"db0", "db1"}, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(table string) string { return "UPDATE " + table + " SET name = ?" }
+	if _, err := manager.ExecShard(context.Background(), "t", "3", update, "c"); err != nil {
+		t.Fatal(err)
+	}
+	//新旧分片相同时只写一次
+	if _, err := manager.ExecShard(context.Background(), "t", "2", update, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if n0, n1 := len(servers["db0"].ExecLog()), len(servers["db1"].ExecLog()); n0 != 2 || n1 != 1 {
+		t.Fatalf("db0 execs %d, db1 execs %d", n0, n1)
+	}
+
+	//新分片失败返回旧分片的结果和DualWriteError
+	boom := errors.New("boom")
+	servers["db1"].SetErr(boom)
+	res, err := manager.ExecShard(context.Background(), "t", "5", update, "e")
+	var dwErr *DualWriteError
+	if !errors.As(err, &dwErr) || dwErr.Table != "t" || dwErr.Key != "5" || !errors.Is(err, boom) {
+		t.Fatalf("err = %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		t.Fatalf("RowsAffected() = %d", n)
+	}
+
+	//旧分片失败不写新分片
+	servers["db1"].SetErr(nil)
+	servers["db0"].SetErr(boom)
+	if _, err := manager.ExecShard(context.Background(), "t", "7", update, "g"); err != boom {
+		t.Fatalf("err = %v", err)
+	}
+	if n := len(servers["db1"].ExecLog()); n != 2 {
+		t.Fatalf("db1 execs = %d, want 2", n)
+	}
+
+	if err := manager.FinishReshard("t"); err != nil {
+		t.Fatal(err)
+	}
+	db, table, err := manager.GetShard("t", "7")
+	if err != nil || db.Name() != "db1" || table != "t" {
+		t.Fatalf("GetShard() after finish = %v, %s, %v", db, table, err)
+	}
+}
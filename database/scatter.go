@@ -0,0 +1,288 @@
+package database
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//跨分片查询返回的一行
+type ShardRow struct {
+	Shard   string
+	Columns []string
+	Values  []interface{}
+}
+
+//按列名取值，列不存在返回nil
+func (r *ShardRow) Get(column string) interface{} {
+	for i, c := range r.Columns {
+		if c == column {
+			return r.Values[i]
+		}
+	}
+	return nil
+}
+
+type ScatterOptions struct {
+	//同时查询的分片数上限，0不限制
+	Concurrency int
+	//合并排序，每个分片的查询需按同样的顺序ORDER BY；为nil时按到达顺序返回
+	//有序时每个分片的结果要先缓存再归并，必须设置Limit
+	Less func(a, b *ShardRow) bool
+	//合并后最多返回的行数，无序时0不限制；每个分片的查询也应带上LIMIT
+	Limit int
+	//部分分片失败时仍返回其他分片的结果
+	AllowPartial bool
+}
+
+//跨分片查询的错误，key为db name
+type ScatterError struct {
+	Errors map[string]error
+}
+
+func (e *ScatterError) Error() string {
+	shards := make([]string, 0, len(e.Errors))
+	for shard := range e.Errors {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+
+	msgs := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", shard, e.Errors[shard]))
+	}
+	return "scatter query failed on " + strings.Join(msgs, "; ")
+}
+
+//有序查询时分片已读够Limit行，提前结束读取
+var errShardLimit = errors.New("shard limit reached")
+
+//有序的跨分片查询没有设置Limit
+var ErrScatterNoLimit = errors.New("scatter with Less requires Limit")
+
+//设置表所在的所有db，用于跨分片查询；未设置时查询所有db
+func (manger *DBManager) SetTableShards(tbname string, dbnames ...string) {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	manger.shards[tbname] = dbnames
+}
+
+func (manger *DBManager) tableShards(tbname string) []string {
+	manger.mu.RLock()
+	defer manger.mu.RUnlock()
+
+	if dbnames, ok := manger.shards[tbname]; ok {
+		return dbnames
+	}
+
+	dbnames := make([]string, 0, len(manger.dbs))
+	for name := range manger.dbs {
+		dbnames = append(dbnames, name)
+	}
+	sort.Strings(dbnames)
+	return dbnames
+}
+
+//在表的所有分片上并发执行同一个查询，合并后的行依次回调fn，fn返回错误时停止
+//无序时边查边回调；有序时每个分片最多读Limit行，读完后再多路归并，未设置Limit返回ErrScatterNoLimit
+//分片出错时返回*ScatterError，AllowPartial为true时其他分片的行仍会回调
+//ctx取消或超时时返回ctx的错误，已回调的行可能不完整
+func (manger *DBManager) Scatter(ctx context.Context, tbname string, opts *ScatterOptions, fn func(*ShardRow) error, query string, args ...interface{}) error {
+	if opts == nil {
+		opts = &ScatterOptions{}
+	}
+	if opts.Less != nil && opts.Limit <= 0 {
+		return ErrScatterNoLimit
+	}
+
+	shards := manger.tableShards(tbname)
+	dbs := make([]*DB, 0, len(shards))
+	for _, name := range shards {
+		db, err := manger.getDB(name)
+		if err != nil {
+			return err
+		}
+		dbs = append(dbs, db)
+	}
+
+	//cancel只用于内部提前结束（达到Limit、fn出错、分片出错），和调用方的取消区分开
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopped := false
+
+	var (
+		mu      sync.Mutex
+		errs    = make(map[string]error)
+		sem     chan struct{}
+		results = make([][]*ShardRow, len(dbs))
+		rowsCh  = make(chan *ShardRow, 64)
+		wg      sync.WaitGroup
+	)
+	if opts.Concurrency > 0 {
+		sem = make(chan struct{}, opts.Concurrency)
+	}
+
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, db *DB) {
+			defer wg.Done()
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			err := queryShard(ctx, db, query, args, func(row *ShardRow) error {
+				if opts.Less != nil {
+					if len(results[i]) >= opts.Limit {
+						return errShardLimit
+					}
+					results[i] = append(results[i], row)
+					return nil
+				}
+				select {
+				case rowsCh <- row:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if errors.Is(err, errShardLimit) {
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				mu.Lock()
+				errs[db.Name()] = err
+				mu.Unlock()
+				if !opts.AllowPartial {
+					cancel()
+				}
+			}
+		}(i, db)
+	}
+
+	go func() {
+		wg.Wait()
+		close(rowsCh)
+	}()
+
+	var fnErr error
+	emitted := 0
+	emit := func(row *ShardRow) bool {
+		if fnErr != nil || (opts.Limit > 0 && emitted >= opts.Limit) {
+			return false
+		}
+		if fnErr = fn(row); fnErr != nil {
+			return false
+		}
+		emitted++
+		return opts.Limit == 0 || emitted < opts.Limit
+	}
+
+	if opts.Less == nil {
+		for row := range rowsCh {
+			if !emit(row) {
+				stopped = true
+				cancel()
+				break
+			}
+		}
+		//等待所有分片结束
+		for range rowsCh {
+		}
+	} else {
+		for range rowsCh {
+		}
+		if parent.Err() == nil && (len(errs) == 0 || opts.AllowPartial) {
+			mergeShardRows(results, opts.Less, emit)
+		}
+	}
+
+	if fnErr != nil {
+		return fnErr
+	}
+	if err := parent.Err(); err != nil && !stopped {
+		return err
+	}
+	if len(errs) > 0 {
+		return &ScatterError{Errors: errs}
+	}
+	return nil
+}
+
+func queryShard(ctx context.Context, db *DB, query string, args []interface{}, fn func(*ShardRow) error) error {
+	rows, err := db.MRDB().QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		if err := fn(&ShardRow{Shard: db.Name(), Columns: columns, Values: values}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//多路归并各分片已排好序的结果
+func mergeShardRows(results [][]*ShardRow, less func(a, b *ShardRow) bool, emit func(*ShardRow) bool) {
+	h := &rowHeap{less: less}
+	for _, rows := range results {
+		if len(rows) > 0 {
+			h.items = append(h.items, rows)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		rows := h.items[0]
+		if !emit(rows[0]) {
+			return
+		}
+		if len(rows) == 1 {
+			heap.Pop(h)
+		} else {
+			h.items[0] = rows[1:]
+			heap.Fix(h, 0)
+		}
+	}
+}
+
+type rowHeap struct {
+	items [][]*ShardRow
+	less  func(a, b *ShardRow) bool
+}
+
+func (h *rowHeap) Len() int           { return len(h.items) }
+func (h *rowHeap) Less(i, j int) bool { return h.less(h.items[i][0], h.items[j][0]) }
+func (h *rowHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *rowHeap) Push(x interface{}) { h.items = append(h.items, x.([]*ShardRow)) }
+func (h *rowHeap) Pop() interface{} {
+	n := len(h.items)
+	x := h.items[n-1]
+	h.items = h.items[:n-1]
+	return x
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+//每个db一个fakedb.Server的DBManager
+func newTestManager(t *testing.T, dbnames ...string) (*DBManager, map[string]*fakedb.Server) {
+	manager := NewDBManager()
+	servers := make(map[string]*fakedb.Server, len(dbnames))
+	for _, name := range dbnames {
+		dsn, s := fakedb.NewServer(t, name)
+		if err := manager.AddDB(name, &MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn}); err != nil {
+			t.Fatal(err)
+		}
+		servers[name] = s
+	}
+	t.Cleanup(func() {
+		for _, db := range manager.DBs() {
+			db.MRDB().Close()
+		}
+	})
+	return manager, servers
+}
+
+func intRows(values ...int64) [][]driver.Value {
+	rows := make([][]driver.Value, 0, len(values))
+	for _, v := range values {
+		rows = append(rows, []driver.Value{v})
+	}
+	return rows
+}
+
+func lessV(a, b *ShardRow) bool {
+	return a.Get("v").(int64) < b.Get("v").(int64)
+}
+
+func TestScatterUnordered(t *testing.T) {
+	manager, servers := newTestManager(t, "db0", "db1")
+	servers["db0"].SetRows([]string{"v"}, intRows(1, 3)...)
+	servers["db1"].SetRows([]string{"v"}, intRows(2)...)
+
+	var got []int64
+	shards := make(map[string]int)
+	err := manager.Scatter(context.Background(), "t", &ScatterOptions{Concurrency: 1}, func(row *ShardRow) error {
+		got = append(got, row.Get("v").(int64))
+		shards[row.Shard]++
+		return nil
+	}, "SELECT v FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if !reflect.DeepEqual(got, []int64{1, 2, 3}) || shards["db0"] != 2 || shards["db1"] != 1 {
+		t.Fatalf("rows = %v, shards = %v", got, shards)
+	}
+}
+
+func TestScatterOrdered(t *testing.T) {
+	manager, servers := newTestManager(t, "db0", "db1", "db2")
+	servers["db0"].SetRows([]string{"v"}, intRows(1, 4, 7, 10)...)
+	servers["db1"].SetRows([]string{"v"}, intRows(2, 3, 8)...)
+	servers["db2"].SetRows([]string{"v"})
+
+	var got []int64
+	err := manager.Scatter(context.Background(), "t", &ScatterOptions{Less: lessV, Limit: 5}, func(row *ShardRow) error {
+		got = append(got, row.Get("v").(int64))
+		return nil
+	}, "SELECT v FROM t ORDER BY v LIMIT 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []int64{1, 2, 3, 4, 7}) {
+		t.Fatalf("rows = %v", got)
+	}
+
+	//有序时必须设置Limit，不会把分片的全部结果读进内存
+	err = manager.Scatter(context.Background(), "t", &ScatterOptions{Less: lessV}, func(*ShardRow) error {
+		t.Fatal("fn called without Limit")
+		return nil
+	}, "SELECT v FROM t ORDER BY v")
+	if err != ErrScatterNoLimit {
+		t.Fatalf("err = %v, want ErrScatterNoLimit", err)
+	}
+}
+
+func TestScatterLimit(t *testing.T) {
+	manager, servers := newTestManager(t, "db0", "db1", "db2")
+	for _, s := range servers {
+		s.SetRows([]string{"v"}, intRows(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)...)
+	}
+
+	//达到Limit后内部取消其他分片，不作为错误返回
+	calls := 0
+	err := manager.Scatter(context.Background(), "t", &ScatterOptions{Limit: 4}, func(*ShardRow) error {
+		calls++
+		return nil
+	}, "SELECT v FROM t")
+	if err != nil || calls != 4 {
+		t.Fatalf("err = %v, calls = %d", err, calls)
+	}
+}
+
+func TestScatterFnError(t *testing.T) {
+	manager, servers := newTestManager(t, "db0", "db1")
+	for _, s := range servers {
+		s.SetRows([]string{"v"}, intRows(1, 2, 3)...)
+	}
+
+	boom := errors.New("boom")
+	for _, opts := range []*ScatterOptions{{}, {Less: lessV, Limit: 10}} {
+		calls := 0
+		err := manager.Scatter(context.Background(), "t", opts, func(*ShardRow) error {
+			calls++
+			if calls == 2 {
+				return boom
+			}
+			return nil
+		}, "SELECT v FROM t")
+		if err != boom || calls != 2 {
+			t.Fatalf("ordered %v: err = %v, calls = %d", opts.Less != nil, err, calls)
+		}
+	}
+}
+
+func TestScatterShardError(t *testing.T) {
+	manager, servers := newTestManager(t, "db0", "db1")
+	servers["db0"].SetRows([]string{"v"}, intRows(1, 2)...)
+	servers["db1"].SetErr(errors.New("table missing"))
+
+	err := manager.Scatter(context.Background(), "t", nil, func(*ShardRow) error { return nil }, "SELECT v FROM t")
+	var se *ScatterError
+	if !errors.As(err, &se) || len(se.Errors) != 1 || se.Errors["db1"] == nil {
+		t.Fatalf("err = %v", err)
+	}
+
+	//AllowPartial时其他分片的行仍然回调
+	calls := 0
+	err = manager.Scatter(context.Background(), "t", &ScatterOptions{AllowPartial: true, Less: lessV, Limit: 10}, func(*ShardRow) error {
+		calls++
+		return nil
+	}, "SELECT v FROM t")
+	if !errors.As(err, &se) || calls != 2 {
+		t.Fatalf("err = %v, calls = %d", err, calls)
+	}
+}
+
+func TestScatterCallerCancel(t *testing.T) {
+	manager, servers := newTestManager(t, "db0", "db1")
+	for _, s := range servers {
+		s.SetRows([]string{"v"}, intRows(1, 2, 3)...)
+	}
+
+	//调用方取消返回ctx的错误，和内部提前结束区分开
+	ctx, cancel := context.WithCancel(context.Background())
+	err := manager.Scatter(ctx, "t", nil, func(*ShardRow) error {
+		cancel()
+		return nil
+	}, "SELECT v FROM t")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	err = manager.Scatter(ctx, "t", &ScatterOptions{Less: lessV, Limit: 10}, func(*ShardRow) error {
+		t.Fatal("fn called after cancel")
+		return nil
+	}, "SELECT v FROM t")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("ordered err = %v, want context.Canceled", err)
+	}
+}
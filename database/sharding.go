@@ -2,8 +2,11 @@ package database
 
 import (
 	"context"
-	"errors"
+	"database/sql"
 	"fmt"
+	"sync"
+
+	"github.com/yybirdcf/golib/clog"
 )
 
 //根据分区key返回dbname
@@ -20,36 +23,91 @@ func (db *DB) MRDB() *MRDB {
 	return db.mrDB
 }
 
+func (db *DB) Name() string {
+	return db.name
+}
+
 type DBManager struct {
-	dbs      map[string]*DB
-	ctx      context.Context
-	sharding map[string]ShardingDBFunc
+	mu         sync.RWMutex
+	dbs        map[string]*DB
+	ctx        context.Context
+	sharding   map[string]ShardingDBFunc
+	strategies map[string]ShardingStrategy
+	shards     map[string][]string
+	//迁移中的表，表名 + 新的分片策略
+	reshards map[string]ShardingStrategy
 }
 
 func NewDBManager() *DBManager {
 	return &DBManager{
-		dbs:      make(map[string]*DB),
-		sharding: make(map[string]ShardingDBFunc),
+		dbs:        make(map[string]*DB),
+		sharding:   make(map[string]ShardingDBFunc),
+		strategies: make(map[string]ShardingStrategy),
+		shards:     make(map[string][]string),
+		reshards:   make(map[string]ShardingStrategy),
 	}
 }
 
-//添加db配置, db name + config
-func (manger *DBManager) AddDB(dbname string, cfg *MRDBConfig) {
+//添加db配置, db name + config，连接失败返回错误
+func (manger *DBManager) AddDB(dbname string, cfg *MRDBConfig) error {
+	manger.mu.RLock()
+	_, ok := manger.dbs[dbname]
+	manger.mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	//NewMRDB会ping数据库，不持锁，避免阻塞其他db的读写
+	mrDB, err := NewMRDB(cfg)
+	if err != nil {
+		return fmt.Errorf("%s %v", dbname, err)
+	}
+	mrDB.name = dbname
+
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	//并发添加同一个db时保留先加入的
 	if _, ok := manger.dbs[dbname]; ok {
-		return
+		mrDB.Close()
+		return nil
 	}
 
-	db := &DB{
+	manger.dbs[dbname] = &DB{
 		ctx:  manger.ctx,
 		name: dbname,
-		mrDB: NewMRDB(cfg),
+		mrDB: mrDB,
+	}
+	return nil
+}
+
+//返回所有db，db name + db
+func (manger *DBManager) DBs() map[string]*DB {
+	manger.mu.RLock()
+	defer manger.mu.RUnlock()
+
+	dbs := make(map[string]*DB, len(manger.dbs))
+	for name, db := range manger.dbs {
+		dbs[name] = db
 	}
+	return dbs
+}
+
+func (manger *DBManager) getDB(dbname string) (*DB, error) {
+	manger.mu.RLock()
+	defer manger.mu.RUnlock()
 
-	manger.dbs[dbname] = db
+	if db, ok := manger.dbs[dbname]; ok {
+		return db, nil
+	}
+	return nil, fmt.Errorf("%s can not found", dbname)
 }
 
-//表名确定sharding func，key确定sharding到哪个db
+//表名确定sharding func，key确定sharding到哪个db，已注册时忽略，替换用ReplaceSharding
 func (manger *DBManager) RegisterSharding(tbname string, f ShardingDBFunc) {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
 	if _, ok := manger.sharding[tbname]; ok {
 		return
 	}
@@ -57,15 +115,182 @@ func (manger *DBManager) RegisterSharding(tbname string, f ShardingDBFunc) {
 	manger.sharding[tbname] = f
 }
 
+//表名注册分片策略，同时注册对应的sharding func，未设置SetTableShards时用策略的所有db做跨分片查询
+func (manger *DBManager) RegisterStrategy(tbname string, s ShardingStrategy) {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	if _, ok := manger.sharding[tbname]; ok {
+		return
+	}
+
+	manger.setStrategy(tbname, s)
+	if _, ok := manger.shards[tbname]; !ok {
+		manger.shards[tbname] = s.DBNames()
+	}
+}
+
+func (manger *DBManager) setStrategy(tbname string, s ShardingStrategy) {
+	manger.sharding[tbname] = ShardingFunc(s)
+	manger.strategies[tbname] = s
+}
+
+//原子替换表的sharding func，之后的GetDB立即使用新的func
+//只修改当前进程，多个应用实例需要各自替换
+func (manger *DBManager) ReplaceSharding(tbname string, f ShardingDBFunc) {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	manger.sharding[tbname] = f
+	delete(manger.strategies, tbname)
+}
+
+//原子替换表的分片策略，跨分片查询的db换成新策略的所有db
+//只修改当前进程，多个应用实例需要各自替换
+func (manger *DBManager) ReplaceStrategy(tbname string, s ShardingStrategy) {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	manger.setStrategy(tbname, s)
+	manger.shards[tbname] = s.DBNames()
+}
+
 //根据表名获取db
 func (manger *DBManager) GetDB(tbname string, key string) (*DB, error) {
-	if f, ok := manger.sharding[tbname]; ok {
-		dbname := f(key)
-		if db, ok := manger.dbs[dbname]; ok {
-			return db, nil
-		}
-		return nil, errors.New(fmt.Sprint("%s can not found", dbname))
+	manger.mu.RLock()
+	f, ok := manger.sharding[tbname]
+	manger.mu.RUnlock()
+
+	if ok {
+		return manger.getDB(f(key))
+	}
+
+	return nil, fmt.Errorf("%s can not found", tbname)
+}
+
+//根据表名获取db和物理表名，只用RegisterSharding注册的表物理表名即表名
+func (manger *DBManager) GetShard(tbname string, key string) (*DB, string, error) {
+	manger.mu.RLock()
+	s, ok := manger.strategies[tbname]
+	manger.mu.RUnlock()
+
+	if !ok {
+		db, err := manger.GetDB(tbname, key)
+		return db, tbname, err
+	}
+	return manger.locate(s, tbname, key)
+}
+
+func (manger *DBManager) locate(s ShardingStrategy, tbname string, key string) (*DB, string, error) {
+	shard, err := s.Locate(key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	db, err := manger.getDB(shard.DB)
+	if err != nil {
+		return nil, "", err
+	}
+	return db, shard.Table(tbname), nil
+}
+
+//开始迁移表到新的分片策略，迁移期间读仍走旧分片，ExecShard同时写旧分片和新分片
+//表必须已用RegisterStrategy注册，迁移期间所有写都要改用ExecShard
+//迁移状态只在当前进程内存中，所有应用实例都调用BeginReshard开始双写后才能运行Resharder，
+//否则未双写的实例在复制之后的写不会到达新分片
+func (manger *DBManager) BeginReshard(tbname string, to ShardingStrategy) error {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	if _, ok := manger.strategies[tbname]; !ok {
+		return fmt.Errorf("%s has no sharding strategy", tbname)
 	}
+	if _, ok := manger.reshards[tbname]; ok {
+		return fmt.Errorf("%s is resharding", tbname)
+	}
+
+	manger.reshards[tbname] = to
+	return nil
+}
+
+//迁移完成，原子切换到新的分片策略并停止双写
+//同样只切换当前进程，所有应用实例要一起切换：已切换的实例不再写旧分片，未切换的实例仍从旧分片读到旧数据
+func (manger *DBManager) FinishReshard(tbname string) error {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	to, ok := manger.reshards[tbname]
+	if !ok {
+		return fmt.Errorf("%s is not resharding", tbname)
+	}
+
+	manger.setStrategy(tbname, to)
+	manger.shards[tbname] = to.DBNames()
+	delete(manger.reshards, tbname)
+	return nil
+}
 
-	return nil, errors.New(fmt.Sprint("%s can not found", tbname))
+//放弃迁移，停止双写，继续使用旧的分片策略
+func (manger *DBManager) AbortReshard(tbname string) {
+	manger.mu.Lock()
+	defer manger.mu.Unlock()
+
+	delete(manger.reshards, tbname)
+}
+
+//迁移中的新分片策略
+func (manger *DBManager) Resharding(tbname string) (ShardingStrategy, bool) {
+	manger.mu.RLock()
+	defer manger.mu.RUnlock()
+
+	to, ok := manger.reshards[tbname]
+	return to, ok
+}
+
+//迁移期间旧分片写成功、新分片写失败，需要按Key从旧分片重新复制
+type DualWriteError struct {
+	Table string
+	Key   string
+	Err   error
+}
+
+func (e *DualWriteError) Error() string {
+	return fmt.Sprintf("reshard %s dual write key %s err: %v", e.Table, e.Key, e.Err)
+}
+
+func (e *DualWriteError) Unwrap() error {
+	return e.Err
+}
+
+//在key所在的分片上执行写，query根据物理表名生成sql
+//迁移期间先写旧分片，成功后再写新分片，新分片失败时返回旧分片的结果和*DualWriteError
+//迁移期间表的所有写都必须经过ExecShard，直接在分片上执行的写不会同步到新分片
+func (manger *DBManager) ExecShard(ctx context.Context, tbname string, key string, query func(table string) string, args ...interface{}) (sql.Result, error) {
+	db, table, err := manger.GetShard(tbname, key)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := db.MRDB().ExecContext(ctx, query(table), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	to, ok := manger.Resharding(tbname)
+	if !ok {
+		return res, nil
+	}
+
+	newDB, newTable, err := manger.locate(to, tbname, key)
+	if err != nil {
+		return res, &DualWriteError{Table: tbname, Key: key, Err: err}
+	}
+	if newDB == db && newTable == table {
+		return res, nil
+	}
+	if _, err := newDB.MRDB().ExecContext(ctx, query(newTable), args...); err != nil {
+		clog.Errorf("reshard %s dual write %s.%s err: %v", tbname, newDB.Name(), newTable, err)
+		return res, &DualWriteError{Table: tbname, Key: key, Err: err}
+	}
+	return res, nil
 }
@@ -3,7 +3,12 @@ package database
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"sync/atomic"
+	"time"
+
+	"github.com/yybirdcf/golib/breaker"
+	"github.com/yybirdcf/golib/clog"
 	// _ "github.com/go-sql-driver/mysql"
 )
 
@@ -12,52 +17,227 @@ type MRDB struct {
 	master *conn
 	reads  []*conn
 	idx    int64
+
+	maxLag   time.Duration
+	lagFunc  LagFunc
+	interval time.Duration
+	checking int32
+	stopCh   chan struct{}
+
+	masterPin time.Duration
+	gtidWait  time.Duration
+
+	txRetries   int
+	txBackoff   time.Duration
+	txRetryable func(error) bool
+
+	//DBManager中的db name
+	name  string
+	hooks []Hook
+
+	placeholder Placeholder
 }
 
 type conn struct {
-	db  *sql.DB
-	dsn string
+	db    *sql.DB
+	dsn   string
+	label string //master、replica-0...
+	stmts *stmtCache
+	//从库的熔断器，未开启时为nil
+	breaker *breaker.Breaker
+
+	healthy int32 //1健康，参与读
+	lag     int64 //复制延迟，纳秒
+}
+
+//连接池配置，0使用database/sql的默认值
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
 }
 
 type MRDBConfig struct {
 	DN        string
 	MasterDSN string
 	ReadDSNs  []string
+
+	//主库和从库的连接池
+	MasterPool PoolConfig
+	ReadPool   PoolConfig
+	//启动时ping的超时，默认5秒
+	PingTimeout time.Duration
+	//每个连接缓存的预编译语句数，Exec、Query、QueryRow使用缓存的语句，0不缓存
+	StmtCacheSize int
+
+	//从库健康检查间隔，0不检查
+	HealthCheckInterval time.Duration
+	//从库最大复制延迟，超过的从库不参与读，0不检查延迟；延迟在健康检查时检测，需同时设置HealthCheckInterval
+	MaxLag time.Duration
+	//从库复制延迟检测，默认MySQLReplicaLag
+	LagFunc LagFunc
+
+	//会话内写之后，读固定走主库的时长，0不固定
+	MasterPinDuration time.Duration
+	//会话内写之后，读从库前等待从库追上写的GTID的最长时间，所有从库同时等待，0不等待；开启后优先于MasterPinDuration
+	GTIDWaitTimeout time.Duration
+
+	//WithTx遇到死锁等可重试错误时的最大重试次数，默认3，小于0不重试
+	TxMaxRetries int
+	//WithTx重试的初始退避时间，默认20毫秒
+	TxRetryBackoff time.Duration
+	//WithTx判断错误是否可以重试整个事务，默认IsRetryableTxError
+	TxRetryable func(error) bool
+
+	//sql调用的钩子，按顺序调用Before，逆序调用After
+	Hooks []Hook
+
+	//从库熔断，每个从库一个熔断器，打开的从库不参与读；IsFailure默认为IsReplicaFailure，nil不开启
+	ReplicaBreaker *breaker.Config
 }
 
-func NewMRDB(cfg *MRDBConfig) *MRDB {
+//连接并ping主库和从库，主库失败返回错误；从库失败时，开启健康检查则标记为不健康，否则返回错误
+func NewMRDB(cfg *MRDBConfig) (*MRDB, error) {
+	if cfg.MaxLag > 0 && cfg.HealthCheckInterval <= 0 {
+		return nil, fmt.Errorf("MaxLag requires HealthCheckInterval")
+	}
+
 	mrDB := &MRDB{
-		idx: 0,
+		idx:      0,
+		maxLag:   cfg.MaxLag,
+		lagFunc:  cfg.LagFunc,
+		interval: cfg.HealthCheckInterval,
+		stopCh:   make(chan struct{}),
+
+		masterPin: cfg.MasterPinDuration,
+		gtidWait:  cfg.GTIDWaitTimeout,
+
+		txRetries:   cfg.TxMaxRetries,
+		txBackoff:   cfg.TxRetryBackoff,
+		txRetryable: cfg.TxRetryable,
+
+		hooks: cfg.Hooks,
+
+		placeholder: PlaceholderFor(cfg.DN),
+	}
+	if mrDB.txRetries == 0 {
+		mrDB.txRetries = 3
+	}
+	if mrDB.txBackoff <= 0 {
+		mrDB.txBackoff = 20 * time.Millisecond
+	}
+	if mrDB.txRetryable == nil {
+		mrDB.txRetryable = IsRetryableTxError
+	}
+	if mrDB.lagFunc == nil {
+		mrDB.lagFunc = MySQLReplicaLag
+	}
+
+	pingTimeout := cfg.PingTimeout
+	if pingTimeout <= 0 {
+		pingTimeout = 5 * time.Second
+	}
+
+	var err error
+	mrDB.master, err = newConn(cfg.DN, cfg.MasterDSN, "master", &cfg.MasterPool, cfg.StmtCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := mrDB.master.ping(pingTimeout); err != nil {
+		mrDB.master.close()
+		return nil, err
 	}
 
-	mrDB.master = &conn{
-		db:  connect(cfg.DN, cfg.MasterDSN),
-		dsn: cfg.MasterDSN,
+	readDSNs := cfg.ReadDSNs
+	if len(readDSNs) == 0 {
+		readDSNs = []string{cfg.MasterDSN}
 	}
 
-	if cfg.ReadDSNs == nil || len(cfg.ReadDSNs) == 0 {
-		cfg.ReadDSNs = make([]string, 1)
-		cfg.ReadDSNs = append(cfg.ReadDSNs, cfg.MasterDSN)
+	mrDB.reads = make([]*conn, 0, len(readDSNs))
+	for i, dsn := range readDSNs {
+		c, err := newConn(cfg.DN, dsn, fmt.Sprintf("replica-%d", i), &cfg.ReadPool, cfg.StmtCacheSize)
+		if err != nil {
+			mrDB.Close()
+			return nil, err
+		}
+		mrDB.reads = append(mrDB.reads, c)
+		if cfg.ReplicaBreaker != nil {
+			c.breaker = newReplicaBreaker(c.label, cfg.ReplicaBreaker)
+		}
+
+		if err := c.ping(pingTimeout); err != nil {
+			if mrDB.interval <= 0 {
+				mrDB.Close()
+				return nil, err
+			}
+			clog.Errorf("%v, wait for health check", err)
+			c.setHealthy(false)
+		}
 	}
 
-	mrDB.reads = make([]*conn, 1)
-	for _, dsn := range cfg.ReadDSNs {
-		mrDB.reads = append(mrDB.reads, &conn{
-			db:  connect(cfg.DN, dsn),
-			dsn: dsn,
-		})
+	if mrDB.interval > 0 {
+		go mrDB.runHealthCheck()
 	}
 
-	return mrDB
+	return mrDB, nil
 }
 
-func connect(dn string, dsn string) *sql.DB {
+func newConn(dn string, dsn string, label string, pool *PoolConfig, stmtCacheSize int) (*conn, error) {
+	db, err := connect(dn, dsn, pool)
+	if err != nil {
+		return nil, fmt.Errorf("open %s err: %v", label, err)
+	}
+
+	c := &conn{
+		db:      db,
+		dsn:     dsn,
+		label:   label,
+		healthy: 1,
+	}
+	if stmtCacheSize > 0 {
+		c.stmts = newStmtCache(db, stmtCacheSize)
+	}
+	return c, nil
+}
+
+func (c *conn) close() error {
+	if c.stmts != nil {
+		c.stmts.purge()
+	}
+	return c.db.Close()
+}
+
+func connect(dn string, dsn string, pool *PoolConfig) (*sql.DB, error) {
 	db, err := sql.Open(dn, dsn)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	if pool.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	if pool.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
 	}
 
-	return db
+	return db, nil
+}
+
+func (c *conn) ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := c.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping %s err: %v", c.label, err)
+	}
+	return nil
 }
 
 func (mrDB *MRDB) masterDB() *sql.DB {
@@ -76,12 +256,18 @@ func (mrDB *MRDB) readDBIndex() int64 {
 
 //主库
 func (mrDB *MRDB) Exec(query string, args ...interface{}) (sql.Result, error) {
-	return mrDB.ExecContext(context.Background(), query, args)
+	return mrDB.ExecContext(context.Background(), query, args...)
 }
 
-//主库
+//主库，ctx中有会话时记录会话的写
 func (mrDB *MRDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
-	return mrDB.masterDB().ExecContext(ctx, query, args)
+	ctx, e := mrDB.before(ctx, OpExec, mrDB.master, query, args)
+	res, err := mrDB.master.execContext(ctx, query, args)
+	mrDB.after(ctx, e, err)
+	if err == nil {
+		mrDB.afterWrite(ctx)
+	}
+	return res, err
 }
 
 //主库
@@ -91,44 +277,86 @@ func (mrDB *MRDB) Prepare(query string) (*sql.Stmt, error) {
 
 //主库
 func (mrDB *MRDB) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
-	return mrDB.masterDB().PrepareContext(ctx, query)
+	ctx, e := mrDB.before(ctx, OpPrepare, mrDB.master, query, nil)
+	stmt, err := mrDB.masterDB().PrepareContext(ctx, query)
+	mrDB.after(ctx, e, err)
+	return stmt, err
 }
 
 //从库，从库都失败走主库
 func (mrDB *MRDB) Query(query string, args ...interface{}) (rows *sql.Rows, err error) {
-	return mrDB.QueryContext(context.Background(), query, args)
+	return mrDB.QueryContext(context.Background(), query, args...)
 }
 
-//从库
+//从库，依次尝试健康且未熔断的从库，都失败走主库
 func (mrDB *MRDB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
-	idx := mrDB.readDBIndex()
-
-	for index := range mrDB.reads {
-		rows, err = mrDB.reads[(int(idx)+index)%len(mrDB.reads)].db.QueryContext(ctx, query, args)
+	for _, c := range mrDB.readConnsContext(ctx) {
+		done, ok := c.allow(ctx)
+		if !ok {
+			continue
+		}
+		rows, err = mrDB.query(ctx, c, query, args)
+		done(err)
 		if err == nil {
 			return
 		}
 	}
-	return mrDB.masterDB().QueryContext(ctx, query, args)
+	return mrDB.query(ctx, mrDB.master, query, args)
+}
+
+//Duration只包含执行查询，不包含读取结果
+func (mrDB *MRDB) query(ctx context.Context, c *conn, query string, args []interface{}) (*sql.Rows, error) {
+	ctx, e := mrDB.before(ctx, OpQuery, c, query, args)
+	rows, err := c.queryContext(ctx, query, args)
+	mrDB.after(ctx, e, err)
+	return rows, err
 }
 
 //从库
 func (mrDB *MRDB) QueryRow(query string, args ...interface{}) (row *sql.Row) {
-	return mrDB.QueryRowContext(context.Background(), query, args)
+	return mrDB.QueryRowContext(context.Background(), query, args...)
 }
 
-//从库
+//从库，sql.Row的错误要到Scan才返回，无法失败重试，没有健康的从库时走主库
 func (mrDB *MRDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
-	idx := mrDB.readDBIndex()
-
-	for index := range mrDB.reads {
-		row = mrDB.reads[(int(idx)+index)%len(mrDB.reads)].db.QueryRowContext(ctx, query, args)
-		return
+	c, done := mrDB.master, func(error) {}
+	for _, rc := range mrDB.readConnsContext(ctx) {
+		if d, ok := rc.allow(ctx); ok {
+			c, done = rc, d
+			break
+		}
 	}
-	return mrDB.masterDB().QueryRowContext(ctx, query, args)
+
+	ctx, e := mrDB.before(ctx, OpQueryRow, c, query, args)
+	row = c.queryRowContext(ctx, query, args)
+	mrDB.after(ctx, e, row.Err())
+	done(row.Err())
+	return row
+}
+
+//主库的单个连接，用于GET_LOCK等依赖会话的操作，用完需要Close
+func (mrDB *MRDB) Conn(ctx context.Context) (*sql.Conn, error) {
+	return mrDB.masterDB().Conn(ctx)
 }
 
 //主库事务
 func (mrDB *MRDB) Begin() (*sql.Tx, error) {
-	return mrDB.masterDB().Begin()
+	return mrDB.BeginTx(context.Background(), nil)
+}
+
+//关闭健康检查和所有连接
+func (mrDB *MRDB) Close() error {
+	select {
+	case <-mrDB.stopCh:
+	default:
+		close(mrDB.stopCh)
+	}
+
+	err := mrDB.master.close()
+	for _, c := range mrDB.reads {
+		if e := c.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+//连接池状态，Label为master、replica-0...
+type ConnStats struct {
+	Label   string
+	Healthy bool
+	sql.DBStats
+	//未开启语句缓存时为nil
+	StmtCache *StmtCacheStats
+}
+
+//主库和所有从库的连接池状态，主库在前
+func (mrDB *MRDB) Stats() []ConnStats {
+	stats := make([]ConnStats, 0, len(mrDB.reads)+1)
+	stats = append(stats, mrDB.master.stats())
+	for _, c := range mrDB.reads {
+		stats = append(stats, c.stats())
+	}
+	return stats
+}
+
+func (c *conn) stats() ConnStats {
+	s := ConnStats{
+		Label:   c.label,
+		Healthy: c.isHealthy(),
+		DBStats: c.db.Stats(),
+	}
+	if c.stmts != nil {
+		stmtStats := c.stmts.stats()
+		s.StmtCache = &stmtStats
+	}
+	return s
+}
+
+//所有db的连接池状态，db name + 状态
+func (manger *DBManager) Stats() map[string][]ConnStats {
+	dbs := manger.DBs()
+	stats := make(map[string][]ConnStats, len(dbs))
+	for name, db := range dbs {
+		stats[name] = db.MRDB().Stats()
+	}
+	return stats
+}
+
+//以prometheus文本格式输出所有db的连接池状态
+func WritePrometheus(w io.Writer, manager *DBManager) error {
+	stats := manager.Stats()
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	metrics := []struct {
+		name  string
+		typ   string
+		value func(s *ConnStats) float64
+	}{
+		{"db_pool_max_open", "gauge", func(s *ConnStats) float64 { return float64(s.MaxOpenConnections) }},
+		{"db_pool_open", "gauge", func(s *ConnStats) float64 { return float64(s.OpenConnections) }},
+		{"db_pool_in_use", "gauge", func(s *ConnStats) float64 { return float64(s.InUse) }},
+		{"db_pool_idle", "gauge", func(s *ConnStats) float64 { return float64(s.Idle) }},
+		{"db_pool_wait_count", "counter", func(s *ConnStats) float64 { return float64(s.WaitCount) }},
+		{"db_pool_wait_seconds", "counter", func(s *ConnStats) float64 { return s.WaitDuration.Seconds() }},
+		{"db_pool_max_idle_closed", "counter", func(s *ConnStats) float64 { return float64(s.MaxIdleClosed) }},
+		{"db_pool_max_idle_time_closed", "counter", func(s *ConnStats) float64 { return float64(s.MaxIdleTimeClosed) }},
+		{"db_pool_max_lifetime_closed", "counter", func(s *ConnStats) float64 { return float64(s.MaxLifetimeClosed) }},
+		{"db_healthy", "gauge", func(s *ConnStats) float64 {
+			if s.Healthy {
+				return 1
+			}
+			return 0
+		}},
+	}
+
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ); err != nil {
+			return err
+		}
+		for _, name := range names {
+			for i := range stats[name] {
+				s := &stats[name][i]
+				fmt.Fprintf(w, "%s{db=%q,conn=%q} %g\n", m.name, name, s.Label, m.value(s))
+			}
+		}
+	}
+
+	stmtMetrics := []struct {
+		name  string
+		typ   string
+		value func(s *StmtCacheStats) float64
+	}{
+		{"db_stmt_cache_size", "gauge", func(s *StmtCacheStats) float64 { return float64(s.Size) }},
+		{"db_stmt_cache_hits", "counter", func(s *StmtCacheStats) float64 { return float64(s.Hits) }},
+		{"db_stmt_cache_misses", "counter", func(s *StmtCacheStats) float64 { return float64(s.Misses) }},
+	}
+	for _, m := range stmtMetrics {
+		fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+		for _, name := range names {
+			for _, s := range stats[name] {
+				if s.StmtCache == nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "%s{db=%q,conn=%q} %g\n", m.name, name, s.Label, m.value(s.StmtCache)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//prometheus抓取连接池状态的handler
+func MetricsHandler(manager *DBManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WritePrometheus(w, manager); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestWritePrometheus(t *testing.T) {
+	manager := NewDBManager()
+	dsnA, _ := fakedb.NewServer(t, "a")
+	dsnB, _ := fakedb.NewServer(t, "b")
+	if err := manager.AddDB("b", &MRDBConfig{DN: fakedb.Driver, MasterDSN: dsnB, MasterPool: PoolConfig{MaxOpenConns: 5}, StmtCacheSize: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.AddDB("a", &MRDBConfig{DN: fakedb.Driver, MasterDSN: dsnA}); err != nil {
+		t.Fatal(err)
+	}
+	dbs := manager.DBs()
+	t.Cleanup(func() {
+		for _, db := range dbs {
+			db.MRDB().Close()
+		}
+	})
+
+	rows, err := dbs["b"].MRDB().QueryContext(context.Background(), "SELECT v FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	dbs["a"].MRDB().reads[0].setHealthy(false)
+
+	var sb strings.Builder
+	if err := WritePrometheus(&sb, manager); err != nil {
+		t.Fatal(err)
+	}
+	out := sb.String()
+
+	//同一个指标下db按名字排序，主库在前
+	for _, want := range []string{
+		"# TYPE db_pool_max_open gauge\n" +
+			`db_pool_max_open{db="a",conn="master"} 0` + "\n" +
+			`db_pool_max_open{db="a",conn="replica-0"} 0` + "\n" +
+			`db_pool_max_open{db="b",conn="master"} 5` + "\n" +
+			`db_pool_max_open{db="b",conn="replica-0"} 0` + "\n",
+		"# TYPE db_pool_wait_seconds counter\n",
+		`db_healthy{db="a",conn="master"} 1`,
+		`db_healthy{db="a",conn="replica-0"} 0`,
+		`db_healthy{db="b",conn="replica-0"} 1`,
+		"# TYPE db_stmt_cache_misses counter\n" +
+			`db_stmt_cache_misses{db="b",conn="master"} 0` + "\n" +
+			`db_stmt_cache_misses{db="b",conn="replica-0"} 1` + "\n",
+		`db_stmt_cache_size{db="b",conn="replica-0"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q", want)
+		}
+	}
+	//未开启语句缓存的db没有缓存指标
+	if strings.Contains(out, `db_stmt_cache_size{db="a"`) {
+		t.Error("stmt cache metrics for db without cache")
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+
+	if err := WritePrometheus(failingWriter{}, manager); err == nil {
+		t.Fatal("WritePrometheus() should return the write error")
+	}
+}
+
+func TestDBMetricsHandler(t *testing.T) {
+	manager, _ := newTestManager(t, "db0")
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(manager)(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `db_healthy{db="db0",conn="master"} 1`) {
+		t.Fatalf("body = %s", rec.Body.String())
+	}
+}
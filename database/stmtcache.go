@@ -0,0 +1,279 @@
+package database
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//mysql预编译语句相关的错误码
+const (
+	//未知的预编译语句
+	mysqlUnknownStmtHandler = 1243
+	//预编译语句数达到max_prepared_stmt_count
+	mysqlMaxPreparedStmtCount = 1461
+	//预编译语句需要重新预编译
+	mysqlNeedReprepare = 1615
+)
+
+//预编译语句数达到服务端上限后暂停预编译的时间
+const stmtLimitBackoff = time.Minute
+
+var errStmtCachePaused = errors.New("stmt cache paused")
+
+//预编译语句缓存的命中情况
+type StmtCacheStats struct {
+	Size   int
+	Hits   int64
+	Misses int64
+}
+
+//命中率，没有请求时为0
+func (s StmtCacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+//单个连接上按sql缓存的预编译语句，LRU淘汰
+//*sql.Stmt在连接池的连接断开后会自动在新连接上重新预编译，这里只处理服务端语句失效的情况
+type stmtCache struct {
+	mu    sync.Mutex
+	db    *sql.DB
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+
+	hits   int64
+	misses int64
+	//在这个时间之前不预编译新的sql，unix纳秒
+	pausedUntil int64
+}
+
+//refs为正在使用的调用数，淘汰时有调用在用则延迟到最后一个release关闭
+type stmtEntry struct {
+	query   string
+	stmt    *sql.Stmt
+	refs    int
+	removed bool
+}
+
+func newStmtCache(db *sql.DB, size int) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+//返回的语句用完后需要调用release，暂停预编译时未缓存的sql返回errStmtCachePaused
+func (c *stmtCache) get(ctx context.Context, query string) (*stmtEntry, error) {
+	c.mu.Lock()
+	if e, ok := c.items[query]; ok {
+		c.ll.MoveToFront(e)
+		entry := e.Value.(*stmtEntry)
+		entry.refs++
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return entry, nil
+	}
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+	if atomic.LoadInt64(&c.pausedUntil) > time.Now().UnixNano() {
+		return nil, errStmtCachePaused
+	}
+
+	//预编译不持锁，并发预编译同一个sql时保留先放入的
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		c.checkLimit(err)
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[query]; ok {
+		stmt.Close()
+		c.ll.MoveToFront(e)
+		entry := e.Value.(*stmtEntry)
+		entry.refs++
+		return entry, nil
+	}
+
+	entry := &stmtEntry{query: query, stmt: stmt, refs: 1}
+	c.items[query] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.removeElement(oldest)
+	}
+	return entry, nil
+}
+
+//调用结束，已淘汰且没有其他调用在用时关闭
+//database/sql会把语句的关闭推迟到它返回的*sql.Rows关闭之后，调用返回后即可release
+func (c *stmtCache) release(entry *stmtEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refs--
+	if entry.removed && entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+//从缓存移除，没有调用在用时立即关闭，否则由最后一个release关闭
+func (c *stmtCache) removeElement(e *list.Element) {
+	entry := c.ll.Remove(e).(*stmtEntry)
+	delete(c.items, entry.query)
+	entry.removed = true
+	if entry.refs == 0 {
+		entry.stmt.Close()
+	}
+}
+
+func (c *stmtCache) evict(query string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[query]; ok {
+		c.removeElement(e)
+	}
+}
+
+//清空缓存，连接不可用或重置时调用
+func (c *stmtCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.ll.Front(); e != nil; e = c.ll.Front() {
+		c.removeElement(e)
+	}
+}
+
+//服务端预编译语句数达到上限时暂停预编译stmtLimitBackoff，期间未缓存的sql直接执行，不再每次都预编译失败
+func (c *stmtCache) checkLimit(err error) {
+	if number, ok := mysqlErrorNumber(err); ok && number == mysqlMaxPreparedStmtCount {
+		atomic.StoreInt64(&c.pausedUntil, time.Now().Add(stmtLimitBackoff).UnixNano())
+	}
+}
+
+//语句失效时淘汰，返回true时需要不预编译直接执行一次
+func (c *stmtCache) discard(query string, err error) bool {
+	if !isStmtInvalid(err) {
+		return false
+	}
+	c.checkLimit(err)
+	c.evict(query)
+	return true
+}
+
+func (c *stmtCache) stats() StmtCacheStats {
+	c.mu.Lock()
+	size := c.ll.Len()
+	c.mu.Unlock()
+
+	return StmtCacheStats{
+		Size:   size,
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+//服务端预编译语句失效，需要重新预编译或不预编译直接执行
+//mysql按错误码：1243未知的语句、1615需要重新预编译、1461预编译语句数达到上限（*sql.Stmt在新连接上重新预编译时）
+//postgres表结构变化后的cached plan must not change result type，SQLSTATE为0A000
+func isStmtInvalid(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	if number, ok := mysqlErrorNumber(err); ok {
+		switch number {
+		case mysqlUnknownStmtHandler, mysqlNeedReprepare, mysqlMaxPreparedStmtCount:
+			return true
+		}
+		return false
+	}
+
+	var state SQLStateError
+	return errors.As(err, &state) && state.SQLState() == "0A000"
+}
+
+//在连接上执行，开启语句缓存时使用缓存的预编译语句，语句失效时淘汰并直接执行一次
+func (c *conn) execContext(ctx context.Context, query string, args []interface{}) (sql.Result, error) {
+	if c.stmts == nil {
+		return c.db.ExecContext(ctx, query, args...)
+	}
+
+	entry, err := c.stmts.get(ctx, query)
+	if err != nil {
+		//不能预编译的语句、暂停预编译时直接执行
+		return c.db.ExecContext(ctx, query, args...)
+	}
+
+	res, err := entry.stmt.ExecContext(ctx, args...)
+	c.stmts.release(entry)
+	if c.stmts.discard(query, err) {
+		return c.db.ExecContext(ctx, query, args...)
+	}
+	return res, err
+}
+
+func (c *conn) queryContext(ctx context.Context, query string, args []interface{}) (*sql.Rows, error) {
+	if c.stmts == nil {
+		return c.db.QueryContext(ctx, query, args...)
+	}
+
+	entry, err := c.stmts.get(ctx, query)
+	if err != nil {
+		return c.db.QueryContext(ctx, query, args...)
+	}
+
+	rows, err := entry.stmt.QueryContext(ctx, args...)
+	c.stmts.release(entry)
+	if c.stmts.discard(query, err) {
+		return c.db.QueryContext(ctx, query, args...)
+	}
+	return rows, err
+}
+
+//sql.Row的错误要到Scan才返回，预编译失败时无法重试
+func (c *conn) queryRowContext(ctx context.Context, query string, args []interface{}) *sql.Row {
+	if c.stmts == nil {
+		return c.db.QueryRowContext(ctx, query, args...)
+	}
+
+	entry, err := c.stmts.get(ctx, query)
+	if err != nil {
+		return c.db.QueryRowContext(ctx, query, args...)
+	}
+
+	row := entry.stmt.QueryRowContext(ctx, args...)
+	c.stmts.release(entry)
+	if c.stmts.discard(query, row.Err()) {
+		return c.db.QueryRowContext(ctx, query, args...)
+	}
+	return row
+}
+
+//主库和所有从库的语句缓存命中情况，未开启时返回nil
+func (mrDB *MRDB) StmtCacheStats() map[string]StmtCacheStats {
+	if mrDB.master.stmts == nil {
+		return nil
+	}
+
+	stats := make(map[string]StmtCacheStats, len(mrDB.reads)+1)
+	stats[mrDB.master.label] = mrDB.master.stmts.stats()
+	for _, c := range mrDB.reads {
+		stats[c.label] = c.stmts.stats()
+	}
+	return stats
+}
@@ -0,0 +1,192 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+func newTestStmtCache(t *testing.T, size int) (*stmtCache, *fakedb.Server) {
+	dsn, s := fakedb.NewServer(t, "db")
+	db, err := sql.Open(fakedb.Driver, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return newStmtCache(db, size), s
+}
+
+func TestStmtCacheLRU(t *testing.T) {
+	c, s := newTestStmtCache(t, 2)
+	ctx := context.Background()
+
+	tests := []struct {
+		query      string
+		wantSize   int
+		wantHits   int64
+		wantMisses int64
+		wantCloses int
+	}{
+		{"a", 1, 0, 1, 0},
+		{"b", 2, 0, 2, 0},
+		{"a", 2, 1, 2, 0},
+		//b最久未使用，被淘汰
+		{"c", 2, 1, 3, 1},
+		{"a", 2, 2, 3, 1},
+		{"b", 2, 2, 4, 2},
+	}
+	for i, tt := range tests {
+		entry, err := c.get(ctx, tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.release(entry)
+
+		stats := c.stats()
+		if stats.Size != tt.wantSize || stats.Hits != tt.wantHits || stats.Misses != tt.wantMisses {
+			t.Fatalf("step %d %s: stats = %+v, want size %d hits %d misses %d", i, tt.query, stats, tt.wantSize, tt.wantHits, tt.wantMisses)
+		}
+		if _, closes, _ := s.Counts(); closes != tt.wantCloses {
+			t.Fatalf("step %d %s: closes = %d, want %d", i, tt.query, closes, tt.wantCloses)
+		}
+	}
+
+	c.purge()
+	if stats := c.stats(); stats.Size != 0 {
+		t.Fatalf("size after purge = %d", stats.Size)
+	}
+	if _, closes, _ := s.Counts(); closes != 4 {
+		t.Fatalf("closes after purge = %d, want 4", closes)
+	}
+}
+
+func TestStmtCacheEvictInUse(t *testing.T) {
+	c, s := newTestStmtCache(t, 1)
+	ctx := context.Background()
+
+	entry, err := c.get(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.evict("a")
+	if _, closes, _ := s.Counts(); closes != 0 {
+		t.Fatalf("statement in use was closed")
+	}
+	if _, err := entry.stmt.ExecContext(ctx); err != nil {
+		t.Fatalf("exec on evicted statement: %v", err)
+	}
+
+	c.release(entry)
+	if _, closes, _ := s.Counts(); closes != 1 {
+		t.Fatalf("closes after release = %d, want 1", closes)
+	}
+}
+
+func TestStmtCacheConcurrentEvict(t *testing.T) {
+	master, s := fakedb.NewServer(t, "master")
+	mrDB, err := NewMRDB(&MRDBConfig{DN: fakedb.Driver, MasterDSN: master, StmtCacheSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mrDB.Close()
+	s.SetRows([]string{"v"}, []driver.Value{int64(1)})
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				query := fmt.Sprintf("SELECT %d", (g+i)%3)
+				if _, err := mrDB.ExecContext(ctx, query); err != nil {
+					errs <- err
+					return
+				}
+				var v int64
+				if err := mrDB.QueryRowContext(ctx, query).Scan(&v); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestIsStmtInvalid(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("wrap: %w", driver.ErrBadConn), true},
+		{&mysql.MySQLError{Number: 1615, Message: "Prepared statement needs to be re-prepared"}, true},
+		{fmt.Errorf("wrap: %w", &mysql.MySQLError{Number: 1243, Message: "Unknown prepared statement handler"}), true},
+		{&mysql.MySQLError{Number: 1461, Message: "Can't create more than max_prepared_stmt_count statements"}, true},
+		{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, false},
+		{sqlStateError("0A000"), true},
+		{sqlStateError("23505"), false},
+		//不按错误信息判断
+		{errors.New("Error 1615: Prepared statement needs to be re-prepared"), false},
+	}
+	for _, tt := range tests {
+		if got := isStmtInvalid(tt.err); got != tt.want {
+			t.Fatalf("isStmtInvalid(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStmtCachePreparedLimit(t *testing.T) {
+	master, s := fakedb.NewServer(t, "master")
+	mrDB, err := NewMRDB(&MRDBConfig{DN: fakedb.Driver, MasterDSN: master, StmtCacheSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mrDB.Close()
+	ctx := context.Background()
+
+	if _, err := mrDB.ExecContext(ctx, "UPDATE a SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+
+	//达到max_prepared_stmt_count后直接执行，暂停期间不再预编译新的sql，已缓存的语句照常使用
+	s.SetPrepareErr(&mysql.MySQLError{Number: 1461, Message: "Can't create more than max_prepared_stmt_count statements"})
+	for i := 0; i < 3; i++ {
+		if _, err := mrDB.ExecContext(ctx, "UPDATE b SET v = 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prepares, _, _ := s.Counts(); prepares != 2 {
+		t.Fatalf("prepares = %d, want 2", prepares)
+	}
+	if _, err := mrDB.ExecContext(ctx, "UPDATE a SET v = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.ExecLog(), []string{"UPDATE a SET v = 1", "UPDATE b SET v = 1", "UPDATE b SET v = 1", "UPDATE b SET v = 1", "UPDATE a SET v = 1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("execs = %q", got)
+	}
+
+	//其他预编译错误不暂停
+	mrDB.master.stmts.pausedUntil = 0
+	s.SetPrepareErr(errors.New("syntax error"))
+	mrDB.ExecContext(ctx, "UPDATE c SET v = 1")
+	mrDB.ExecContext(ctx, "UPDATE c SET v = 1")
+	if prepares, _, _ := s.Counts(); prepares != 4 {
+		t.Fatalf("prepares = %d, want 4", prepares)
+	}
+}
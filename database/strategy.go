@@ -0,0 +1,348 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/yybirdcf/golib/utils"
+)
+
+//分片位置，DB为db name，Suffix为物理表后缀，不分表时为空
+type Shard struct {
+	DB     string
+	Suffix string
+}
+
+//物理表名
+func (s Shard) Table(tbname string) string {
+	return tbname + s.Suffix
+}
+
+//分片策略，根据分区key计算db和物理表后缀
+type ShardingStrategy interface {
+	Locate(key string) (Shard, error)
+	//策略可能用到的所有db，用于跨分片查询
+	DBNames() []string
+}
+
+//能列出所有物理分片的策略，迁移时用来遍历源表和目标表
+type ShardLister interface {
+	Shards() []Shard
+}
+
+//把分片策略转为ShardingDBFunc，计算失败时返回空db name
+func ShardingFunc(s ShardingStrategy) ShardingDBFunc {
+	return func(key string) string {
+		shard, err := s.Locate(key)
+		if err != nil {
+			return ""
+		}
+		return shard.DB
+	}
+}
+
+func parseShardID(key string) (int64, error) {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sharding key %q: %v", key, err)
+	}
+	return id, nil
+}
+
+//数字id取模，共len(dbs)*tables个分片，分片i在dbs[i/tables]，物理表后缀为_i
+//tables<=1时不分表
+type ModuloSharding struct {
+	dbs    []string
+	tables int
+}
+
+func NewModuloSharding(dbs []string, tables int) *ModuloSharding {
+	if tables < 1 {
+		tables = 1
+	}
+	return &ModuloSharding{
+		dbs:    dbs,
+		tables: tables,
+	}
+}
+
+func (s *ModuloSharding) Locate(key string) (Shard, error) {
+	if len(s.dbs) == 0 {
+		return Shard{}, errors.New("no db for modulo sharding")
+	}
+
+	id, err := parseShardID(key)
+	if err != nil {
+		return Shard{}, err
+	}
+
+	slot := id % int64(len(s.dbs)*s.tables)
+	if slot < 0 {
+		slot = -slot
+	}
+
+	shard := Shard{DB: s.dbs[slot/int64(s.tables)]}
+	if s.tables > 1 {
+		shard.Suffix = "_" + strconv.FormatInt(slot, 10)
+	}
+	return shard, nil
+}
+
+func (s *ModuloSharding) DBNames() []string {
+	return append([]string(nil), s.dbs...)
+}
+
+func (s *ModuloSharding) Shards() []Shard {
+	if s.tables == 1 {
+		return listShards(s.dbs, 1, nil)
+	}
+
+	shards := make([]Shard, 0, len(s.dbs)*s.tables)
+	for slot := 0; slot < len(s.dbs)*s.tables; slot++ {
+		shards = append(shards, Shard{DB: s.dbs[slot/s.tables], Suffix: "_" + strconv.Itoa(slot)})
+	}
+	return shards
+}
+
+//一致性hash，ring的节点为db name，增删db时只迁移少量key
+//tables>1时库内再按crc32(key)%tables分表，物理表后缀为_i
+type HashRingSharding struct {
+	ring   *utils.HashRing
+	tables int
+}
+
+func NewHashRingSharding(ring *utils.HashRing, tables int) *HashRingSharding {
+	if tables < 1 {
+		tables = 1
+	}
+	return &HashRingSharding{
+		ring:   ring,
+		tables: tables,
+	}
+}
+
+func (s *HashRingSharding) Locate(key string) (Shard, error) {
+	dbname := s.ring.GetNode(key)
+	if dbname == "" {
+		return Shard{}, errors.New("no db for hash ring sharding")
+	}
+
+	shard := Shard{DB: dbname}
+	if s.tables > 1 {
+		shard.Suffix = "_" + strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(key))%uint32(s.tables)), 10)
+	}
+	return shard, nil
+}
+
+func (s *HashRingSharding) DBNames() []string {
+	return s.ring.Nodes()
+}
+
+func (s *HashRingSharding) Shards() []Shard {
+	return listShards(s.ring.Nodes(), s.tables, func(i int) string { return "_" + strconv.Itoa(i) })
+}
+
+//数字id范围，[Start, End)
+type RangeShard struct {
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	DB     string `json:"db"`
+	Suffix string `json:"suffix"`
+}
+
+//按数字id范围分片，范围表一般来自配置
+type RangeSharding struct {
+	ranges []RangeShard
+}
+
+//范围不能为空或重叠
+func NewRangeSharding(ranges []RangeShard) (*RangeSharding, error) {
+	sorted := append([]RangeShard(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	for i, r := range sorted {
+		if r.Start >= r.End {
+			return nil, fmt.Errorf("invalid range [%d, %d)", r.Start, r.End)
+		}
+		if r.DB == "" {
+			return nil, fmt.Errorf("range [%d, %d) has no db", r.Start, r.End)
+		}
+		if i > 0 && sorted[i-1].End > r.Start {
+			return nil, fmt.Errorf("range [%d, %d) overlaps [%d, %d)", sorted[i-1].Start, sorted[i-1].End, r.Start, r.End)
+		}
+	}
+
+	return &RangeSharding{ranges: sorted}, nil
+}
+
+//从json配置加载范围表，如[{"start":0,"end":10000000,"db":"db0","suffix":"_0"}]
+func ParseRangeSharding(data []byte) (*RangeSharding, error) {
+	var ranges []RangeShard
+	if err := json.Unmarshal(data, &ranges); err != nil {
+		return nil, err
+	}
+	return NewRangeSharding(ranges)
+}
+
+func (s *RangeSharding) Locate(key string) (Shard, error) {
+	id, err := parseShardID(key)
+	if err != nil {
+		return Shard{}, err
+	}
+
+	i := sort.Search(len(s.ranges), func(i int) bool { return s.ranges[i].End > id })
+	if i == len(s.ranges) || s.ranges[i].Start > id {
+		return Shard{}, fmt.Errorf("no range for id %d", id)
+	}
+	return Shard{DB: s.ranges[i].DB, Suffix: s.ranges[i].Suffix}, nil
+}
+
+func (s *RangeSharding) DBNames() []string {
+	dbnames := make([]string, 0, len(s.ranges))
+	for _, r := range s.ranges {
+		dbnames = append(dbnames, r.DB)
+	}
+	return uniqueDBNames(dbnames)
+}
+
+func (s *RangeSharding) Shards() []Shard {
+	seen := make(map[Shard]bool, len(s.ranges))
+	shards := make([]Shard, 0, len(s.ranges))
+	for _, r := range s.ranges {
+		shard := Shard{DB: r.DB, Suffix: r.Suffix}
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+//从Since开始的数据写入DB
+type DateDB struct {
+	Since time.Time
+	DB    string
+}
+
+type DateShardingConfig struct {
+	//解析key的时间格式，为空时key为unix秒
+	KeyLayout string
+	//物理表后缀的时间格式，如"200601"按月分表、"20060102"按天分表，为空时不分表
+	TableLayout string
+	//按时间分库，key早于第一个Since时报错
+	DBs []DateDB
+	//时区，默认time.Local
+	Location *time.Location
+}
+
+//按时间分片，适合日志、流水等时序表
+type DateSharding struct {
+	keyLayout   string
+	tableLayout string
+	dbs         []DateDB
+	loc         *time.Location
+}
+
+func NewDateSharding(cfg *DateShardingConfig) (*DateSharding, error) {
+	if len(cfg.DBs) == 0 {
+		return nil, errors.New("no db for date sharding")
+	}
+
+	dbs := append([]DateDB(nil), cfg.DBs...)
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].Since.Before(dbs[j].Since) })
+
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.Local
+	}
+
+	return &DateSharding{
+		keyLayout:   cfg.KeyLayout,
+		tableLayout: cfg.TableLayout,
+		dbs:         dbs,
+		loc:         loc,
+	}, nil
+}
+
+func (s *DateSharding) parseKey(key string) (time.Time, error) {
+	if s.keyLayout == "" {
+		sec, err := parseShardID(key)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0).In(s.loc), nil
+	}
+
+	t, err := time.ParseInLocation(s.keyLayout, key, s.loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid sharding key %q: %v", key, err)
+	}
+	return t, nil
+}
+
+func (s *DateSharding) Locate(key string) (Shard, error) {
+	t, err := s.parseKey(key)
+	if err != nil {
+		return Shard{}, err
+	}
+	return s.LocateTime(t)
+}
+
+//按时间直接计算分片
+func (s *DateSharding) LocateTime(t time.Time) (Shard, error) {
+	i := sort.Search(len(s.dbs), func(i int) bool { return s.dbs[i].Since.After(t) })
+	if i == 0 {
+		return Shard{}, fmt.Errorf("no db for time %s", t)
+	}
+
+	shard := Shard{DB: s.dbs[i-1].DB}
+	if s.tableLayout != "" {
+		shard.Suffix = "_" + t.In(s.loc).Format(s.tableLayout)
+	}
+	return shard, nil
+}
+
+func (s *DateSharding) DBNames() []string {
+	dbnames := make([]string, 0, len(s.dbs))
+	for _, d := range s.dbs {
+		dbnames = append(dbnames, d.DB)
+	}
+	return uniqueDBNames(dbnames)
+}
+
+func uniqueDBNames(dbnames []string) []string {
+	seen := make(map[string]bool, len(dbnames))
+	unique := make([]string, 0, len(dbnames))
+	for _, dbname := range dbnames {
+		if !seen[dbname] {
+			seen[dbname] = true
+			unique = append(unique, dbname)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+//每个db下tables张表，tables<=1时不分表
+func listShards(dbnames []string, tables int, suffix func(int) string) []Shard {
+	if tables <= 1 {
+		shards := make([]Shard, 0, len(dbnames))
+		for _, dbname := range dbnames {
+			shards = append(shards, Shard{DB: dbname})
+		}
+		return shards
+	}
+
+	shards := make([]Shard, 0, len(dbnames)*tables)
+	for _, dbname := range dbnames {
+		for i := 0; i < tables; i++ {
+			shards = append(shards, Shard{DB: dbname, Suffix: suffix(i)})
+		}
+	}
+	return shards
+}
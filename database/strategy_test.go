@@ -0,0 +1,193 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/utils"
+)
+
+func TestModuloSharding(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       *ModuloSharding
+		key     string
+		want    Shard
+		wantErr bool
+	}{
+		{"db only", NewModuloSharding([]string{"db0", "db1"}, 1), "3", Shard{DB: "db1"}, false},
+		{"db and table", NewModuloSharding([]string{"db0", "db1"}, 4), "13", Shard{DB: "db1", Suffix: "_5"}, false},
+		{"first slot", NewModuloSharding([]string{"db0", "db1"}, 4), "8", Shard{DB: "db0", Suffix: "_0"}, false},
+		{"negative id", NewModuloSharding([]string{"db0", "db1"}, 2), "-3", Shard{DB: "db1", Suffix: "_3"}, false},
+		{"invalid key", NewModuloSharding([]string{"db0"}, 1), "abc", Shard{}, true},
+		{"no db", NewModuloSharding(nil, 1), "1", Shard{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.s.Locate(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Locate(%s) = %+v, want %+v", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	s := NewModuloSharding([]string{"db0", "db1"}, 2)
+	want := []Shard{{"db0", "_0"}, {"db0", "_1"}, {"db1", "_2"}, {"db1", "_3"}}
+	if got := s.Shards(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Shards() = %v, want %v", got, want)
+	}
+}
+
+func TestHashRingSharding(t *testing.T) {
+	ring := utils.NewHashRing(100)
+	ring.AddNodes(map[string]int{"db0": 1, "db1": 1, "db2": 1})
+	s := NewHashRingSharding(ring, 4)
+
+	for _, key := range []string{"1", "42", "user-7", "abc"} {
+		shard, err := s.Locate(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard.DB != ring.GetNode(key) {
+			t.Fatalf("Locate(%s).DB = %s, want %s", key, shard.DB, ring.GetNode(key))
+		}
+		again, _ := s.Locate(key)
+		if again != shard {
+			t.Fatalf("Locate(%s) not stable: %+v, %+v", key, shard, again)
+		}
+		found := false
+		for _, sh := range s.Shards() {
+			found = found || sh == shard
+		}
+		if !found {
+			t.Fatalf("Locate(%s) = %+v not in Shards()", key, shard)
+		}
+	}
+	if n := len(s.Shards()); n != 12 {
+		t.Fatalf("len(Shards()) = %d, want 12", n)
+	}
+
+	if _, err := NewHashRingSharding(utils.NewHashRing(100), 1).Locate("1"); err == nil {
+		t.Fatal("expected error for empty ring")
+	}
+}
+
+func TestRangeSharding(t *testing.T) {
+	s, err := ParseRangeSharding([]byte(`[
+		{"start": 100, "end": 200, "db": "db1", "suffix": "_1"},
+		{"start": 0, "end": 100, "db": "db0", "suffix": "_0"},
+		{"start": 300, "end": 400, "db": "db1", "suffix": "_2"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key     string
+		want    Shard
+		wantErr bool
+	}{
+		{"0", Shard{"db0", "_0"}, false},
+		{"99", Shard{"db0", "_0"}, false},
+		{"100", Shard{"db1", "_1"}, false},
+		{"399", Shard{"db1", "_2"}, false},
+		{"250", Shard{}, true},
+		{"400", Shard{}, true},
+		{"-1", Shard{}, true},
+		{"x", Shard{}, true},
+	}
+	for _, tt := range tests {
+		got, err := s.Locate(tt.key)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("Locate(%s) = %+v, %v, want %+v", tt.key, got, err, tt.want)
+		}
+	}
+	if got := s.DBNames(); !reflect.DeepEqual(got, []string{"db0", "db1"}) {
+		t.Fatalf("DBNames() = %v", got)
+	}
+	if got := s.Shards(); len(got) != 3 {
+		t.Fatalf("Shards() = %v", got)
+	}
+}
+
+func TestNewRangeShardingInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []RangeShard
+	}{
+		{"empty range", []RangeShard{{Start: 10, End: 10, DB: "db0"}}},
+		{"no db", []RangeShard{{Start: 0, End: 10}}},
+		{"overlap", []RangeShard{{Start: 0, End: 10, DB: "db0"}, {Start: 5, End: 20, DB: "db1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRangeSharding(tt.ranges); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestDateSharding(t *testing.T) {
+	loc := time.UTC
+	s, err := NewDateSharding(&DateShardingConfig{
+		KeyLayout:   "2006-01-02",
+		TableLayout: "200601",
+		Location:    loc,
+		DBs: []DateDB{
+			{Since: time.Date(2024, 1, 1, 0, 0, 0, 0, loc), DB: "db2024"},
+			{Since: time.Date(2023, 1, 1, 0, 0, 0, 0, loc), DB: "db2023"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key     string
+		want    Shard
+		wantErr bool
+	}{
+		{"2023-01-01", Shard{"db2023", "_202301"}, false},
+		{"2023-12-31", Shard{"db2023", "_202312"}, false},
+		{"2024-01-01", Shard{"db2024", "_202401"}, false},
+		{"2030-06-15", Shard{"db2024", "_203006"}, false},
+		{"2022-12-31", Shard{}, true},
+		{"20230101", Shard{}, true},
+	}
+	for _, tt := range tests {
+		got, err := s.Locate(tt.key)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Fatalf("Locate(%s) = %+v, %v, want %+v", tt.key, got, err, tt.want)
+		}
+	}
+	if got := s.DBNames(); !reflect.DeepEqual(got, []string{"db2023", "db2024"}) {
+		t.Fatalf("DBNames() = %v", got)
+	}
+
+	unix, err := NewDateSharding(&DateShardingConfig{Location: loc, DBs: []DateDB{{DB: "db"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := unix.Locate("1700000000"); err != nil || got != (Shard{DB: "db"}) {
+		t.Fatalf("Locate(unix) = %+v, %v", got, err)
+	}
+
+	if _, err := NewDateSharding(&DateShardingConfig{}); err == nil {
+		t.Fatal("expected error without dbs")
+	}
+}
+
+func TestShardingFunc(t *testing.T) {
+	f := ShardingFunc(NewModuloSharding([]string{"db0", "db1"}, 1))
+	if got := f("1"); got != "db1" {
+		t.Fatalf("f(1) = %q", got)
+	}
+	if got := f("bad"); got != "" {
+		t.Fatalf("f(bad) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,210 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type txKey struct{}
+
+//嵌套事务的状态
+type txState struct {
+	tx        *sql.Tx
+	savepoint int
+}
+
+//主库事务，带context和事务选项
+func (mrDB *MRDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	ctx, e := mrDB.before(ctx, OpBegin, mrDB.master, "", nil)
+	tx, err := mrDB.masterDB().BeginTx(ctx, opts)
+	mrDB.after(ctx, e, err)
+	return tx, err
+}
+
+//主库事务，fn返回nil提交，返回错误或panic回滚
+//TxRetryable判断为可重试的错误（默认死锁、序列化失败）按TxMaxRetries重试整个fn，fn需要可重复执行
+func (mrDB *MRDB) WithTx(ctx context.Context, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	return mrDB.WithTxContext(ctx, opts, func(ctx context.Context, tx *sql.Tx) error {
+		return fn(tx)
+	})
+}
+
+//同WithTx，fn收到的ctx带着当前事务，在fn里用这个ctx再调用WithTxContext会以savepoint嵌套，
+//嵌套的fn返回错误只回滚到savepoint，不会重试
+func (mrDB *MRDB) WithTxContext(ctx context.Context, opts *sql.TxOptions, fn func(context.Context, *sql.Tx) error) error {
+	if state, ok := ctx.Value(txKey{}).(*txState); ok {
+		return withSavepoint(ctx, state, fn)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := mrDB.runTx(ctx, opts, fn)
+		if err == nil {
+			mrDB.afterWrite(ctx)
+			return nil
+		}
+
+		if attempt >= mrDB.txRetries || !mrDB.txRetryable(err) {
+			return err
+		}
+
+		//指数退避加随机抖动
+		backoff := mrDB.txBackoff << uint(attempt)
+		backoff += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+//同WithTxContext，fn收到的*Tx上执行的sql经过钩子
+func (mrDB *MRDB) WithHookedTx(ctx context.Context, opts *sql.TxOptions, fn func(context.Context, *Tx) error) error {
+	return mrDB.WithTxContext(ctx, opts, func(ctx context.Context, tx *sql.Tx) error {
+		return fn(ctx, mrDB.HookTx(tx))
+	})
+}
+
+//带钩子的事务，Exec、Query、QueryRow及其Context版本经过MRDB的钩子，Target为master，
+//其他方法同*sql.Tx，Prepare、Stmt返回的*sql.Stmt上执行的sql不经过钩子
+type Tx struct {
+	*sql.Tx
+	mrDB *MRDB
+}
+
+//给BeginTx返回的事务加上钩子
+func (mrDB *MRDB) HookTx(tx *sql.Tx) *Tx {
+	return &Tx{Tx: tx, mrDB: mrDB}
+}
+
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, e := tx.mrDB.before(ctx, OpExec, tx.mrDB.master, query, args)
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	tx.mrDB.after(ctx, e, err)
+	return result, err
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, e := tx.mrDB.before(ctx, OpQuery, tx.mrDB.master, query, args)
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	tx.mrDB.after(ctx, e, err)
+	return rows, err
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	ctx, e := tx.mrDB.before(ctx, OpQueryRow, tx.mrDB.master, query, args)
+	row := tx.Tx.QueryRowContext(ctx, query, args...)
+	tx.mrDB.after(ctx, e, row.Err())
+	return row
+}
+
+func (mrDB *MRDB) runTx(ctx context.Context, opts *sql.TxOptions, fn func(context.Context, *sql.Tx) error) (err error) {
+	tx, err := mrDB.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			mrDB.endTx(ctx, OpRollback, tx.Rollback)
+			panic(p)
+		}
+	}()
+
+	if err := fn(context.WithValue(ctx, txKey{}, &txState{tx: tx}), tx); err != nil {
+		if rbErr := mrDB.endTx(ctx, OpRollback, tx.Rollback); rbErr != nil {
+			return fmt.Errorf("%w, rollback err: %v", err, rbErr)
+		}
+		return err
+	}
+
+	return mrDB.endTx(ctx, OpCommit, tx.Commit)
+}
+
+func (mrDB *MRDB) endTx(ctx context.Context, op string, end func() error) error {
+	ctx, e := mrDB.before(ctx, op, mrDB.master, "", nil)
+	err := end()
+	mrDB.after(ctx, e, err)
+	return err
+}
+
+func withSavepoint(ctx context.Context, state *txState, fn func(context.Context, *sql.Tx) error) (err error) {
+	state.savepoint++
+	name := fmt.Sprintf("sp_%d", state.savepoint)
+
+	if _, err := state.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			state.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+			panic(p)
+		}
+	}()
+
+	if err := fn(ctx, state.tx); err != nil {
+		if _, rbErr := state.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+			return fmt.Errorf("%w, rollback to savepoint err: %v", err, rbErr)
+		}
+		return err
+	}
+
+	_, err = state.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
+
+//驱动错误实现这个接口时按SQLSTATE判断是否可重试，如pgx、pq的错误
+type SQLStateError interface {
+	SQLState() string
+}
+
+//默认的可重试判断：SQLSTATE为40001序列化失败或40P01死锁，
+//go-sql-driver/mysql的错误没有SQLState方法，按错误码1213死锁、1205锁等待超时判断
+func IsRetryableTxError(err error) bool {
+	if number, ok := mysqlErrorNumber(err); ok {
+		return IsRetryableMySQLError(number)
+	}
+
+	var state SQLStateError
+	if !errors.As(err, &state) {
+		return false
+	}
+	switch state.SQLState() {
+	case "40001", "40P01":
+		return true
+	}
+	return false
+}
+
+//go-sql-driver/mysql返回的错误码
+func mysqlErrorNumber(err error) (uint16, bool) {
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		return me.Number, true
+	}
+	return 0, false
+}
+
+//mysql错误码是否可以重试整个事务：1213死锁、1205锁等待超时
+func IsRetryableMySQLError(number uint16) bool {
+	return number == 1213 || number == 1205
+}
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+//带SQLSTATE的驱动错误
+type sqlStateError string
+
+func (e sqlStateError) Error() string {
+	return "sqlstate " + string(e)
+}
+
+func (e sqlStateError) SQLState() string {
+	return string(e)
+}
+
+func newTestTxDB(t *testing.T, cfg *MRDBConfig) (*MRDB, *fakedb.Server) {
+	dsn, s := fakedb.NewServer(t, "master")
+	cfg.DN = fakedb.Driver
+	cfg.MasterDSN = dsn
+	db, err := NewMRDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, s
+}
+
+func TestIsRetryableTxError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{sqlStateError("40001"), true},
+		{sqlStateError("40P01"), true},
+		{sqlStateError("23000"), false},
+		{fmt.Errorf("insert: %w", sqlStateError("40001")), true},
+		//go-sql-driver/mysql的错误按错误码判断
+		{&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}, true},
+		{fmt.Errorf("update: %w", &mysql.MySQLError{Number: 1205}), true},
+		{&mysql.MySQLError{Number: 1062}, false},
+		//不按错误信息匹配
+		{errors.New("Error 1213: Deadlock found when trying to get lock"), false},
+	}
+	for _, tt := range tests {
+		if got := IsRetryableTxError(tt.err); got != tt.want {
+			t.Errorf("IsRetryableTxError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+
+	if !IsRetryableMySQLError(1213) || !IsRetryableMySQLError(1205) || IsRetryableMySQLError(1062) {
+		t.Fatal("IsRetryableMySQLError() mismatch")
+	}
+}
+
+func TestWithTxCommit(t *testing.T) {
+	db, s := newTestTxDB(t, &MRDBConfig{})
+
+	err := db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE t SET v = 1")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, c, r := s.TxCounts(); b != 1 || c != 1 || r != 0 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+}
+
+func TestWithTxNotRetryable(t *testing.T) {
+	db, s := newTestTxDB(t, &MRDBConfig{TxRetryBackoff: time.Millisecond})
+
+	boom := errors.New("boom")
+	calls := 0
+	err := db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		calls++
+		return boom
+	})
+	if err != boom || calls != 1 {
+		t.Fatalf("err = %v, calls = %d", err, calls)
+	}
+	if b, c, r := s.TxCounts(); b != 1 || c != 0 || r != 1 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+}
+
+func TestWithTxRetry(t *testing.T) {
+	db, s := newTestTxDB(t, &MRDBConfig{TxMaxRetries: 2, TxRetryBackoff: 5 * time.Millisecond})
+
+	calls := 0
+	start := time.Now()
+	err := db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		calls++
+		return fmt.Errorf("update: %w", sqlStateError("40001"))
+	})
+	if !IsRetryableTxError(err) || calls != 3 {
+		t.Fatalf("err = %v, calls = %d", err, calls)
+	}
+	//退避5ms、10ms
+	if d := time.Since(start); d < 15*time.Millisecond {
+		t.Fatalf("retried after %v, want backoff", d)
+	}
+	if b, c, r := s.TxCounts(); b != 3 || c != 0 || r != 3 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+
+	//重试后成功
+	calls = 0
+	err = db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		calls++
+		if calls == 1 {
+			return sqlStateError("40P01")
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Fatalf("err = %v, calls = %d", err, calls)
+	}
+}
+
+func TestWithTxNoRetry(t *testing.T) {
+	db, _ := newTestTxDB(t, &MRDBConfig{TxMaxRetries: -1})
+
+	calls := 0
+	db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		calls++
+		return sqlStateError("40001")
+	})
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+}
+
+func TestWithTxRetryable(t *testing.T) {
+	deadlock := errors.New("Error 1213")
+	db, _ := newTestTxDB(t, &MRDBConfig{
+		TxRetryBackoff: time.Millisecond,
+		TxRetryable:    func(err error) bool { return errors.Is(err, deadlock) },
+	})
+
+	calls := 0
+	db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		calls++
+		return deadlock
+	})
+	if calls != 4 {
+		t.Fatalf("calls = %d, want 4", calls)
+	}
+
+	calls = 0
+	db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+		calls++
+		return sqlStateError("40001")
+	})
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+}
+
+func TestWithTxContextCanceled(t *testing.T) {
+	db, s := newTestTxDB(t, &MRDBConfig{TxRetryBackoff: time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	err := db.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		cancel()
+		return sqlStateError("40001")
+	})
+	if !IsRetryableTxError(err) {
+		t.Fatalf("err = %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("returned after %v, want no backoff", d)
+	}
+	if b, _, _ := s.TxCounts(); b != 1 {
+		t.Fatalf("begins = %d, want 1", b)
+	}
+}
+
+func TestWithTxContextSavepoint(t *testing.T) {
+	db, s := newTestTxDB(t, &MRDBConfig{TxRetryBackoff: time.Millisecond})
+
+	inner := 0
+	err := db.WithTxContext(context.Background(), nil, func(ctx context.Context, tx *sql.Tx) error {
+		if err := db.WithTxContext(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.Exec("UPDATE a")
+			return err
+		}); err != nil {
+			return err
+		}
+
+		//嵌套的错误只回滚到savepoint，不重试
+		err := db.WithTxContext(ctx, nil, func(ctx context.Context, tx *sql.Tx) error {
+			inner++
+			tx.Exec("UPDATE b")
+			return sqlStateError("40001")
+		})
+		if !IsRetryableTxError(err) {
+			t.Errorf("inner err = %v", err)
+		}
+		return nil
+	})
+	if err != nil || inner != 1 {
+		t.Fatalf("err = %v, inner calls = %d", err, inner)
+	}
+
+	want := []string{
+		"SAVEPOINT sp_1", "UPDATE a", "RELEASE SAVEPOINT sp_1",
+		"SAVEPOINT sp_2", "UPDATE b", "ROLLBACK TO SAVEPOINT sp_2",
+	}
+	if got := s.ExecLog(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("execs = %v, want %v", got, want)
+	}
+	if b, c, r := s.TxCounts(); b != 1 || c != 1 || r != 0 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+}
+
+func TestWithTxPanic(t *testing.T) {
+	db, s := newTestTxDB(t, &MRDBConfig{})
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("recover() = %v, want boom", p)
+			}
+		}()
+		db.WithTx(context.Background(), nil, func(tx *sql.Tx) error {
+			panic("boom")
+		})
+	}()
+	if b, c, r := s.TxCounts(); b != 1 || c != 0 || r != 1 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+
+	//嵌套的panic先回滚到savepoint，再回滚外层事务
+	func() {
+		defer func() {
+			if p := recover(); p != "nested" {
+				t.Fatalf("recover() = %v, want nested", p)
+			}
+		}()
+		db.WithTxContext(context.Background(), nil, func(ctx context.Context, tx *sql.Tx) error {
+			return db.WithTxContext(ctx, nil, func(context.Context, *sql.Tx) error {
+				panic("nested")
+			})
+		})
+	}()
+	if got := s.ExecLog(); !reflect.DeepEqual(got, []string{"SAVEPOINT sp_1", "ROLLBACK TO SAVEPOINT sp_1"}) {
+		t.Fatalf("execs = %v", got)
+	}
+	if b, c, r := s.TxCounts(); b != 2 || c != 0 || r != 2 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+}
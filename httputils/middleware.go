@@ -0,0 +1,173 @@
+package httputils
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+)
+
+// Middleware 包装一次完整的请求和响应，只作用于使用它的Client
+// 可以修改请求、处理响应，或者不调用next直接返回构造的响应
+// 全局拦截器在中间件之前调用，设置了重试时每次请求都会经过中间件
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc 函数形式的http.RoundTripper
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Use 添加中间件，先添加的在外层
+func (c *Client) Use(middlewares ...Middleware) *Client {
+	c.middlewares = append(c.middlewares, middlewares...)
+	return c
+}
+
+// transport 中间件包装后的请求，最内层按host熔断后发送
+func (c *Client) transport() http.RoundTripper {
+	var rt http.RoundTripper = RoundTripperFunc(c.roundTrip)
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		rt = c.middlewares[i](rt)
+	}
+	return rt
+}
+
+// LoggingMiddleware 记录请求方法、url、状态码和耗时
+func LoggingMiddleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				clog.ErrorfCtx(req.Context(), "http %s %s err: %v, cost %s", req.Method, req.URL, err, time.Since(start))
+				return resp, err
+			}
+			clog.InfofCtx(req.Context(), "http %s %s %d, cost %s", req.Method, req.URL, resp.StatusCode, time.Since(start))
+			return resp, err
+		})
+	}
+}
+
+// MetricsMiddleware 每次请求结束后调用observe，d不包含读取响应body
+func MetricsMiddleware(observe func(req *http.Request, resp *http.Response, err error, d time.Duration)) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			observe(req, resp, err, time.Since(start))
+			return resp, err
+		})
+	}
+}
+
+// TokenSource 获取访问token，refresh为true时需要重新获取，不能返回缓存的token
+type TokenSource func(ctx context.Context, refresh bool) (string, error)
+
+// AuthMiddleware 设置Authorization: Bearer token，响应401时刷新token并重发一次
+// 请求体不能重放时（如流式上传）不重发，直接返回401响应
+func AuthMiddleware(token TokenSource) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			t, err := token(req.Context(), false)
+			if err != nil {
+				return nil, err
+			}
+
+			resp, err := next.RoundTrip(withBearer(req, t))
+			if err != nil || resp.StatusCode != http.StatusUnauthorized {
+				return resp, err
+			}
+			if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+				return resp, nil
+			}
+
+			t, err = token(req.Context(), true)
+			if err != nil {
+				return resp, nil
+			}
+			retry := withBearer(req, t)
+			if req.GetBody != nil {
+				if retry.Body, err = req.GetBody(); err != nil {
+					return resp, nil
+				}
+			}
+
+			resp.Body.Close()
+			return next.RoundTrip(retry)
+		})
+	}
+}
+
+func withBearer(req *http.Request, token string) *http.Request {
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// DecompressMiddleware 请求没有Accept-Encoding时声明支持gzip、deflate，并解压响应
+// http.Transport只在自己添加Accept-Encoding时自动解压gzip，请求头里已经设置时由这里解压
+// HEAD请求、204、304和空body的响应没有内容，不解压
+func DecompressMiddleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Accept-Encoding") == "" {
+				req = req.Clone(req.Context())
+				req.Header.Set("Accept-Encoding", "gzip, deflate")
+			}
+
+			resp, err := next.RoundTrip(req)
+			if err != nil || !hasBody(req, resp) {
+				return resp, err
+			}
+
+			var reader io.ReadCloser
+			switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+			case "gzip":
+				reader, err = gzip.NewReader(resp.Body)
+			case "deflate":
+				reader, err = zlib.NewReader(resp.Body)
+			default:
+				return resp, nil
+			}
+			if err == io.EOF {
+				//Content-Encoding头存在但body为空
+				reader, err = io.NopCloser(strings.NewReader("")), nil
+			}
+			if err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+
+			resp.Body = &decompressBody{ReadCloser: reader, body: resp.Body}
+			resp.Header.Del("Content-Encoding")
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+			resp.Uncompressed = true
+			return resp, nil
+		})
+	}
+}
+
+func hasBody(req *http.Request, resp *http.Response) bool {
+	if req.Method == http.MethodHead || resp.ContentLength == 0 {
+		return false
+	}
+	return resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+type decompressBody struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b *decompressBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
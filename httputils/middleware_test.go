@@ -0,0 +1,76 @@
+package httputils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func gzipBytes(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressMiddleware(t *testing.T) {
+	compressed := gzipBytes(t, "hello")
+
+	tests := []struct {
+		name          string
+		method        string
+		status        int
+		body          []byte
+		contentLength int64
+		want          string
+		wantEncoding  string
+	}{
+		{"gzip", http.MethodGet, http.StatusOK, compressed, int64(len(compressed)), "hello", ""},
+		{"gzip unknown length", http.MethodGet, http.StatusOK, compressed, -1, "hello", ""},
+		{"empty body unknown length", http.MethodGet, http.StatusOK, nil, -1, "", ""},
+		{"head", http.MethodHead, http.StatusOK, nil, int64(len(compressed)), "", "gzip"},
+		{"no content", http.MethodGet, http.StatusNoContent, nil, -1, "", "gzip"},
+		{"not modified", http.MethodGet, http.StatusNotModified, nil, -1, "", "gzip"},
+		{"zero length", http.MethodGet, http.StatusOK, nil, 0, "", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Header.Get("Accept-Encoding") == "" {
+					t.Fatal("Accept-Encoding not set")
+				}
+				return &http.Response{
+					StatusCode:    tt.status,
+					Header:        http.Header{"Content-Encoding": []string{"gzip"}},
+					Body:          io.NopCloser(bytes.NewReader(tt.body)),
+					ContentLength: tt.contentLength,
+				}, nil
+			})
+
+			req, _ := http.NewRequest(tt.method, "http://example.com", nil)
+			resp, err := DecompressMiddleware()(next).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.want {
+				t.Fatalf("body = %q, want %q", b, tt.want)
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package httputils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Part form-data中的一个文件，内容来自任意io.Reader
+type Part struct {
+	// Field 表单字段名
+	Field string
+	// FileName 文件名
+	FileName string
+	// ContentType 默认application/octet-stream
+	ContentType string
+	// Reader 文件内容，实现io.Seeker时重试会从头重新读取，否则不能重试
+	Reader io.Reader
+	// Size 内容长度，为0时按Reader推断（bytes.Reader、strings.Reader、bytes.Buffer、普通文件），推断不出时不设置Content-Length
+	Size int64
+}
+
+// Progress 上传进度回调，sent为已发送的字节数，total为请求体总长度，未知时为-1
+// 重试时从0重新开始
+type Progress func(sent int64, total int64)
+
+// requestBody 请求体，每次请求调用open获取一份新的body
+type requestBody struct {
+	open func() (io.ReadCloser, error)
+	// 长度，-1未知
+	length int64
+	// 能否重新打开用于重试
+	replayable bool
+}
+
+func bytesBody(b []byte) *requestBody {
+	return &requestBody{
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(b)), nil
+		},
+		length:     int64(len(b)),
+		replayable: true,
+	}
+}
+
+// multipartPart 按写入顺序排好的一个part
+type multipartPart struct {
+	header textproto.MIMEHeader
+	// 字段值
+	value string
+	// 文件路径，每次请求重新打开
+	path string
+	// 调用方传入的Reader
+	reader io.Reader
+	start  int64
+	size   int64
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+func fileHeader(field, filename, contentType string) textproto.MIMEHeader {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(field), quoteEscaper.Replace(filename)))
+	h.Set(ContentType, contentType)
+	return h
+}
+
+func fieldHeader(field string) textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"`, quoteEscaper.Replace(field)))
+	return h
+}
+
+// readerSize 能推断出的剩余长度，推断不出时返回-1
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		fi, err := v.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - pos
+	}
+	return -1
+}
+
+// multipartParts 按File、Parts、Value的顺序排好所有part，File和Value按字段名排序
+func (f *FileForm) multipartParts() ([]multipartPart, error) {
+	var parts []multipartPart
+
+	names := make([]string, 0, len(f.File))
+	for name := range f.File {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := f.File[name]
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, multipartPart{
+			header: fileHeader(name, path, ""),
+			path:   path,
+			size:   fi.Size(),
+		})
+	}
+
+	for _, p := range f.Parts {
+		if p.Reader == nil {
+			return nil, fmt.Errorf("part %s has no reader", p.Field)
+		}
+		part := multipartPart{
+			header: fileHeader(p.Field, p.FileName, p.ContentType),
+			reader: p.Reader,
+			size:   p.Size,
+			start:  -1,
+		}
+		if part.size == 0 {
+			part.size = readerSize(p.Reader)
+		}
+		if seeker, ok := p.Reader.(io.Seeker); ok {
+			if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+				part.start = start
+			}
+		}
+		parts = append(parts, part)
+	}
+
+	names = names[:0]
+	for name := range f.Value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range f.Value[name] {
+			parts = append(parts, multipartPart{
+				header: fieldHeader(name),
+				value:  value,
+				size:   int64(len(value)),
+			})
+		}
+	}
+	return parts, nil
+}
+
+// multipartLength 所有part长度已知时计算整个请求体的长度，否则返回-1
+func multipartLength(parts []multipartPart, boundary string) int64 {
+	var content int64
+	for _, p := range parts {
+		if p.size < 0 {
+			return -1
+		}
+		content += p.size
+	}
+
+	// 用同样的boundary只写part头，得到除内容外的长度
+	counter := &countWriter{}
+	w := multipart.NewWriter(counter)
+	w.SetBoundary(boundary)
+	for _, p := range parts {
+		if _, err := w.CreatePart(p.header); err != nil {
+			return -1
+		}
+	}
+	if err := w.Close(); err != nil {
+		return -1
+	}
+	return counter.n + content
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// progressWriter 写入时回调上传进度
+type progressWriter struct {
+	w        io.Writer
+	sent     int64
+	total    int64
+	progress Progress
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.sent += int64(n)
+	w.progress(w.sent, w.total)
+	return n, err
+}
+
+// multipartBody 流式的form-data请求体，通过io.Pipe边读文件边发送，不在内存中缓存文件
+// 所有Reader都能Seek时可以重试
+func (c *Client) multipartBody() (*requestBody, error) {
+	parts, err := c.multipart.multipartParts()
+	if err != nil {
+		return nil, err
+	}
+
+	writer := multipart.NewWriter(io.Discard)
+	boundary := writer.Boundary()
+	c.header.Set(ContentType, writer.FormDataContentType())
+
+	length := multipartLength(parts, boundary)
+	replayable := true
+	for _, p := range parts {
+		if p.reader != nil && p.start < 0 {
+			replayable = false
+		}
+	}
+
+	var prev *io.PipeReader
+	var prevDone chan struct{}
+	open := func() (io.ReadCloser, error) {
+		if prev != nil {
+			if !replayable {
+				return nil, errors.New("multipart body can not be replayed")
+			}
+			// 等上一次的写入结束再Seek，避免和读取并发
+			prev.Close()
+			<-prevDone
+			for _, p := range parts {
+				if p.reader == nil {
+					continue
+				}
+				if _, err := p.reader.(io.Seeker).Seek(p.start, io.SeekStart); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		pr, pw := io.Pipe()
+		var dst io.Writer = pw
+		if c.multipart.Progress != nil {
+			dst = &progressWriter{w: pw, total: length, progress: c.multipart.Progress}
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pw.CloseWithError(writeMultipart(dst, boundary, parts))
+		}()
+		prev, prevDone = pr, done
+		return pr, nil
+	}
+
+	return &requestBody{
+		open:       open,
+		length:     length,
+		replayable: replayable,
+	}, nil
+}
+
+// writeMultipart 按顺序写入所有part，读取方关闭时返回错误结束
+func writeMultipart(dst io.Writer, boundary string, parts []multipartPart) error {
+	w := multipart.NewWriter(dst)
+	if err := w.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	for _, p := range parts {
+		part, err := w.CreatePart(p.header)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case p.path != "":
+			file, err := os.Open(p.path)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(part, file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+		case p.reader != nil:
+			if _, err := io.Copy(part, p.reader); err != nil {
+				return err
+			}
+		default:
+			if _, err := io.WriteString(part, p.value); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Close()
+}
+
+// setBody 设置请求体，body可以重放时设置GetBody
+func setBody(req *http.Request, body *requestBody) error {
+	if body == nil {
+		return nil
+	}
+	if body.length == 0 {
+		req.Body = http.NoBody
+		return nil
+	}
+
+	rc, err := body.open()
+	if err != nil {
+		return err
+	}
+	req.Body = rc
+	req.ContentLength = body.length
+	if body.replayable {
+		req.GetBody = body.open
+	}
+	return nil
+}
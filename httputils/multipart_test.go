@@ -0,0 +1,121 @@
+package httputils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/breaker"
+)
+
+// onlyReader 隐藏Len和Seek，长度不能推断
+type onlyReader struct {
+	r io.Reader
+}
+
+func (r onlyReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func TestMultipartLength(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("file content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		form    FileForm
+		unknown bool
+	}{
+		{"values", FileForm{Value: url.Values{"a": {"1", "2"}, "b": {`q"uote`}}}, false},
+		{"file", FileForm{File: map[string]string{"f": path}}, false},
+		{"bytes reader", FileForm{Parts: []Part{{Field: "p", FileName: "p.bin", Reader: bytes.NewReader([]byte("abc"))}}}, false},
+		{"strings reader with size", FileForm{Parts: []Part{{Field: "p", FileName: "p.txt", ContentType: "text/plain", Reader: strings.NewReader("hello"), Size: 5}}}, false},
+		{"mixed", FileForm{
+			Value: url.Values{"k": {"v"}},
+			File:  map[string]string{"f": path},
+			Parts: []Part{{Field: "p", FileName: "p.bin", Reader: bytes.NewBufferString("buffer")}},
+		}, false},
+		{"unknown size", FileForm{Parts: []Part{{Field: "p", FileName: "p.bin", Reader: onlyReader{strings.NewReader("xyz")}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, err := tt.form.multipartParts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			const boundary = "test-boundary"
+			length := multipartLength(parts, boundary)
+
+			var buf bytes.Buffer
+			if err := writeMultipart(&buf, boundary, parts); err != nil {
+				t.Fatal(err)
+			}
+			if tt.unknown {
+				if length != -1 {
+					t.Fatalf("length = %d, want -1", length)
+				}
+				return
+			}
+			if length != int64(buf.Len()) {
+				t.Fatalf("length = %d, written %d", length, buf.Len())
+			}
+		})
+	}
+}
+
+// waitGoroutines 等待goroutine数回到n以内
+func waitGoroutines(t *testing.T, n int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d, want <= %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMultipartBodyClosedWhenNotSent(t *testing.T) {
+	open := breaker.NewGroup(&breaker.Config{MinRequests: 1})
+	open.Get("127.0.0.1:1").Do(func() error { return errors.New("down") })
+
+	tests := []struct {
+		name  string
+		setup func(c *Client) *Client
+	}{
+		{"breaker open", func(c *Client) *Client {
+			return c.Breaker(open)
+		}},
+		{"middleware error", func(c *Client) *Client {
+			return c.Use(func(next http.RoundTripper) http.RoundTripper {
+				return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					return nil, errors.New("no token")
+				})
+			})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			data := strings.Repeat("x", 1<<20)
+			c := tt.setup(Post("http://127.0.0.1:1/upload").Multipart(FileForm{
+				Parts: []Part{{Field: "f", FileName: "f.bin", Reader: onlyReader{strings.NewReader(data)}}},
+			}))
+			if r := c.Send(); r.Err == nil {
+				t.Fatal("expected error")
+			}
+			waitGoroutines(t, before)
+		})
+	}
+}
@@ -1,17 +1,21 @@
 package httputils
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/yybirdcf/golib/breaker"
+	"github.com/yybirdcf/golib/trace"
 )
 
 const (
@@ -20,7 +24,7 @@ const (
 	ApplicationFormUrlencoded = "application/x-www-form-urlencoded"
 )
 
-// RequestInterceptor 请求拦截器
+// RequestInterceptor 请求拦截器，对所有Client生效，只作用于某个Client时使用Middleware
 // 返回不为nil，即有错误会终止后续执行
 type RequestInterceptor func(request *http.Request) error
 
@@ -39,7 +43,13 @@ var defaultRequestInterceptorChain = &requestInterceptorChain{
 // Client 封装了http的参数等信息
 type Client struct {
 	// 自定义Client
-	client *http.Client
+	client   *http.Client
+	ctx      context.Context
+	timeout  time.Duration
+	retry    *RetryPolicy
+	breakers *breaker.Group
+	// 只作用于这个Client的中间件
+	middlewares []Middleware
 
 	url    string
 	method string
@@ -51,10 +61,15 @@ type Client struct {
 	multipart FileForm
 }
 
-// FileForm form参数和文件参数
+// FileForm form参数和文件参数，请求体边读边发送，不在内存中缓存文件
 type FileForm struct {
 	Value url.Values
-	File  map[string]string
+	// File 字段名对应的文件路径
+	File map[string]string
+	// Parts 来自任意io.Reader的文件
+	Parts []Part
+	// Progress 上传进度回调
+	Progress Progress
 }
 
 // Result http响应结果
@@ -89,6 +104,34 @@ func Request(url, method string, client *http.Client) *Client {
 	return newClient(url, method, client)
 }
 
+// Context 请求使用的context，拦截器可以从request.Context()中读取
+// ctx中有trace时自动注入traceparent header，Header已经设置的不覆盖
+func (c *Client) Context(ctx context.Context) *Client {
+	c.ctx = ctx
+	return c
+}
+
+// Timeout 单次请求的超时，包含读取响应body，重试时每次请求单独计时，总时长由Context控制
+func (c *Client) Timeout(timeout time.Duration) *Client {
+	c.timeout = timeout
+	return c
+}
+
+// Retry 失败重试，默认连接错误、429和5xx重试，响应有Retry-After时按Retry-After等待
+// POST、PATCH只在带Idempotency-Key请求头或RetryNonIdempotent时重试，连接失败时任何方法都重试
+// form-data的Part.Reader不能Seek时请求体不能重放，只请求一次
+func (c *Client) Retry(policy *RetryPolicy) *Client {
+	c.retry = policy
+	return c
+}
+
+// Breaker 按host熔断，同一个host的请求应使用同一个Group
+// 连接错误和5xx响应算作失败，熔断时不发送请求，Result.Err为breaker.ErrOpen
+func (c *Client) Breaker(breakers *breaker.Group) *Client {
+	c.breakers = breakers
+	return c
+}
+
 // Params http请求中url参数
 func (c *Client) Params(params url.Values) *Client {
 	for k, v := range params {
@@ -134,7 +177,7 @@ func (c *Client) Multipart(multipart FileForm) *Client {
 
 // Send 发送http请求
 func (c *Client) Send() *Result {
-	var result *Result
+	var result = new(Result)
 
 	// 处理query string
 	if c.params != nil && len(c.params) != 0 {
@@ -148,139 +191,146 @@ func (c *Client) Send() *Result {
 	}
 
 	// 根据不同的Content-Type设置不同的http body
+	var body *requestBody
 	contentType := c.header.Get(ContentType)
-	if c.multipart.Value != nil || c.multipart.File != nil {
-		result = c.createMultipartForm()
+	if c.multipart.Value != nil || c.multipart.File != nil || c.multipart.Parts != nil {
+		var err error
+		if body, err = c.multipartBody(); err != nil {
+			result.Err = err
+			return result
+		}
 	} else if strings.HasPrefix(contentType, ApplicationJSON) {
-		result = c.createJson()
+		b, err := json.Marshal(c.json)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		body = bytesBody(b)
 	} else if strings.HasPrefix(contentType, ApplicationFormUrlencoded) {
-		result = c.createForm()
-	} else {
-		// 不是以上类型，就不设置http body
-		result = c.createEmptyBody()
+		body = bytesBody([]byte(c.form.Encode()))
 	}
+	// 不是以上类型，就不设置http body
 
+	c.doSend(body, result)
 	return result
 }
 
-// createMultipartForm 创建form-data的请求
-func (c *Client) createMultipartForm() *Result {
-	var result = new(Result)
-
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
+// doSend 发送请求，设置了重试策略时失败后重试，每次重试都会重新创建请求并调用拦截器
+func (c *Client) doSend(body *requestBody, result *Result) {
+	attempts := 1
+	// 流式的请求体不能重放时只请求一次
+	if c.retry != nil && (body == nil || body.replayable) {
+		attempts = c.retry.maxAttempts()
+	}
 
-	// 设置文件字节
-	for name, filename := range c.multipart.File {
-		file, err := os.Open(filename)
-		if err != nil {
-			result.Err = err
-			return result
+	for attempt := 1; ; attempt++ {
+		req, resp, err := c.attempt(body)
+		if req == nil || attempt >= attempts || c.ctx.Err() != nil || errors.Is(err, breaker.ErrOpen) ||
+			!c.retry.shouldRetry(req, resp, err) {
+			result.Resp, result.Err = resp, err
+			return
 		}
 
-		part, err := writer.CreateFormFile(name, filename)
-		if err != nil {
-			result.Err = err
-			return result
+		delay, ok := c.retry.backoff(attempt, resp)
+		if !ok {
+			result.Resp, result.Err = resp, err
+			return
 		}
-
-		// todo 这里的io.Copy实现，会把file文件都读取到内存里面，然后当做一个buffer传给NewRequest。对于大文件来说会占用很多内存
-		_, err = io.Copy(part, file)
-		if err != nil {
-			result.Err = err
-			return result
+		if resp != nil {
+			// 读完body才能复用连接
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
 		}
 
-		err = file.Close()
-		if err != nil {
-			result.Err = err
-			return result
+		timer := time.NewTimer(delay)
+		select {
+		case <-c.ctx.Done():
+			timer.Stop()
+			result.Err = c.ctx.Err()
+			return
+		case <-timer.C:
 		}
 	}
+}
 
-	// 设置field
-	for name, values := range c.multipart.Value {
-		for _, value := range values {
-			_ = writer.WriteField(name, value)
-		}
+// attempt 发送一次请求，拦截器返回错误时req为nil，不再重试
+func (c *Client) attempt(body *requestBody) (*http.Request, *http.Response, error) {
+	ctx, cancel := c.ctx, context.CancelFunc(func() {})
+	if c.timeout > 0 {
+		ctx, cancel = context.WithTimeout(c.ctx, c.timeout)
 	}
 
-	err := writer.Close()
+	req, err := http.NewRequestWithContext(ctx, c.method, c.url, nil)
 	if err != nil {
-		result.Err = err
-		return result
+		cancel()
+		return nil, nil, err
+	}
+	req.Header = c.header.Clone()
+	if err := setBody(req, body); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if req.Header.Get(trace.TraceparentHeader) == "" {
+		trace.Inject(ctx, req.Header)
 	}
 
-	req, err := http.NewRequest(c.method, c.url, body)
-	req.Header = c.header
-	req.Header.Set(ContentType, writer.FormDataContentType())
-	c.doSend(req, result)
-	return result
-}
-
-// createForm 创建application/json请求
-func (c *Client) createJson() *Result {
-	var result = new(Result)
-
-	b, err := json.Marshal(c.json)
-	if err != nil {
-		result.Err = err
-		return result
+	// 调用拦截器，遇到错误就退出
+	if err := c.beforeSend(req); err != nil {
+		closeBody(req)
+		cancel()
+		return nil, nil, err
 	}
 
-	req, err := http.NewRequest(c.method, c.url, bytes.NewReader(b))
+	resp, err := c.transport().RoundTrip(req)
 	if err != nil {
-		result.Err = err
-		return result
+		// 熔断或中间件没有调用next时请求体不会被http.Client关闭，multipart的写goroutine会一直阻塞
+		closeBody(req)
+		cancel()
+		return req, nil, err
 	}
-
-	req.Header = c.header
-	c.doSend(req, result)
-	return result
+	// 超时覆盖读取body，body关闭时释放
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return req, resp, nil
 }
 
-// createForm 创建application/x-www-form-urlencoded请求
-func (c *Client) createForm() *Result {
-	var result = new(Result)
-
-	form := c.form.Encode()
+// roundTrip 按host熔断后发送请求
+func (c *Client) roundTrip(req *http.Request) (*http.Response, error) {
+	if c.breakers == nil {
+		return c.client.Do(req)
+	}
 
-	req, err := http.NewRequest(c.method, c.url, strings.NewReader(form))
+	done, err := c.breakers.Get(req.URL.Host).Allow()
 	if err != nil {
-		result.Err = err
-		return result
+		closeBody(req)
+		return nil, fmt.Errorf("%s: %w", req.URL.Host, err)
 	}
 
-	req.Header = c.header
-	c.doSend(req, result)
-	return result
+	// 发送请求
+	resp, err := c.client.Do(req)
+	if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+		done(fmt.Errorf("status code %d", resp.StatusCode))
+	} else {
+		done(err)
+	}
+	return resp, err
 }
 
-// createEmptyBody 没有内容的body
-func (c *Client) createEmptyBody() *Result {
-	var result = new(Result)
-
-	req, err := http.NewRequest(c.method, c.url, nil)
-	if err != nil {
-		result.Err = err
-		return result
+// closeBody 关闭没有发送的请求体，重复关闭没有影响
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
 	}
-
-	req.Header = c.header
-	c.doSend(req, result)
-	return result
 }
 
-// doSend 发送请求
-func (c *Client) doSend(req *http.Request, result *Result) {
-	// 调用拦截器，遇到错误就退出
-	if err := c.beforeSend(req); err != nil {
-		result.Err = err
-		return
-	}
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-	// 发送请求
-	result.Resp, result.Err = c.client.Do(req)
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
 
 // beforeSend 发送请求前，调用拦截器
@@ -394,6 +444,7 @@ func newClient(u string, method string, client *http.Client) *Client {
 	}
 	return &Client{
 		client: client,
+		ctx:    context.Background(),
 		url:    u,
 		method: method,
 		header: make(http.Header),
@@ -0,0 +1,55 @@
+package httputils
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/yybirdcf/golib/trace"
+)
+
+// captureHeader 不发送请求，记录请求header并返回200
+func captureHeader(headers *[]http.Header) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			*headers = append(*headers, req.Header.Clone())
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+				Request:    req,
+			}, nil
+		})
+	}
+}
+
+func TestTraceparentInjected(t *testing.T) {
+	var headers []http.Header
+	ctx, sc := trace.StartSpan(context.Background())
+
+	// ctx中有trace时默认注入
+	if err := Get("http://example.com").Context(ctx).Use(captureHeader(&headers)).Send().Err; err != nil {
+		t.Fatal(err)
+	}
+	if got := headers[0].Get(trace.TraceparentHeader); got != sc.Traceparent() {
+		t.Fatalf("traceparent = %q, want %q", got, sc.Traceparent())
+	}
+
+	// 没有trace时不注入
+	if err := Get("http://example.com").Use(captureHeader(&headers)).Send().Err; err != nil {
+		t.Fatal(err)
+	}
+	if got := headers[1].Get(trace.TraceparentHeader); got != "" {
+		t.Fatalf("traceparent without span = %q", got)
+	}
+
+	// 调用方设置的header不覆盖
+	custom := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	if err := Get("http://example.com").Context(ctx).Header(trace.TraceparentHeader, custom).Use(captureHeader(&headers)).Send().Err; err != nil {
+		t.Fatal(err)
+	}
+	if got := headers[2].Get(trace.TraceparentHeader); got != custom {
+		t.Fatalf("traceparent = %q, want %q", got, custom)
+	}
+}
@@ -0,0 +1,132 @@
+package httputils
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// IdempotencyKey 带有该请求头的非幂等请求（POST、PATCH）也会重试
+const IdempotencyKey = "Idempotency-Key"
+
+// RetryPolicy 重试策略
+type RetryPolicy struct {
+	// MaxAttempts 最多请求次数，包含第一次，默认3
+	MaxAttempts int
+	// BaseDelay 第一次重试的退避上限，之后每次翻倍，默认100毫秒
+	BaseDelay time.Duration
+	// MaxDelay 退避上限，默认5秒
+	MaxDelay time.Duration
+	// MaxRetryAfter 响应的Retry-After超过该值时不再重试，直接返回响应，默认30秒
+	MaxRetryAfter time.Duration
+	// RetryNonIdempotent 为true时POST、PATCH没有Idempotency-Key请求头也重试
+	RetryNonIdempotent bool
+	// ShouldRetry 自定义是否重试，默认连接错误、429和5xx重试
+	ShouldRetry func(resp *http.Response, err error) bool
+}
+
+// DefaultRetryPolicy 默认的重试策略
+var DefaultRetryPolicy = &RetryPolicy{}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	// 连接没建立时请求还没发出，任何方法都可以重试
+	if isDialError(err) {
+		return true
+	}
+	if !p.RetryNonIdempotent && !isIdempotent(req) {
+		return false
+	}
+
+	if p.ShouldRetry != nil {
+		return p.ShouldRetry(resp, err)
+	}
+	if err != nil {
+		// 连接错误、单次请求超时，调用方的ctx结束时在外层不再重试
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// backoff 第attempt次请求失败后的等待时间，指数退避加全抖动，响应有Retry-After时至少等待Retry-After
+// 返回false表示Retry-After太长，不再重试
+func (p *RetryPolicy) backoff(attempt int, resp *http.Response) (time.Duration, bool) {
+	base := p.BaseDelay
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+
+	delay := max
+	if shift := attempt - 1; shift < 32 && base<<shift < max {
+		delay = base << shift
+	}
+	delay = time.Duration(rand.Int63n(int64(delay) + 1))
+
+	if resp == nil {
+		return delay, true
+	}
+	retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+	if !ok {
+		return delay, true
+	}
+
+	maxRetryAfter := p.MaxRetryAfter
+	if maxRetryAfter <= 0 {
+		maxRetryAfter = 30 * time.Second
+	}
+	if retryAfter > maxRetryAfter {
+		return 0, false
+	}
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay, true
+}
+
+// parseRetryAfter Retry-After为秒数或http时间
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// isIdempotent 按方法判断是否幂等，POST、PATCH带Idempotency-Key时视为幂等
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get(IdempotencyKey) != ""
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,117 @@
+package httputils
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		value  string
+		min    time.Duration
+		max    time.Duration
+		wantOK bool
+	}{
+		{"empty", "", 0, 0, false},
+		{"seconds", "120", 120 * time.Second, 120 * time.Second, true},
+		{"zero", "0", 0, 0, true},
+		{"negative", "-1", 0, 0, false},
+		{"http date", future, 59 * time.Minute, time.Hour, true},
+		{"past date", past, 0, 0, true},
+		{"invalid", "soon", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, ok := parseRetryAfter(tt.value)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if d < tt.min || d > tt.max {
+				t.Fatalf("delay = %s, want between %s and %s", d, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second, MaxRetryAfter: 10 * time.Second}
+	retryAfter := func(v string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{v}}}
+	}
+
+	tests := []struct {
+		name    string
+		attempt int
+		resp    *http.Response
+		min     time.Duration
+		max     time.Duration
+		wantOK  bool
+	}{
+		{"first attempt", 1, nil, 0, 100 * time.Millisecond, true},
+		{"doubles", 3, nil, 0, 400 * time.Millisecond, true},
+		{"capped", 10, nil, 0, time.Second, true},
+		{"large attempt", 100, nil, 0, time.Second, true},
+		{"retry after raises delay", 1, retryAfter("2"), 2 * time.Second, 2 * time.Second, true},
+		{"retry after too long", 1, retryAfter("60"), 0, 0, false},
+		{"invalid retry after ignored", 1, retryAfter("later"), 0, 100 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				d, ok := p.backoff(tt.attempt, tt.resp)
+				if ok != tt.wantOK {
+					t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+				}
+				if d < tt.min || d > tt.max {
+					t.Fatalf("delay = %s, want between %s and %s", d, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	get, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	post, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+	keyed, _ := http.NewRequest(http.MethodPost, "http://example.com", nil)
+	keyed.Header.Set(IdempotencyKey, "k")
+
+	status := func(code int) *http.Response {
+		return &http.Response{StatusCode: code}
+	}
+	dialErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Err: errors.New("connection reset")}
+
+	tests := []struct {
+		name   string
+		policy *RetryPolicy
+		req    *http.Request
+		resp   *http.Response
+		err    error
+		want   bool
+	}{
+		{"get 503", DefaultRetryPolicy, get, status(503), nil, true},
+		{"get 429", DefaultRetryPolicy, get, status(429), nil, true},
+		{"get 404", DefaultRetryPolicy, get, status(404), nil, false},
+		{"get read error", DefaultRetryPolicy, get, nil, readErr, true},
+		{"post 503", DefaultRetryPolicy, post, status(503), nil, false},
+		{"post dial error", DefaultRetryPolicy, post, nil, dialErr, true},
+		{"post with idempotency key", DefaultRetryPolicy, keyed, status(503), nil, true},
+		{"post non idempotent allowed", &RetryPolicy{RetryNonIdempotent: true}, post, status(503), nil, true},
+		{"custom", &RetryPolicy{ShouldRetry: func(resp *http.Response, err error) bool { return resp.StatusCode == 404 }}, get, status(404), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.shouldRetry(tt.req, tt.resp, tt.err); got != tt.want {
+				t.Fatalf("shouldRetry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
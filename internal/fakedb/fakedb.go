@@ -0,0 +1,340 @@
+//测试用的database/sql驱动，驱动名fakedb，每个dsn对应一个Server
+//Server默认对所有查询返回SetRows设置的结果，需要按语句模拟时用SetHandlers，需要事务语义时用SetBegin
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+)
+
+//驱动名，MRDBConfig.DN
+const Driver = "fakedb"
+
+//按语句返回结果，代替SetRows和SetErr
+type QueryFunc func(ctx context.Context, query string, args []driver.Value) (driver.Rows, error)
+type ExecFunc func(ctx context.Context, query string, args []driver.Value) (driver.Result, error)
+
+//事务开始时调用，返回提交和回滚时调用的函数，用于快照和恢复数据
+type BeginFunc func() (commit func() error, rollback func() error)
+
+//testing.TB中用到的方法
+type TB interface {
+	Name() string
+	Cleanup(func())
+}
+
+type Server struct {
+	mu      sync.Mutex
+	down    bool
+	columns []string
+	rows    [][]driver.Value
+	err     error
+	prepErr error
+	onQuery QueryFunc
+	onExec  ExecFunc
+	onBegin BeginFunc
+
+	prepares    int
+	stmtCloses  int
+	stmtQueries int
+
+	begins    int
+	commits   int
+	rollbacks int
+	execs     []string
+}
+
+var servers sync.Map
+
+func init() {
+	sql.Register(Driver, fakeDriver{})
+}
+
+//注册一个Server，返回它的dsn，测试结束时注销
+func NewServer(t TB, name string) (string, *Server) {
+	dsn := t.Name() + "/" + name
+	s := &Server{columns: []string{"v"}}
+	servers.Store(dsn, s)
+	t.Cleanup(func() { servers.Delete(dsn) })
+	return dsn, s
+}
+
+//down时ping、查询、预编译和开始事务都返回driver.ErrBadConn
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *Server) SetRows(columns []string, rows ...[]driver.Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.columns = columns
+	s.rows = rows
+}
+
+//Exec、Query返回的错误
+func (s *Server) SetErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+//Prepare返回的错误
+func (s *Server) SetPrepareErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prepErr = err
+}
+
+func (s *Server) SetHandlers(onQuery QueryFunc, onExec ExecFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onQuery = onQuery
+	s.onExec = onExec
+}
+
+func (s *Server) SetBegin(onBegin BeginFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onBegin = onBegin
+}
+
+func (s *Server) Counts() (prepares int, stmtCloses int, stmtQueries int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prepares, s.stmtCloses, s.stmtQueries
+}
+
+func (s *Server) TxCounts() (begins int, commits int, rollbacks int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.begins, s.commits, s.rollbacks
+}
+
+//执行过的Exec语句
+func (s *Server) ExecLog() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.execs...)
+}
+
+//handler不持有锁调用，可以在handler里调用Server的方法
+func (s *Server) query(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	s.mu.Lock()
+	if s.down {
+		s.mu.Unlock()
+		return nil, driver.ErrBadConn
+	}
+	if onQuery := s.onQuery; onQuery != nil {
+		s.mu.Unlock()
+		return onQuery(ctx, query, args)
+	}
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return NewRows(s.columns, s.rows...), nil
+}
+
+func (s *Server) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	s.mu.Lock()
+	if s.down {
+		s.mu.Unlock()
+		return nil, driver.ErrBadConn
+	}
+	s.execs = append(s.execs, query)
+	if onExec := s.onExec; onExec != nil {
+		s.mu.Unlock()
+		return onExec(ctx, query, args)
+	}
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, 0, len(args))
+	for _, a := range args {
+		values = append(values, a.Value)
+	}
+	return values
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	s, ok := servers.Load(dsn)
+	if !ok {
+		return nil, errors.New("unknown fake server " + dsn)
+	}
+	return &fakeConn{server: s.(*Server)}, nil
+}
+
+type fakeConn struct {
+	server *Server
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.down {
+		return nil, driver.ErrBadConn
+	}
+	c.server.prepares++
+	if c.server.prepErr != nil {
+		return nil, c.server.prepErr
+	}
+	return &fakeStmt{server: c.server, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.server.mu.Lock()
+	if c.server.down {
+		c.server.mu.Unlock()
+		return nil, driver.ErrBadConn
+	}
+	c.server.begins++
+	onBegin := c.server.onBegin
+	c.server.mu.Unlock()
+
+	tx := &fakeTx{server: c.server}
+	if onBegin != nil {
+		tx.commit, tx.rollback = onBegin()
+	}
+	return tx, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.down {
+		return driver.ErrBadConn
+	}
+	return nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.server.exec(ctx, query, namedValues(args))
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.server.query(ctx, query, namedValues(args))
+}
+
+//没有SetBegin时只记录提交和回滚，Exec直接生效
+type fakeTx struct {
+	server   *Server
+	commit   func() error
+	rollback func() error
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.server.mu.Lock()
+	tx.server.commits++
+	tx.server.mu.Unlock()
+	if tx.commit != nil {
+		return tx.commit()
+	}
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.server.mu.Lock()
+	tx.server.rollbacks++
+	tx.server.mu.Unlock()
+	if tx.rollback != nil {
+		return tx.rollback()
+	}
+	return nil
+}
+
+type fakeStmt struct {
+	server *Server
+	query  string
+}
+
+func (s *fakeStmt) Close() error {
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+	s.server.stmtCloses++
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.server.exec(context.Background(), s.query, args)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.queryRows(context.Background(), args)
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.server.exec(ctx, s.query, namedValues(args))
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.queryRows(ctx, namedValues(args))
+}
+
+func (s *fakeStmt) queryRows(ctx context.Context, args []driver.Value) (driver.Rows, error) {
+	s.server.mu.Lock()
+	s.server.stmtQueries++
+	s.server.mu.Unlock()
+	return s.server.query(ctx, s.query, args)
+}
+
+type rows struct {
+	columns []string
+	types   []string
+	rows    [][]driver.Value
+	i       int
+}
+
+//固定结果的driver.Rows
+func NewRows(columns []string, values ...[]driver.Value) driver.Rows {
+	return &rows{columns: columns, rows: values}
+}
+
+//带列类型的driver.Rows，types为数据库的类型名，如BIGINT
+func NewTypedRows(columns []string, types []string, values ...[]driver.Value) driver.Rows {
+	return &rows{columns: columns, types: types, rows: values}
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	if index < len(r.types) {
+		return r.types[index]
+	}
+	return ""
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
@@ -0,0 +1,574 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yybirdcf/golib/database"
+)
+
+//一个版本的迁移
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+//迁移文件名：版本_名称.up.sql、版本_名称.down.sql，如0001_create_users.up.sql
+var fileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+//从目录加载迁移
+func LoadDir(dir string) ([]*Migration, error) {
+	return Load(os.DirFS(dir))
+}
+
+//从fs根目录加载迁移，可配合embed.FS，按版本排序
+func Load(fsys fs.FS) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := fileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %s: %v", entry.Name(), err)
+		}
+		data, err := fs.ReadFile(fsys, path.Clean(entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d has different names %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+//迁移状态
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+//迁移锁，同一时间只有一个进程迁移同一个库，Lock和Unlock在同一个连接上调用
+type Locker interface {
+	Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) error
+	Unlock(ctx context.Context, conn *sql.Conn, name string) error
+}
+
+//mysql的GET_LOCK
+type MySQLLocker struct{}
+
+func (MySQLLocker) Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) error {
+	var ok sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(timeout.Seconds())).Scan(&ok); err != nil {
+		return err
+	}
+	if ok.Int64 != 1 {
+		return fmt.Errorf("migration lock %s is held by another process", name)
+	}
+	return nil
+}
+
+func (MySQLLocker) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+	return err
+}
+
+//postgres的advisory lock，拿不到锁时每秒重试直到超时
+type PostgresLocker struct{}
+
+func (PostgresLocker) Lock(ctx context.Context, conn *sql.Conn, name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var ok bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&ok); err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("migration lock %s is held by another process", name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (PostgresLocker) Unlock(ctx context.Context, conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtext($1))", name)
+	return err
+}
+
+type Config struct {
+	//记录已执行版本的表，默认schema_migrations
+	Table string
+	//锁名，默认golib_migrate
+	LockName string
+	//等待锁的时间，默认1分钟
+	LockTimeout time.Duration
+	//默认MySQLLocker，$1占位符的驱动默认PostgresLocker
+	Locker Locker
+	//只输出要执行的sql，不执行
+	DryRun bool
+	//postgres默认在事务中执行每个版本的sql和记录，失败时整体回滚；
+	//包含CREATE INDEX CONCURRENTLY等不能在事务中执行的语句时设置为true
+	NoTransaction bool
+	//dry-run的sql和执行进度输出，默认os.Stdout
+	Out io.Writer
+}
+
+type Migrator struct {
+	migrations []*Migration
+	cfg        Config
+}
+
+func NewMigrator(migrations []*Migration, cfg *Config) *Migrator {
+	m := &Migrator{
+		migrations: migrations,
+		cfg:        *cfg,
+	}
+	if m.cfg.Table == "" {
+		m.cfg.Table = "schema_migrations"
+	}
+	if m.cfg.LockName == "" {
+		m.cfg.LockName = "golib_migrate"
+	}
+	if m.cfg.LockTimeout <= 0 {
+		m.cfg.LockTimeout = time.Minute
+	}
+	if m.cfg.Out == nil {
+		m.cfg.Out = os.Stdout
+	}
+	return m
+}
+
+//mysql的DDL会隐式提交，只有postgres在事务中执行
+func (m *Migrator) transactional(db *database.MRDB) bool {
+	return db.Placeholder() == database.Dollar && !m.cfg.NoTransaction
+}
+
+func (m *Migrator) locker(db *database.MRDB) Locker {
+	if m.cfg.Locker != nil {
+		return m.cfg.Locker
+	}
+	if db.Placeholder() == database.Dollar {
+		return PostgresLocker{}
+	}
+	return MySQLLocker{}
+}
+
+//已执行的版本，表不存在时返回错误
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT version, applied_at FROM %s", m.cfg.Table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt sql.NullString
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = parseTime(appliedAt.String)
+	}
+	return applied, rows.Err()
+}
+
+//记录表不存在：mysql 1146，postgres 42P01（pq的错误信息不带错误码），sqlite no such table
+func isTableMissing(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "Error 1146") ||
+		strings.Contains(msg, "42P01") ||
+		(strings.Contains(msg, "relation") && strings.Contains(msg, "does not exist")) ||
+		strings.Contains(msg, "no such table")
+}
+
+//mysql没有parseTime时时间列扫描为字符串
+func parseTime(s string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05", time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (m *Migrator) createTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	version BIGINT NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`, m.cfg.Table))
+	return err
+}
+
+//库的迁移状态，包括已执行但本地没有的版本
+func (m *Migrator) Status(ctx context.Context, db *database.MRDB) ([]Status, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied, err := m.applied(ctx, conn)
+	if isTableMissing(err) {
+		//还没有迁移过
+		applied, err = map[int64]time.Time{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := make([]Status, 0, len(m.migrations))
+	known := make(map[int64]bool, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.Version] = true
+		appliedAt, ok := applied[mig.Version]
+		status = append(status, Status{
+			Version:   mig.Version,
+			Name:      mig.Name,
+			Applied:   ok,
+			AppliedAt: appliedAt,
+		})
+	}
+	for version, appliedAt := range applied {
+		if !known[version] {
+			status = append(status, Status{Version: version, Name: "(missing)", Applied: true, AppliedAt: appliedAt})
+		}
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+	return status, nil
+}
+
+//执行到target版本，target为0时执行所有未执行的迁移，返回执行的版本
+func (m *Migrator) Up(ctx context.Context, db *database.MRDB, target int64) ([]int64, error) {
+	var done []int64
+	err := m.withLock(ctx, db, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		for _, mig := range m.migrations {
+			if target > 0 && mig.Version > target {
+				break
+			}
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			insert := database.Rebind(db.Placeholder(), fmt.Sprintf("INSERT INTO %s (version, name) VALUES (?, ?)", m.cfg.Table))
+			if err := m.apply(ctx, conn, m.transactional(db), mig, "up", mig.Up, insert, mig.Version, mig.Name); err != nil {
+				return err
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//回滚最近执行的steps个版本，返回回滚的版本
+func (m *Migrator) Down(ctx context.Context, db *database.MRDB, steps int) ([]int64, error) {
+	var done []int64
+	err := m.withLock(ctx, db, func(conn *sql.Conn, applied map[int64]time.Time) error {
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", mig.Version, mig.Name)
+			}
+
+			del := database.Rebind(db.Placeholder(), fmt.Sprintf("DELETE FROM %s WHERE version = ?", m.cfg.Table))
+			if err := m.apply(ctx, conn, m.transactional(db), mig, "down", mig.Down, del, mig.Version); err != nil {
+				return err
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+//dry-run时不加锁不建表，只读取已执行的版本
+func (m *Migrator) withLock(ctx context.Context, db *database.MRDB, fn func(*sql.Conn, map[int64]time.Time) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.cfg.DryRun {
+		applied, err := m.applied(ctx, conn)
+		if isTableMissing(err) {
+			applied, err = map[int64]time.Time{}, nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(conn, applied)
+	}
+
+	locker := m.locker(db)
+	if err := locker.Lock(ctx, conn, m.cfg.LockName, m.cfg.LockTimeout); err != nil {
+		return err
+	}
+	defer locker.Unlock(context.Background(), conn, m.cfg.LockName)
+
+	if err := m.createTable(ctx, conn); err != nil {
+		return err
+	}
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn, applied)
+}
+
+//*sql.Conn和*sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+//逐条执行迁移的sql，成功后更新记录表；transactional时sql和记录在同一个事务中，失败整体回滚，
+//否则（mysql的DDL不能回滚）失败时需要人工处理已执行的部分
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, transactional bool, mig *Migration, direction string, script string, record string, args ...interface{}) (err error) {
+	fmt.Fprintf(m.cfg.Out, "-- %d_%s %s\n", mig.Version, mig.Name, direction)
+
+	stmts := SplitStatements(script)
+	if m.cfg.DryRun {
+		for _, stmt := range stmts {
+			fmt.Fprintf(m.cfg.Out, "%s;\n", stmt)
+		}
+		return nil
+	}
+
+	var exec execer = conn
+	var tx *sql.Tx
+	if transactional {
+		if tx, err = conn.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+			}
+		}()
+		exec = tx
+	}
+
+	for _, stmt := range stmts {
+		if _, err := exec.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d_%s %s err: %v\n%s", mig.Version, mig.Name, direction, err, stmt)
+		}
+	}
+	if _, err := exec.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	if tx != nil {
+		return tx.Commit()
+	}
+	return nil
+}
+
+//在DBManager的每个库上执行Up，按db name顺序，遇到错误停止
+func (m *Migrator) UpAll(ctx context.Context, manager *database.DBManager, target int64) (map[string][]int64, error) {
+	return m.eachDB(manager, func(name string, db *database.MRDB) ([]int64, error) {
+		fmt.Fprintf(m.cfg.Out, "-- db %s\n", name)
+		return m.Up(ctx, db, target)
+	})
+}
+
+//在DBManager的每个库上执行Down
+func (m *Migrator) DownAll(ctx context.Context, manager *database.DBManager, steps int) (map[string][]int64, error) {
+	return m.eachDB(manager, func(name string, db *database.MRDB) ([]int64, error) {
+		fmt.Fprintf(m.cfg.Out, "-- db %s\n", name)
+		return m.Down(ctx, db, steps)
+	})
+}
+
+//DBManager每个库的迁移状态，db name + 状态
+func (m *Migrator) StatusAll(ctx context.Context, manager *database.DBManager) (map[string][]Status, error) {
+	result := make(map[string][]Status)
+	dbs := manager.DBs()
+	for _, name := range dbNames(dbs) {
+		status, err := m.Status(ctx, dbs[name].MRDB())
+		if err != nil {
+			return result, fmt.Errorf("%s %v", name, err)
+		}
+		result[name] = status
+	}
+	return result, nil
+}
+
+func (m *Migrator) eachDB(manager *database.DBManager, fn func(string, *database.MRDB) ([]int64, error)) (map[string][]int64, error) {
+	result := make(map[string][]int64)
+	dbs := manager.DBs()
+	for _, name := range dbNames(dbs) {
+		done, err := fn(name, dbs[name].MRDB())
+		result[name] = done
+		if err != nil {
+			return result, fmt.Errorf("%s %v", name, err)
+		}
+	}
+	return result, nil
+}
+
+func dbNames(dbs map[string]*database.DB) []string {
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//postgres的$$、$tag$引用
+var dollarQuoteRegexp = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+//按分号拆分sql，跳过引号、注释和postgres $$函数体中的分号，去掉空语句和注释
+//mysql的/*! */版本注释和/*+ */优化器提示会被执行，原样保留
+//支持mysql客户端的DELIMITER，如DELIMITER //切换分隔符，用于存储过程和触发器
+func SplitStatements(script string) []string {
+	var stmts []string
+	var b strings.Builder
+	var quote byte
+	delimiter := ";"
+
+	flush := func() {
+		if stmt := strings.TrimSpace(b.String()); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		b.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' && i+1 < len(script) {
+				b.WriteByte(c)
+				i++
+				c = script[i]
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			//行注释
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			i += end - 1
+			continue
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				end = len(script) - i - 2
+			}
+			if strings.HasPrefix(script[i:], "/*!") || strings.HasPrefix(script[i:], "/*+") {
+				stop := i + end + 4
+				if stop > len(script) {
+					stop = len(script)
+				}
+				b.WriteString(script[i:stop])
+			}
+			i += end + 3
+			continue
+		case c == '$' && (i == 0 || !isIdentByte(script[i-1])) && dollarQuoteRegexp.MatchString(script[i:]):
+			//函数体原样保留到结束标记
+			tag := dollarQuoteRegexp.FindString(script[i:])
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				end = len(script) - i - len(tag)
+			} else {
+				end += len(tag)
+			}
+			b.WriteString(script[i : i+len(tag)+end])
+			i += len(tag) + end - 1
+			continue
+		case (c == 'D' || c == 'd') && strings.TrimSpace(b.String()) == "" && hasDelimiterPrefix(script[i:]):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			if d := strings.TrimSpace(script[i+len("DELIMITER") : i+end]); d != "" {
+				delimiter = d
+			}
+			b.Reset()
+			i += end - 1
+			continue
+		case strings.HasPrefix(script[i:], delimiter):
+			flush()
+			i += len(delimiter) - 1
+			continue
+		}
+		b.WriteByte(c)
+	}
+	flush()
+	return stmts
+}
+
+func hasDelimiterPrefix(s string) bool {
+	const keyword = "DELIMITER"
+	return len(s) > len(keyword) && strings.EqualFold(s[:len(keyword)], keyword) && (s[len(keyword)] == ' ' || s[len(keyword)] == '\t')
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
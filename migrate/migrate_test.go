@@ -0,0 +1,464 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/yybirdcf/golib/database"
+	"github.com/yybirdcf/golib/internal/fakedb"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{
+			"simple",
+			"CREATE TABLE a (id INT);\nCREATE TABLE b (id INT);",
+			[]string{"CREATE TABLE a (id INT)", "CREATE TABLE b (id INT)"},
+		},
+		{
+			"empty statements",
+			";;\n  ;SELECT 1;;",
+			[]string{"SELECT 1"},
+		},
+		{
+			"no trailing semicolon",
+			"SELECT 1;\nSELECT 2",
+			[]string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			"quotes",
+			"INSERT INTO a VALUES ('x;y', \"z;\", `c;`);SELECT 'it\\'s;'",
+			[]string{"INSERT INTO a VALUES ('x;y', \"z;\", `c;`)", "SELECT 'it\\'s;'"},
+		},
+		{
+			"comments",
+			"-- drop; table\nSELECT 1; /* a; b */ SELECT 2;",
+			[]string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			"postgres dollar quote",
+			"CREATE FUNCTION f() RETURNS trigger AS $$\nBEGIN\n  NEW.a := 1;\n  RETURN NEW;\nEND;\n$$ LANGUAGE plpgsql;\nSELECT 1;",
+			[]string{"CREATE FUNCTION f() RETURNS trigger AS $$\nBEGIN\n  NEW.a := 1;\n  RETURN NEW;\nEND;\n$$ LANGUAGE plpgsql", "SELECT 1"},
+		},
+		{
+			"postgres tagged dollar quote",
+			"DO $body$ BEGIN PERFORM 1; END $body$;SELECT $1",
+			[]string{"DO $body$ BEGIN PERFORM 1; END $body$", "SELECT $1"},
+		},
+		{
+			"mysql delimiter",
+			"DELIMITER //\nCREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\n  SELECT 2;\nEND //\nDELIMITER ;\nSELECT 3;",
+			[]string{"CREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\n  SELECT 2;\nEND", "SELECT 3"},
+		},
+		{
+			"mysql versioned comments and hints",
+			"/*!40101 SET NAMES utf8mb4 */;\nSELECT /*+ MAX_EXECUTION_TIME(1000) */ 1; /* plain; */ SELECT 2 /*!80000 ; */;",
+			[]string{"/*!40101 SET NAMES utf8mb4 */", "SELECT /*+ MAX_EXECUTION_TIME(1000) */ 1", "SELECT 2 /*!80000 ; */"},
+		},
+		{
+			"delimiter keyword inside statement",
+			"UPDATE a SET delimiter = 1;",
+			[]string{"UPDATE a SET delimiter = 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SplitStatements(tt.script)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("SplitStatements() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTableMissing(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("Error 1146: Table 'db.schema_migrations' doesn't exist"), true},
+		{errors.New(`pq: relation "schema_migrations" does not exist`), true},
+		{errors.New(`ERROR: relation "schema_migrations" does not exist (SQLSTATE 42P01)`), true},
+		{errors.New("no such table: schema_migrations"), true},
+		{errors.New("Error 1045: Access denied for user"), false},
+		{errors.New("driver: bad connection"), false},
+	}
+	for _, tt := range tests {
+		if got := isTableMissing(tt.err); got != tt.want {
+			t.Fatalf("isTableMissing(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_email.up.sql":      {Data: []byte("ALTER TABLE users ADD email VARCHAR(255);")},
+		"0001_create_users.up.sql":   {Data: []byte("CREATE TABLE users (id INT);")},
+		"0001_create_users.down.sql": {Data: []byte("DROP TABLE users;")},
+		"README.md":                  {Data: []byte("migrations")},
+		"old/0003_ignored.up.sql":    {Data: []byte("SELECT 1;")},
+		"0004_no_direction.sql":      {Data: []byte("SELECT 1;")},
+	}
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Migration{
+		{Version: 1, Name: "create_users", Up: "CREATE TABLE users (id INT);", Down: "DROP TABLE users;"},
+		{Version: 2, Name: "add_email", Up: "ALTER TABLE users ADD email VARCHAR(255);"},
+	}
+	if !reflect.DeepEqual(migrations, want) {
+		t.Fatalf("Load() = %+v, want %+v", migrations, want)
+	}
+
+	for name, fsys := range map[string]fstest.MapFS{
+		"no up file":      {"0001_a.down.sql": {Data: []byte("SELECT 1;")}},
+		"different names": {"0001_a.up.sql": {Data: []byte("SELECT 1;")}, "0001_b.down.sql": {Data: []byte("SELECT 1;")}},
+	} {
+		if _, err := Load(fsys); err == nil {
+			t.Errorf("%s: Load() should fail", name)
+		}
+	}
+}
+
+//fakedb上的schema_migrations表和GET_LOCK
+type fakeSchema struct {
+	mu      sync.Mutex
+	created bool
+	applied map[int64]string
+	//GET_LOCK返回0
+	lockHeld bool
+	unlocks  int
+}
+
+func newTestMigrateDB(t *testing.T, name string, applied map[int64]string) (*database.MRDB, *fakedb.Server, *fakeSchema) {
+	dsn, s := fakedb.NewServer(t, name)
+	schema := &fakeSchema{applied: applied, created: applied != nil}
+	if schema.applied == nil {
+		schema.applied = make(map[int64]string)
+	}
+	s.SetHandlers(schema.query, schema.exec)
+	s.SetBegin(schema.begin)
+
+	db, err := database.NewMRDB(&database.MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, s, schema
+}
+
+func (f *fakeSchema) versions() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var versions []int64
+	for v := range f.applied {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return versions
+}
+
+func (f *fakeSchema) query(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "SELECT GET_LOCK("):
+		ok := int64(1)
+		if f.lockHeld {
+			ok = 0
+		}
+		return fakedb.NewRows([]string{"ok"}, []driver.Value{ok}), nil
+	case strings.HasPrefix(query, "SELECT version, applied_at FROM schema_migrations"):
+		if !f.created {
+			return nil, errors.New("Error 1146: Table 'db.schema_migrations' doesn't exist")
+		}
+		var rows [][]driver.Value
+		for v := range f.applied {
+			rows = append(rows, []driver.Value{v, []byte("2024-01-02 03:04:05")})
+		}
+		return fakedb.NewRows([]string{"version", "applied_at"}, rows...), nil
+	}
+	return nil, errors.New("unexpected query: " + query)
+}
+
+func (f *fakeSchema) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS schema_migrations"):
+		f.created = true
+	case strings.HasPrefix(query, "INSERT INTO schema_migrations"):
+		f.applied[args[0].(int64)] = args[1].(string)
+	case strings.HasPrefix(query, "DELETE FROM schema_migrations"):
+		delete(f.applied, args[0].(int64))
+	case strings.HasPrefix(query, "SELECT RELEASE_LOCK("):
+		f.unlocks++
+	case strings.Contains(query, "FAIL"):
+		return nil, errors.New("syntax error")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+//回滚时恢复记录表
+func (f *fakeSchema) begin() (func() error, func() error) {
+	f.mu.Lock()
+	snapshot := make(map[int64]string, len(f.applied))
+	for v, name := range f.applied {
+		snapshot[v] = name
+	}
+	f.mu.Unlock()
+
+	rollback := func() error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.applied = snapshot
+		return nil
+	}
+	return func() error { return nil }, rollback
+}
+
+func testMigrations() []*Migration {
+	return []*Migration{
+		{Version: 1, Name: "a", Up: "CREATE TABLE a (id INT);", Down: "DROP TABLE a;"},
+		{Version: 2, Name: "b", Up: "CREATE TABLE b (id INT);\nCREATE INDEX ib ON b (id);", Down: "DROP TABLE b;"},
+		{Version: 3, Name: "c", Up: "CREATE TABLE c (id INT);", Down: "DROP TABLE c;"},
+	}
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	db, s, schema := newTestMigrateDB(t, "db0", nil)
+	var out bytes.Buffer
+	m := NewMigrator(testMigrations(), &Config{Out: &out})
+	ctx := context.Background()
+
+	//建表后执行到版本2
+	done, err := m.Up(ctx, db, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(done, []int64{1, 2}) || !reflect.DeepEqual(schema.versions(), []int64{1, 2}) {
+		t.Fatalf("Up(2) = %v, applied %v", done, schema.versions())
+	}
+	want := []string{
+		"CREATE TABLE IF NOT EXISTS schema_migrations",
+		"CREATE TABLE a (id INT)",
+		"INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+		"CREATE TABLE b (id INT)",
+		"CREATE INDEX ib ON b (id)",
+		"INSERT INTO schema_migrations (version, name) VALUES (?, ?)",
+		"SELECT RELEASE_LOCK(?)",
+	}
+	if got := s.ExecLog(); len(got) != len(want) || !strings.HasPrefix(got[0], want[0]) || !reflect.DeepEqual(got[1:], want[1:]) {
+		t.Fatalf("execs = %q", got)
+	}
+	//mysql不在事务中执行
+	if b, _, _ := s.TxCounts(); b != 0 {
+		t.Fatalf("begins = %d", b)
+	}
+
+	//已执行的版本跳过
+	if done, err = m.Up(ctx, db, 0); err != nil || !reflect.DeepEqual(done, []int64{3}) {
+		t.Fatalf("Up(0) = %v, %v", done, err)
+	}
+
+	//从最新的版本回滚
+	if done, err = m.Down(ctx, db, 2); err != nil || !reflect.DeepEqual(done, []int64{3, 2}) {
+		t.Fatalf("Down(2) = %v, %v", done, err)
+	}
+	if got := schema.versions(); !reflect.DeepEqual(got, []int64{1}) {
+		t.Fatalf("applied after down = %v", got)
+	}
+	if schema.unlocks != 3 {
+		t.Fatalf("unlocks = %d, want 3", schema.unlocks)
+	}
+
+	//没有down文件
+	m = NewMigrator([]*Migration{{Version: 1, Name: "a", Up: "SELECT 1;"}}, &Config{Out: &out})
+	if _, err := m.Down(ctx, db, 1); err == nil || !strings.Contains(err.Error(), "no down file") {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestMigratorFailure(t *testing.T) {
+	db, _, schema := newTestMigrateDB(t, "db0", nil)
+	migrations := testMigrations()
+	migrations[1].Up = "CREATE TABLE b (id INT);\nFAIL;"
+	m := NewMigrator(migrations, &Config{Out: io.Discard})
+
+	//失败的版本不记录，之前的版本保留
+	done, err := m.Up(context.Background(), db, 0)
+	if err == nil || !strings.Contains(err.Error(), "migration 2_b up err") || !reflect.DeepEqual(done, []int64{1}) {
+		t.Fatalf("Up() = %v, %v", done, err)
+	}
+	if got := schema.versions(); !reflect.DeepEqual(got, []int64{1}) {
+		t.Fatalf("applied = %v", got)
+	}
+}
+
+func TestMigratorApplyTransactional(t *testing.T) {
+	db, s, schema := newTestMigrateDB(t, "db0", map[int64]string{})
+	m := NewMigrator(nil, &Config{Out: io.Discard})
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	//postgres的迁移和记录在同一个事务中
+	insert := "INSERT INTO schema_migrations (version, name) VALUES (?, ?)"
+	mig := &Migration{Version: 1, Name: "a", Up: "CREATE TABLE a (id INT);"}
+	if err := m.apply(ctx, conn, true, mig, "up", mig.Up, insert, int64(1), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if b, c, r := s.TxCounts(); b != 1 || c != 1 || r != 0 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+
+	//失败时整体回滚，不留下记录
+	mig = &Migration{Version: 2, Name: "b", Up: "CREATE TABLE b (id INT);\nFAIL;"}
+	if err := m.apply(ctx, conn, true, mig, "up", mig.Up, insert, int64(2), "b"); err == nil {
+		t.Fatal("apply() should fail")
+	}
+	if b, c, r := s.TxCounts(); b != 2 || c != 1 || r != 1 {
+		t.Fatalf("begins %d commits %d rollbacks %d", b, c, r)
+	}
+	if got := schema.versions(); !reflect.DeepEqual(got, []int64{1}) {
+		t.Fatalf("applied = %v", got)
+	}
+}
+
+func TestMigratorLockHeld(t *testing.T) {
+	db, s, schema := newTestMigrateDB(t, "db0", nil)
+	schema.lockHeld = true
+	m := NewMigrator(testMigrations(), &Config{Out: io.Discard})
+
+	done, err := m.Up(context.Background(), db, 0)
+	if err == nil || !strings.Contains(err.Error(), "held by another process") || len(done) != 0 {
+		t.Fatalf("Up() = %v, %v", done, err)
+	}
+	//拿不到锁时不建表、不释放锁
+	if got := s.ExecLog(); len(got) != 0 {
+		t.Fatalf("execs = %q", got)
+	}
+}
+
+func TestMigratorDryRun(t *testing.T) {
+	db, s, _ := newTestMigrateDB(t, "db0", map[int64]string{1: "a"})
+	var out bytes.Buffer
+	m := NewMigrator(testMigrations(), &Config{DryRun: true, Out: &out})
+
+	done, err := m.Up(context.Background(), db, 0)
+	if err != nil || !reflect.DeepEqual(done, []int64{2, 3}) {
+		t.Fatalf("Up() = %v, %v", done, err)
+	}
+	want := "-- 2_b up\nCREATE TABLE b (id INT);\nCREATE INDEX ib ON b (id);\n-- 3_c up\nCREATE TABLE c (id INT);\n"
+	if out.String() != want {
+		t.Fatalf("output = %q, want %q", out.String(), want)
+	}
+	//dry-run不加锁、不执行
+	if got := s.ExecLog(); len(got) != 0 {
+		t.Fatalf("execs = %q", got)
+	}
+
+	//记录表不存在时按都未执行
+	db, _, _ = newTestMigrateDB(t, "db1", nil)
+	out.Reset()
+	if done, err = m.Down(context.Background(), db, 1); err != nil || len(done) != 0 {
+		t.Fatalf("Down() = %v, %v", done, err)
+	}
+}
+
+func TestMigratorStatus(t *testing.T) {
+	db, _, _ := newTestMigrateDB(t, "db0", map[int64]string{1: "a", 9: "removed"})
+	m := NewMigrator(testMigrations(), &Config{Out: io.Discard})
+
+	status, err := m.Status(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, st := range status {
+		got = append(got, fmt.Sprintf("%d %s %v", st.Version, st.Name, st.Applied))
+	}
+	want := []string{"1 a true", "2 b false", "3 c false", "9 (missing) true"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("status = %v, want %v", got, want)
+	}
+	if status[0].AppliedAt != time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) {
+		t.Fatalf("applied at = %v", status[0].AppliedAt)
+	}
+
+	//还没有迁移过
+	db, _, _ = newTestMigrateDB(t, "db1", nil)
+	if status, err = m.Status(context.Background(), db); err != nil || len(status) != 3 || status[0].Applied {
+		t.Fatalf("Status() = %+v, %v", status, err)
+	}
+}
+
+func TestMigratorAll(t *testing.T) {
+	manager := database.NewDBManager()
+	schemas := make(map[string]*fakeSchema)
+	for _, name := range []string{"db1", "db0", "db2"} {
+		dsn, s := fakedb.NewServer(t, name)
+		schema := &fakeSchema{applied: make(map[int64]string)}
+		s.SetHandlers(schema.query, schema.exec)
+		schemas[name] = schema
+		if err := manager.AddDB(name, &database.MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, db := range manager.DBs() {
+			db.MRDB().Close()
+		}
+	})
+	//db2拿不到锁
+	schemas["db2"].lockHeld = true
+
+	var out bytes.Buffer
+	m := NewMigrator(testMigrations(), &Config{Out: &out})
+	done, err := m.UpAll(context.Background(), manager, 0)
+	if err == nil || !strings.HasPrefix(err.Error(), "db2 ") {
+		t.Fatalf("err = %v", err)
+	}
+	want := map[string][]int64{"db0": {1, 2, 3}, "db1": {1, 2, 3}, "db2": nil}
+	if !reflect.DeepEqual(done, want) {
+		t.Fatalf("UpAll() = %v, want %v", done, want)
+	}
+	//按db name顺序
+	if i0, i1, i2 := strings.Index(out.String(), "-- db db0"), strings.Index(out.String(), "-- db db1"), strings.Index(out.String(), "-- db db2"); !(i0 >= 0 && i0 < i1 && i1 < i2) {
+		t.Fatalf("output = %q", out.String())
+	}
+
+	schemas["db2"].lockHeld = false
+	done, err = m.DownAll(context.Background(), manager, 1)
+	want = map[string][]int64{"db0": {3}, "db1": {3}, "db2": nil}
+	if err != nil || !reflect.DeepEqual(done, want) {
+		t.Fatalf("DownAll() = %v, %v", done, err)
+	}
+
+	status, err := m.StatusAll(context.Background(), manager)
+	if err != nil || len(status) != 3 || !status["db0"][1].Applied || status["db0"][2].Applied || status["db2"][0].Applied {
+		t.Fatalf("StatusAll() = %+v, %v", status, err)
+	}
+}
@@ -0,0 +1,215 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+	"github.com/yybirdcf/golib/database"
+	"github.com/yybirdcf/golib/queue"
+	"github.com/yybirdcf/golib/wait"
+)
+
+// CreateTableSQL outbox表结构，%s为表名
+// outbox只支持mysql：语句使用?占位符，认领事件使用mysql的UPDATE ... ORDER BY ... LIMIT
+const CreateTableSQL = `CREATE TABLE IF NOT EXISTS %s (
+	id VARCHAR(32) NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	value MEDIUMTEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	sent_at BIGINT NULL,
+	claim_id VARCHAR(32) NULL,
+	claimed_until BIGINT NULL,
+	KEY idx_sent_at_created_at (sent_at, created_at),
+	KEY idx_claim_id (claim_id)
+)`
+
+type Config struct {
+	// outbox表名，默认outbox
+	Table string
+	// 每次relay最多发送的条数，默认100
+	BatchSize int
+	// relay周期，默认1秒
+	Interval time.Duration
+	// relay认领一批事件的时长，超时未发送的事件可以被其他relay重新认领，默认1分钟
+	ClaimTimeout time.Duration
+}
+
+// Outbox 事务性发件箱
+// 业务写库和事件写outbox表在同一个事务里提交，relay再把事件投递到队列并标记已发送
+// 投递语义为at-least-once，消息以queue.Message信封发送，ID可用于消费端去重
+// relay先在短事务里认领一批事件再发送，发送期间不持有行锁；多个进程relay同一张表时各自认领不同批次，批次之间不保证顺序
+// 只支持mysql，见CreateTableSQL
+type Outbox struct {
+	db    *database.MRDB
+	q     queue.Queue
+	table string
+	batch int
+	tick  time.Duration
+	claim time.Duration
+
+	relaying int32
+}
+
+func NewOutbox(db *database.MRDB, q queue.Queue, cfg *Config) *Outbox {
+	o := &Outbox{
+		db:    db,
+		q:     q,
+		table: "outbox",
+		batch: 100,
+		tick:  time.Second,
+		claim: time.Minute,
+	}
+
+	if cfg != nil {
+		if cfg.Table != "" {
+			o.table = cfg.Table
+		}
+		if cfg.BatchSize > 0 {
+			o.batch = cfg.BatchSize
+		}
+		if cfg.Interval > 0 {
+			o.tick = cfg.Interval
+		}
+		if cfg.ClaimTimeout > 0 {
+			o.claim = cfg.ClaimTimeout
+		}
+	}
+
+	return o
+}
+
+// NewShardOutboxes 为DBManager中的每个库创建outbox，key为db name
+// 配合DBManager.GetDB使用：按分片拿到db后，用db.Name()找到对应的outbox
+func NewShardOutboxes(manager *database.DBManager, q queue.Queue, cfg *Config) map[string]*Outbox {
+	outboxes := make(map[string]*Outbox)
+	for name, db := range manager.DBs() {
+		outboxes[name] = NewOutbox(db.MRDB(), q, cfg)
+	}
+	return outboxes
+}
+
+// Publish 在tx中写入一条待发送事件，返回消息ID
+// tx需来自同一个库的MRDB.Begin
+func (o *Outbox) Publish(tx *sql.Tx, name string, value string) (string, error) {
+	return o.PublishContext(context.Background(), tx, name, value)
+}
+
+func (o *Outbox) PublishContext(ctx context.Context, tx *sql.Tx, name string, value string) (string, error) {
+	id := queue.NewMessageID()
+	query := fmt.Sprintf("INSERT INTO %s (id, name, value, created_at) VALUES (?, ?, ?, ?)", o.table)
+	if _, err := tx.ExecContext(ctx, query, id, name, value, time.Now().UnixNano()); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Run 周期性relay，直到stopCh关闭
+func (o *Outbox) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if _, err := o.Relay(context.Background()); err != nil {
+			clog.Errorf("outbox %s relay err: %v", o.table, err)
+		}
+	}, o.tick, stopCh)
+}
+
+type event struct {
+	id    string
+	name  string
+	value string
+}
+
+// Relay 发送一批未发送的事件，返回发送成功的条数
+// 同一个Outbox上的relay不会并发执行
+func (o *Outbox) Relay(ctx context.Context) (int, error) {
+	if !atomic.CompareAndSwapInt32(&o.relaying, 0, 1) {
+		return 0, nil
+	}
+	defer atomic.StoreInt32(&o.relaying, 0)
+
+	claimID := queue.NewMessageID()
+	events, err := o.claimEvents(ctx, claimID)
+	if err != nil {
+		return 0, err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET sent_at = ? WHERE id = ? AND claim_id = ?", o.table)
+	sent := 0
+	for _, e := range events {
+		msg := &queue.Message{
+			ID:   e.id,
+			Body: e.value,
+		}
+		// 发送失败的事件保留到下一轮，保证顺序不乱
+		if err := o.q.Push(e.name, msg.Encode()); err != nil {
+			clog.Errorf("outbox %s push %s err: %v", o.table, e.id, err)
+			break
+		}
+		if _, err := o.db.ExecContext(ctx, update, time.Now().UnixNano(), e.id, claimID); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	if sent < len(events) {
+		// 释放没发出去的认领，下一轮不用等认领超时
+		release := fmt.Sprintf("UPDATE %s SET claim_id = NULL, claimed_until = NULL WHERE claim_id = ? AND sent_at IS NULL", o.table)
+		if _, err := o.db.ExecContext(ctx, release, claimID); err != nil {
+			clog.Errorf("outbox %s release claim err: %v", o.table, err)
+		}
+	}
+	return sent, nil
+}
+
+// claimEvents 在主库短事务里认领一批未发送且未被认领（或认领已超时）的事件并读出
+func (o *Outbox) claimEvents(ctx context.Context, claimID string) ([]*event, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixNano()
+	claim := fmt.Sprintf("UPDATE %s SET claim_id = ?, claimed_until = ? WHERE sent_at IS NULL AND (claimed_until IS NULL OR claimed_until < ?) ORDER BY created_at LIMIT %d", o.table, o.batch)
+	if _, err := tx.ExecContext(ctx, claim, claimID, now+int64(o.claim), now); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("SELECT id, name, value FROM %s WHERE claim_id = ? AND sent_at IS NULL ORDER BY created_at", o.table)
+	rows, err := tx.QueryContext(ctx, query, claimID)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*event, 0, o.batch)
+	for rows.Next() {
+		e := &event{}
+		if err := rows.Scan(&e.id, &e.name, &e.value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Purge 删除before之前已发送的事件
+func (o *Outbox) Purge(ctx context.Context, before time.Time) (int64, error) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE sent_at IS NOT NULL AND sent_at < ?", o.table)
+	res, err := o.db.ExecContext(ctx, query, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
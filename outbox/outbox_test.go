@@ -0,0 +1,375 @@
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/database"
+	"github.com/yybirdcf/golib/internal/fakedb"
+	"github.com/yybirdcf/golib/queue"
+)
+
+//内存里的outbox表，只认识Outbox发出的几条语句
+type fakeRow struct {
+	id           string
+	name         string
+	value        string
+	createdAt    int64
+	sentAt       int64 //0表示未发送
+	claimID      string
+	claimedUntil int64
+}
+
+type fakeTable struct {
+	mu   sync.Mutex
+	rows []*fakeRow
+	//未提交的事务数
+	inTx int
+}
+
+func newTestOutbox(t *testing.T, q queue.Queue, cfg *Config) (*Outbox, *fakeTable) {
+	dsn, server := fakedb.NewServer(t, "outbox")
+	table := &fakeTable{}
+	server.SetHandlers(table.query, table.exec)
+	server.SetBegin(table.begin)
+
+	db, err := database.NewMRDB(&database.MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewOutbox(db, q, cfg), table
+}
+
+func (t *fakeTable) add(rows ...*fakeRow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rows = append(t.rows, rows...)
+}
+
+func (t *fakeTable) snapshot() []fakeRow {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rows := make([]fakeRow, 0, len(t.rows))
+	for _, r := range t.rows {
+		rows = append(rows, *r)
+	}
+	return rows
+}
+
+func (t *fakeTable) openTx() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inTx
+}
+
+//事务开始时保存表内容，回滚时恢复
+func (t *fakeTable) begin() (func() error, func() error) {
+	saved := t.snapshot()
+	t.mu.Lock()
+	t.inTx++
+	t.mu.Unlock()
+
+	commit := func() error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.inTx--
+		return nil
+	}
+	rollback := func() error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.inTx--
+		t.rows = t.rows[:0]
+		for i := range saved {
+			r := saved[i]
+			t.rows = append(t.rows, &r)
+		}
+		return nil
+	}
+	return commit, rollback
+}
+
+func (t *fakeTable) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	arg := func(i int) driver.Value { return args[i] }
+	var n int64
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO outbox "):
+		t.rows = append(t.rows, &fakeRow{
+			id:        arg(0).(string),
+			name:      arg(1).(string),
+			value:     arg(2).(string),
+			createdAt: arg(3).(int64),
+		})
+		n = 1
+	case strings.HasPrefix(query, "UPDATE outbox SET claim_id = ?, claimed_until = ? "):
+		limit, _ := strconv.Atoi(query[strings.LastIndex(query, " ")+1:])
+		rows := append([]*fakeRow(nil), t.rows...)
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].createdAt < rows[j].createdAt })
+		for _, r := range rows {
+			if n == int64(limit) {
+				break
+			}
+			if r.sentAt == 0 && (r.claimedUntil == 0 || r.claimedUntil < arg(2).(int64)) {
+				r.claimID, r.claimedUntil = arg(0).(string), arg(1).(int64)
+				n++
+			}
+		}
+	case strings.HasPrefix(query, "UPDATE outbox SET sent_at = ? WHERE id = ? AND claim_id = ?"):
+		for _, r := range t.rows {
+			if r.id == arg(1) && r.claimID == arg(2) {
+				r.sentAt = arg(0).(int64)
+				n++
+			}
+		}
+	case strings.HasPrefix(query, "UPDATE outbox SET claim_id = NULL, claimed_until = NULL WHERE claim_id = ? AND sent_at IS NULL"):
+		for _, r := range t.rows {
+			if r.claimID == arg(0) && r.sentAt == 0 {
+				r.claimID, r.claimedUntil = "", 0
+				n++
+			}
+		}
+	case strings.HasPrefix(query, "DELETE FROM outbox WHERE sent_at IS NOT NULL AND sent_at < ?"):
+		kept := t.rows[:0]
+		for _, r := range t.rows {
+			if r.sentAt != 0 && r.sentAt < arg(0).(int64) {
+				n++
+				continue
+			}
+			kept = append(kept, r)
+		}
+		t.rows = kept
+	default:
+		return nil, errors.New("unexpected exec: " + query)
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (t *fakeTable) query(ctx context.Context, query string, args []driver.Value) (driver.Rows, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !strings.HasPrefix(query, "SELECT id, name, value FROM outbox WHERE claim_id = ? AND sent_at IS NULL ORDER BY created_at") {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	var matched []*fakeRow
+	for _, r := range t.rows {
+		if r.claimID == args[0] && r.sentAt == 0 {
+			matched = append(matched, r)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].createdAt < matched[j].createdAt })
+
+	rows := make([][]driver.Value, 0, len(matched))
+	for _, r := range matched {
+		rows = append(rows, []driver.Value{r.id, r.name, r.value})
+	}
+	return fakedb.NewRows([]string{"id", "name", "value"}, rows...), nil
+}
+
+//记录Push的队列，fail返回非nil时Push失败
+type recordQueue struct {
+	mu     sync.Mutex
+	pushed []string
+	fail   func(name string, value string) error
+}
+
+func (q *recordQueue) Push(name string, value string) error {
+	if q.fail != nil {
+		if err := q.fail(name, value); err != nil {
+			return err
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pushed = append(q.pushed, name+":"+value)
+	return nil
+}
+
+func (q *recordQueue) Run()   {}
+func (q *recordQueue) Close() {}
+
+func (q *recordQueue) messages() []*queue.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	msgs := make([]*queue.Message, 0, len(q.pushed))
+	for _, p := range q.pushed {
+		msgs = append(msgs, queue.DecodeMessage(p[strings.Index(p, ":")+1:]))
+	}
+	return msgs
+}
+
+func publish(t *testing.T, o *Outbox, name string, values ...string) []string {
+	tx, err := o.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, 0, len(values))
+	for _, v := range values {
+		id, err := o.Publish(tx, name, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestPublish(t *testing.T) {
+	o, table := newTestOutbox(t, &recordQueue{}, nil)
+
+	ids := publish(t, o, "orders", "a", "b")
+	rows := table.snapshot()
+	if len(rows) != 2 || rows[0].id != ids[0] || rows[1].value != "b" || rows[0].sentAt != 0 {
+		t.Fatalf("rows = %+v", rows)
+	}
+	if len(ids[0]) != 32 || ids[0] == ids[1] {
+		t.Fatalf("ids = %v", ids)
+	}
+
+	//事务回滚时事件一起回滚
+	tx, err := o.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Publish(tx, "orders", "c"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if n := len(table.snapshot()); n != 2 {
+		t.Fatalf("rows after rollback = %d, want 2", n)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	q := &recordQueue{}
+	o, table := newTestOutbox(t, q, &Config{BatchSize: 2})
+	q.fail = func(string, string) error {
+		//发送时不能持有outbox表上的事务
+		if n := table.openTx(); n != 0 {
+			t.Errorf("push with %d open transactions", n)
+		}
+		return nil
+	}
+
+	ids := publish(t, o, "orders", "a", "b", "c")
+
+	sent, err := o.Relay(context.Background())
+	if err != nil || sent != 2 {
+		t.Fatalf("Relay() = %d, %v, want 2", sent, err)
+	}
+	sent, err = o.Relay(context.Background())
+	if err != nil || sent != 1 {
+		t.Fatalf("Relay() = %d, %v, want 1", sent, err)
+	}
+	if sent, _ := o.Relay(context.Background()); sent != 0 {
+		t.Fatalf("Relay() with nothing pending = %d", sent)
+	}
+
+	//消息信封的ID就是Publish返回的ID，消费端用它去重
+	var gotIDs, gotBodies []string
+	for _, m := range q.messages() {
+		gotIDs = append(gotIDs, m.ID)
+		gotBodies = append(gotBodies, m.Body)
+	}
+	if !reflect.DeepEqual(gotIDs, ids) || !reflect.DeepEqual(gotBodies, []string{"a", "b", "c"}) {
+		t.Fatalf("pushed ids %v bodies %v, want %v", gotIDs, gotBodies, ids)
+	}
+	for _, r := range table.snapshot() {
+		if r.sentAt == 0 {
+			t.Fatalf("row %s not marked sent", r.id)
+		}
+	}
+}
+
+func TestRelayPushFailure(t *testing.T) {
+	q := &recordQueue{}
+	o, table := newTestOutbox(t, q, nil)
+	publish(t, o, "orders", "a", "b", "c")
+
+	q.fail = func(name string, value string) error {
+		if queue.DecodeMessage(value).Body == "b" {
+			return errors.New("broker down")
+		}
+		return nil
+	}
+	sent, err := o.Relay(context.Background())
+	if err != nil || sent != 1 {
+		t.Fatalf("Relay() = %d, %v, want 1", sent, err)
+	}
+	//没发出去的事件释放认领，下一轮立即可以重新发送
+	for _, r := range table.snapshot() {
+		if r.sentAt == 0 && r.claimID != "" {
+			t.Fatalf("row %s still claimed", r.value)
+		}
+	}
+
+	q.fail = nil
+	if sent, err := o.Relay(context.Background()); err != nil || sent != 2 {
+		t.Fatalf("Relay() = %d, %v, want 2", sent, err)
+	}
+	var bodies []string
+	for _, m := range q.messages() {
+		bodies = append(bodies, m.Body)
+	}
+	if !reflect.DeepEqual(bodies, []string{"a", "b", "c"}) {
+		t.Fatalf("pushed %v", bodies)
+	}
+}
+
+func TestRelaySkipsClaimed(t *testing.T) {
+	q := &recordQueue{}
+	o, table := newTestOutbox(t, q, nil)
+
+	now := time.Now().UnixNano()
+	table.add(
+		&fakeRow{id: "1", name: "orders", value: "claimed", createdAt: 1, claimID: "other", claimedUntil: now + int64(time.Hour)},
+		&fakeRow{id: "2", name: "orders", value: "expired", createdAt: 2, claimID: "crashed", claimedUntil: now - int64(time.Second)},
+		&fakeRow{id: "3", name: "orders", value: "sent", createdAt: 3, sentAt: now},
+	)
+
+	sent, err := o.Relay(context.Background())
+	if err != nil || sent != 1 {
+		t.Fatalf("Relay() = %d, %v, want 1", sent, err)
+	}
+	if msgs := q.messages(); len(msgs) != 1 || msgs[0].ID != "2" {
+		t.Fatalf("pushed %+v, want only the expired claim", msgs)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	o, table := newTestOutbox(t, &recordQueue{}, nil)
+
+	before := time.Now()
+	table.add(
+		&fakeRow{id: "old", sentAt: before.Add(-time.Hour).UnixNano()},
+		&fakeRow{id: "new", sentAt: before.Add(time.Hour).UnixNano()},
+		&fakeRow{id: "pending"},
+	)
+
+	n, err := o.Purge(context.Background(), before)
+	if err != nil || n != 1 {
+		t.Fatalf("Purge() = %d, %v, want 1", n, err)
+	}
+	var left []string
+	for _, r := range table.snapshot() {
+		left = append(left, r.id)
+	}
+	if !reflect.DeepEqual(left, []string{"new", "pending"}) {
+		t.Fatalf("rows left %v", left)
+	}
+}
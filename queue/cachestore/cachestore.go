@@ -0,0 +1,46 @@
+// Package cachestore 基于cache的消息去重记录，配合queue.Idempotent使用
+package cachestore
+
+import (
+	"context"
+
+	"github.com/yybirdcf/golib/cache"
+	"github.com/yybirdcf/golib/queue"
+)
+
+// Store 基于cache的去重记录，redis下为SET NX + 过期时间
+// 处理中标记的值为随机token，撤销时只删除自己的token
+type Store struct {
+	cache  cache.NXCache
+	prefix string
+	lease  int32
+	ttl    int32
+}
+
+var _ queue.ProcessedStore = (*Store)(nil)
+
+// lease为处理中标记保留的秒数，应大于handler的最长耗时
+// ttl为已处理记录保留的秒数，应大于消息可能重投的时间窗口
+func NewStore(c cache.NXCache, prefix string, lease int32, ttl int32) *Store {
+	return &Store{
+		cache:  c,
+		prefix: prefix,
+		lease:  lease,
+		ttl:    ttl,
+	}
+}
+
+func (s *Store) MarkProcessing(ctx context.Context, id string) (string, bool, error) {
+	token := queue.NewMessageID()
+	ok, err := s.cache.SetNX(s.prefix+id, []byte(token), s.lease)
+	return token, ok, err
+}
+
+func (s *Store) MarkProcessed(ctx context.Context, id string) error {
+	return s.cache.Set(s.prefix+id, []byte("done"), s.ttl)
+}
+
+func (s *Store) Unmark(ctx context.Context, id string, token string) error {
+	_, err := s.cache.CompareAndDelete(s.prefix+id, []byte(token))
+	return err
+}
@@ -0,0 +1,238 @@
+package cachestore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/queue"
+)
+
+// fakeNXCache 带过期时间的内存cache，now可以拨动
+type fakeNXCache struct {
+	mu     sync.Mutex
+	now    time.Time
+	values map[string]string
+	expire map[string]time.Time
+}
+
+func newFakeNXCache() *fakeNXCache {
+	return &fakeNXCache{
+		now:    time.Unix(1000, 0),
+		values: make(map[string]string),
+		expire: make(map[string]time.Time),
+	}
+}
+
+func (c *fakeNXCache) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeNXCache) value(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.now.Before(c.expire[key]) {
+		return ""
+	}
+	return c.values[key]
+}
+
+func (c *fakeNXCache) Get(key string) ([]byte, error) {
+	return []byte(c.value(key)), nil
+}
+
+func (c *fakeNXCache) Set(key string, value []byte, seconds int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = string(value)
+	c.expire[key] = c.now.Add(time.Duration(seconds) * time.Second)
+	return nil
+}
+
+func (c *fakeNXCache) SetNX(key string, value []byte, seconds int32) (bool, error) {
+	if c.value(key) != "" {
+		return false, nil
+	}
+	return true, c.Set(key, value, seconds)
+}
+
+func (c *fakeNXCache) Del(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+	return nil
+}
+
+func (c *fakeNXCache) CompareAndDelete(key string, value []byte) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.now.Before(c.expire[key]) || c.values[key] != string(value) {
+		return false, nil
+	}
+	delete(c.values, key)
+	return true, nil
+}
+
+func (c *fakeNXCache) Decr(string, uint64) (uint64, error) { return 0, errors.New("not supported") }
+func (c *fakeNXCache) Incr(string, uint64) (uint64, error) { return 0, errors.New("not supported") }
+
+// failingHandler 前fail次调用返回错误
+type failingHandler struct {
+	mu    sync.Mutex
+	calls []string
+	fail  int
+}
+
+func (h *failingHandler) handle(name string, msg *queue.Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, msg.Body)
+	if len(h.calls) <= h.fail {
+		return errors.New("boom")
+	}
+	return nil
+}
+
+func (h *failingHandler) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.calls)
+}
+
+func newIdempotentQueue(t *testing.T, handler queue.HandlerE) *queue.MemoryQueue {
+	mq := queue.NewMemoryQueue(&queue.MemoryConfig{Sync: true, MaxRetries: 2})
+	t.Cleanup(mq.Close)
+	mq.RegisterHandlerE("q", handler)
+	mq.Run()
+	return mq
+}
+
+func TestIdempotentSkipsDuplicate(t *testing.T) {
+	c := newFakeNXCache()
+	h := &failingHandler{}
+	mq := newIdempotentQueue(t, queue.Idempotent(NewStore(c, "p:", 60, 3600), h.handle))
+
+	msg := queue.NewMessage("a").Encode()
+	mq.Push("q", msg)
+	mq.Push("q", msg)
+	if n := h.count(); n != 1 {
+		t.Fatalf("handler calls = %d, want 1", n)
+	}
+	if v := c.value("p:" + queue.DecodeMessage(msg).ID); v != "done" {
+		t.Fatalf("mark = %q, want done", v)
+	}
+
+	//没有ID的消息不去重
+	mq.Push("q", "raw")
+	mq.Push("q", "raw")
+	if n := h.count(); n != 3 {
+		t.Fatalf("handler calls = %d, want 3", n)
+	}
+}
+
+func TestIdempotentFailureRedelivered(t *testing.T) {
+	c := newFakeNXCache()
+	h := &failingHandler{fail: 1}
+	var marks []string
+	store := NewStore(c, "p:", 60, 3600)
+	mq := newIdempotentQueue(t, queue.Idempotent(store, func(name string, msg *queue.Message) error {
+		//handler执行时是处理中，不是已处理
+		marks = append(marks, c.value("p:"+msg.ID))
+		return h.handle(name, msg)
+	}))
+
+	msg := queue.NewMessage("a")
+	mq.Push("q", msg.Encode())
+	if n := h.count(); n != 2 {
+		t.Fatalf("handler calls = %d, want 2", n)
+	}
+	if marks[0] == "" || marks[0] == "done" || marks[1] == "" || marks[1] == "done" {
+		t.Fatalf("marks during handler = %v", marks)
+	}
+	if v := c.value("p:" + msg.ID); v != "done" {
+		t.Fatalf("mark = %q, want done", v)
+	}
+	if dead := mq.DeadLetters("q"); len(dead) != 0 {
+		t.Fatalf("DeadLetters() = %v", dead)
+	}
+}
+
+func TestIdempotentFailureNotMarked(t *testing.T) {
+	c := newFakeNXCache()
+	h := &failingHandler{fail: 100}
+	mq := newIdempotentQueue(t, queue.Idempotent(NewStore(c, "p:", 60, 3600), h.handle))
+
+	msg := queue.NewMessage("a")
+	mq.Push("q", msg.Encode())
+	if n := h.count(); n != 3 {
+		t.Fatalf("handler calls = %d, want 3", n)
+	}
+	if v := c.value("p:" + msg.ID); v != "" {
+		t.Fatalf("mark = %q, want none after failure", v)
+	}
+	if dead := mq.DeadLetters("q"); len(dead) != 1 {
+		t.Fatalf("DeadLetters() = %v", dead)
+	}
+}
+
+func TestIdempotentLeaseTakeover(t *testing.T) {
+	c := newFakeNXCache()
+	h := &failingHandler{}
+	mq := newIdempotentQueue(t, queue.Idempotent(NewStore(c, "p:", 60, 3600), h.handle))
+
+	//另一个消费者标记处理中后崩溃
+	msg := queue.NewMessage("a")
+	c.SetNX("p:"+msg.ID, []byte("crashed"), 60)
+
+	mq.Push("q", msg.Encode())
+	if n := h.count(); n != 0 {
+		t.Fatalf("handler calls within lease = %d, want 0", n)
+	}
+
+	c.advance(61 * time.Second)
+	mq.Push("q", msg.Encode())
+	if n := h.count(); n != 1 {
+		t.Fatalf("handler calls after lease = %d, want 1", n)
+	}
+	if v := c.value("p:" + msg.ID); v != "done" {
+		t.Fatalf("mark = %q, want done", v)
+	}
+}
+
+func TestUnmarkKeepsTakenOverLease(t *testing.T) {
+	c := newFakeNXCache()
+	store := NewStore(c, "p:", 60, 3600)
+	ctx := context.Background()
+
+	slow, ok, err := store.MarkProcessing(ctx, "a")
+	if err != nil || !ok {
+		t.Fatalf("MarkProcessing() = %v, %v", ok, err)
+	}
+
+	//租约过期后被另一个消费者接管，原消费者失败撤销时不能删除新的租约
+	c.advance(61 * time.Second)
+	owner, ok, err := store.MarkProcessing(ctx, "a")
+	if err != nil || !ok {
+		t.Fatalf("MarkProcessing() after lease = %v, %v", ok, err)
+	}
+	if err := store.Unmark(ctx, "a", slow); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.value("p:a"); v != owner {
+		t.Fatalf("mark = %q, want lease of new owner %q", v, owner)
+	}
+	if _, ok, _ := store.MarkProcessing(ctx, "a"); ok {
+		t.Fatal("MarkProcessing() while owner holds lease = true")
+	}
+
+	if err := store.Unmark(ctx, "a", owner); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.value("p:a"); v != "" {
+		t.Fatalf("mark = %q, want none after owner unmark", v)
+	}
+}
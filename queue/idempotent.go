@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yybirdcf/golib/clog"
+)
+
+// ProcessedStore 记录消息的处理状态，先标记处理中（带租约），handler成功后标记已处理
+// 进程在处理中崩溃时，租约过期后重投的消息可以再次处理
+// 基于cache和数据库表的实现在cachestore和sqlstore子包里，queue本身不依赖存储的驱动
+type ProcessedStore interface {
+	// 标记消息处理中，返回这次租约的token，已处理或其他消费者处理中（租约未过期）返回false
+	MarkProcessing(ctx context.Context, id string) (token string, ok bool, err error)
+	// handler成功后标记已处理
+	MarkProcessed(ctx context.Context, id string) error
+	// 处理失败时撤销token对应的租约，让重投的消息可以再次处理
+	// 租约已过期并被其他消费者接管时不能删除对方的租约
+	Unmark(ctx context.Context, id string, token string) error
+}
+
+// Idempotent 包装handler，按消息ID去重，重复的消息直接跳过，用RegisterHandlerE注册
+// 消息需为Message信封格式，没有ID的消息不去重
+// handler返回错误或panic时撤销标记并交给队列重投，成功后才标记已处理
+func Idempotent(store ProcessedStore, handler func(string, *Message) error) HandlerE {
+	return func(name string, value string) error {
+		ctx := context.Background()
+		msg := DecodeMessage(value)
+
+		if msg.ID == "" {
+			return handler(name, msg)
+		}
+
+		token, ok, err := store.MarkProcessing(ctx, msg.ID)
+		if err != nil {
+			return fmt.Errorf("mark %s processing: %w", msg.ID, err)
+		}
+		if !ok {
+			clog.Debugf("queue %s skip duplicate message %s", name, msg.ID)
+			return nil
+		}
+
+		done := false
+		defer func() {
+			if done {
+				return
+			}
+			if err := store.Unmark(ctx, msg.ID, token); err != nil {
+				clog.Errorf("queue %s unmark %s err: %v", name, msg.ID, err)
+			}
+		}()
+
+		if err := handler(name, msg); err != nil {
+			return err
+		}
+		done = true
+
+		//标记失败时处理中的租约过期后可能重复处理一次
+		if err := store.MarkProcessed(ctx, msg.ID); err != nil {
+			clog.Errorf("queue %s mark %s processed err: %v", name, msg.ID, err)
+		}
+		return nil
+	}
+}
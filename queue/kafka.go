@@ -1,7 +1,14 @@
 package queue
 
 import (
-	"os"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/yybirdcf/golib/clog"
@@ -9,107 +16,645 @@ import (
 
 type KafkaConfig struct {
 	Addresses []string
+
+	// 客户端ID，默认sarama
+	ClientID string
+	// kafka版本，如2.1.0，默认使用sarama的最低兼容版本
+	Version string
+	// 不为nil时使用TLS连接
+	TLS *tls.Config
+	// SASL认证，User不为空时开启
+	SASLUser     string
+	SASLPassword string
+	// PLAIN、SCRAM-SHA-256、SCRAM-SHA-512，默认PLAIN
+	SASLMechanism string
+	// SCRAM认证需要提供SCRAM客户端
+	SCRAMClient func() sarama.SCRAMClient
+	// 连接失败或运行中连接断开后的重连间隔，默认5秒
+	ReconnectInterval time.Duration
+	// handler失败（返回错误或panic）后的重试次数，默认3，小于0不重试，重试耗尽后进入死信topic
+	// 重试期间阻塞所在分区的消费
+	MaxRetries int
+	// 重试间隔，默认1秒
+	RetryDelay time.Duration
+	// 消费组，不为空时同组的实例分摊分区，处理完成后提交offset，Stats按提交的offset计算lag
+	// 为空时每个实例从最新位置独立消费全部分区，不提交offset，Stats不统计lag
+	GroupID string
+
+	// 异步批量发送，默认同步发送；开启后Push仍等待投递结果，不等待用PushAsync
+	Async bool
+	// 批量发送的等待时间，对应linger.ms
+	Linger time.Duration
+	// 批量发送的字节数阈值
+	BatchBytes int
+	// 压缩方式：gzip、snappy、lz4、zstd，为空不压缩
+	Compression string
+	// 幂等生产者，保证单分区内不重复
+	Idempotent bool
+	// 异步发送的投递结果回调
+	OnDelivery func(*Delivery)
 }
 
+// KafkaQueue 连接是懒加载的，第一次Push或Run时才连接broker
+// Run时连接失败会在后台按ReconnectInterval重连，连上后再启动消费
+// 运行中发送或消费组遇到连接错误（broker全部不可用、网络错误）时关闭整个连接，
+// 下一次Push重新连接，Run过时在后台重连并重新启动消费
 type KafkaQueue struct {
-	producer sarama.SyncProducer
-	consumer sarama.Consumer
-	handlers map[string]func(string, string)
+	cfg    *KafkaConfig
+	config *sarama.Config
+
+	connMu   sync.Mutex
+	conn     *kafkaConn
+	handlers map[string]HandlerE
+
+	// 异步发送时持有读锁，关闭连接时持有写锁，关闭后不再往Input发送
+	sendMu     sync.RWMutex
+	onDelivery func(*Delivery)
+
+	// Run之后为1，连接断开后需要重新启动消费
+	running int32
+	// 后台重连中为1，同时只有一个重连
+	reconnecting int32
+	// 正在关闭断开的连接，Close等待
+	resets sync.WaitGroup
+
+	mu      sync.Mutex
+	pcs     []sarama.PartitionConsumer
+	metrics *Metrics
+
+	// 消费组模式的消费者，关闭连接时取消
+	// groupID和groupHandler默认为GroupID和kafkaGroupHandler，KafkaPubSub替换为广播的消费组
+	groupID      string
+	groupHandler sarama.ConsumerGroupHandler
+	group        sarama.ConsumerGroup
+	cancelGroup  context.CancelFunc
+	groupWG      sync.WaitGroup
+	// 创建过消费组为1
+	groupCreated int32
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// kafkaConn 一次连接的client、生产者和消费者，Close或连接断开时整体摘下
+type kafkaConn struct {
+	client        sarama.Client
+	producer      sarama.SyncProducer
+	asyncProducer sarama.AsyncProducer
+	consumer      sarama.Consumer
+
+	// 异步生产者的投递结果分发
+	deliveries sync.WaitGroup
+	// 在sendMu写锁内设置，之后不再往Input发送
+	closing bool
 }
 
-func NewKafkaQueue(cfg *KafkaConfig) *KafkaQueue {
+var (
+	errKafkaClosed    = errors.New("kafka queue closed")
+	errKafkaConnReset = errors.New("kafka connection reset")
+)
+
+// isKafkaConnError 连接级别的错误，需要重建连接
+func isKafkaConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, sarama.ErrOutOfBrokers) || errors.Is(err, sarama.ErrClosedClient) ||
+		errors.Is(err, sarama.ErrNotConnected) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func NewKafkaQueue(cfg *KafkaConfig) (*KafkaQueue, error) {
+	if cfg == nil || len(cfg.Addresses) == 0 {
+		return nil, errors.New("kafka addresses is empty")
+	}
+
+	config, err := newSaramaConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.GroupID != "" {
+		// 消费组要求0.10.2以上，第一次加入时从最新位置开始
+		if !config.Version.IsAtLeast(sarama.V0_10_2_0) {
+			config.Version = sarama.V0_10_2_0
+		}
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+
+	kq := &KafkaQueue{}
+	kq.cfg = cfg
+	kq.config = config
+	kq.onDelivery = cfg.OnDelivery
+	kq.handlers = make(map[string]HandlerE)
+	kq.groupID = cfg.GroupID
+	kq.groupHandler = kafkaGroupHandler{kq}
+	kq.metrics = NewMetrics(nil)
+	kq.closed = make(chan struct{})
+
+	return kq, nil
+}
+
+// newSaramaConfig 根据KafkaConfig生成客户端配置，生产者和消费者共用
+func newSaramaConfig(cfg *KafkaConfig) (*sarama.Config, error) {
 	config := sarama.NewConfig()
-	// 等待服务器所有副本都保存成功后的响应
-	config.Producer.RequiredAcks = sarama.WaitForAll
-	// 随机的分区类型：返回一个分区器，该分区器每次选择一个随机分区
-	config.Producer.Partitioner = sarama.NewRandomPartitioner
-	// 是否等待成功和失败后的响应
-	config.Producer.Return.Successes = true
-	// 使用给定代理地址和配置创建一个同步生产者
-	producer, err := sarama.NewSyncProducer(cfg.Addresses, config)
+
+	if cfg.ClientID != "" {
+		config.ClientID = cfg.ClientID
+	}
+	if cfg.Version != "" {
+		version, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, err
+		}
+		config.Version = version
+	}
+
+	if cfg.TLS != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = cfg.TLS
+	}
+
+	if cfg.SASLUser != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = cfg.SASLUser
+		config.Net.SASL.Password = cfg.SASLPassword
+		switch cfg.SASLMechanism {
+		case "", sarama.SASLTypePlaintext:
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+			if cfg.SCRAMClient == nil {
+				return nil, errors.New("kafka sasl scram needs SCRAMClient")
+			}
+			config.Net.SASL.Mechanism = sarama.SASLMechanism(cfg.SASLMechanism)
+			config.Net.SASL.SCRAMClientGeneratorFunc = cfg.SCRAMClient
+		default:
+			return nil, errors.New("kafka sasl mechanism not supported: " + cfg.SASLMechanism)
+		}
+	}
+
+	if err := applyProducerConfig(config, cfg); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (kq *KafkaQueue) isClosed() bool {
+	select {
+	case <-kq.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// connect 懒加载连接，已连接直接返回，Close后返回错误
+func (kq *KafkaQueue) connect() (*kafkaConn, error) {
+	kq.connMu.Lock()
+	defer kq.connMu.Unlock()
+
+	if kq.isClosed() {
+		return nil, errKafkaClosed
+	}
+	if kq.conn != nil {
+		return kq.conn, nil
+	}
+
+	// 生产者和消费者共用一个client，client也用于查询分区高水位
+	client, err := sarama.NewClient(kq.cfg.Addresses, kq.config)
 	if err != nil {
-		clog.Errorf("instance kafka producer err: %v", err)
-		os.Exit(-1)
+		return nil, err
 	}
 
 	// 根据给定的代理地址和配置创建一个消费者
-	consumer, err := sarama.NewConsumer(cfg.Addresses, nil)
+	consumer, err := sarama.NewConsumerFromClient(client)
 	if err != nil {
-		clog.Errorf("instance kafka producer err: %v", err)
-		os.Exit(-1)
+		client.Close()
+		return nil, err
 	}
 
-	kq := &KafkaQueue{}
-	kq.producer = producer
-	kq.consumer = consumer
-	kq.handlers = make(map[string]func(string, string))
+	c := &kafkaConn{
+		client:   client,
+		consumer: consumer,
+	}
+	if kq.cfg.Async {
+		// 使用给定代理地址和配置创建一个异步生产者
+		producer, err := sarama.NewAsyncProducerFromClient(client)
+		if err != nil {
+			consumer.Close()
+			client.Close()
+			return nil, err
+		}
+		c.asyncProducer = producer
+		c.deliveries.Add(1)
+		go kq.dispatchDeliveries(c)
+	} else {
+		// 使用给定代理地址和配置创建一个同步生产者
+		producer, err := sarama.NewSyncProducerFromClient(client)
+		if err != nil {
+			consumer.Close()
+			client.Close()
+			return nil, err
+		}
+		c.producer = producer
+	}
+
+	kq.conn = c
+	return c, nil
+}
+
+// reset 连接断开后摘下c并关闭，c已经被摘下时不处理
+// Run过时在后台重连并重新启动消费，否则等下一次Push懒加载
+func (kq *KafkaQueue) reset(c *kafkaConn, err error) {
+	kq.connMu.Lock()
+	if kq.conn != c {
+		kq.connMu.Unlock()
+		return
+	}
+	kq.conn = nil
+	kq.resets.Add(1)
+	kq.connMu.Unlock()
+	defer kq.resets.Done()
+
+	clog.Errorf("kafka connection broken: %v, reconnecting", err)
+	kq.closeConn(c)
+
+	if atomic.LoadInt32(&kq.running) == 1 {
+		go kq.reconnect()
+	}
+}
+
+// checkConn 连接错误时在后台重建连接
+// 调用方可能是消费组里的handler（如发送死信），关闭连接要等handler返回，不能同步关闭
+func (kq *KafkaQueue) checkConn(c *kafkaConn, err error) {
+	if isKafkaConnError(err) {
+		go kq.reset(c, err)
+	}
+}
 
-	return kq
+func (kq *KafkaQueue) reconnectInterval() time.Duration {
+	if kq.cfg.ReconnectInterval > 0 {
+		return kq.cfg.ReconnectInterval
+	}
+	return 5 * time.Second
 }
 
 func (kq *KafkaQueue) Push(name string, value string) error {
-	//构建发送的消息
-	msg := &sarama.ProducerMessage{
-		Topic: name, //包含了消息的主题
+	return kq.PushWithKey(name, "", value)
+}
+
+// 按key做hash分区，相同key的消息保证进入同一分区
+func (kq *KafkaQueue) PushWithKey(name string, key string, value string) error {
+	c, err := kq.connect()
+	if err != nil {
+		return err
+	}
+
+	if c.asyncProducer != nil {
+		// 等待投递结果，返回发送错误；不需要等待时用PushAsync
+		// 投递结果回调在同一个goroutine里执行，不能在回调里调用Push
+		result := make(chan error, 1)
+		kq.PushAsync(name, key, value, func(d *Delivery) {
+			result <- d.Err
+		})
+		return <-result
 	}
 
-	msg.Value = sarama.ByteEncoder(value)
+	//构建发送的消息
+	msg := newProducerMessage(name, key, value)
 	//SendMessage：该方法是生产者生产给定的消息
 	//生产成功的时候返回该消息的分区和所在的偏移量
 	//生产失败的时候返回error
-	partition, offset, err := kq.producer.SendMessage(msg)
+	partition, offset, err := c.producer.SendMessage(msg)
 
 	if err != nil {
 		clog.Errorf("Send message Fail: %+v", msg)
+		kq.checkConn(c, err)
+		return err
 	}
-	clog.Info("Partition = %d, offset=%d\n", partition, offset)
-	return err
+	clog.Debugf("Partition = %d, offset=%d", partition, offset)
+	return nil
 }
 
 func (kq *KafkaQueue) Close() {
-	if kq.producer != nil {
-		kq.producer.Close()
+	kq.closeOnce.Do(func() {
+		close(kq.closed)
+	})
+
+	// 先摘下连接再关闭，投递回调里调用Push时connect直接返回错误，不会等connMu
+	kq.connMu.Lock()
+	c := kq.conn
+	kq.conn = nil
+	kq.connMu.Unlock()
+
+	if c != nil {
+		kq.closeConn(c)
+	}
+	kq.resets.Wait()
+}
+
+// closeConn 关闭连接上的生产者和消费者，异步生产者缓冲中的消息发送完后返回
+func (kq *KafkaQueue) closeConn(c *kafkaConn) {
+	if c.producer != nil {
+		c.producer.Close()
+	}
+
+	if c.asyncProducer != nil {
+		// 等正在往Input发送的PushAsync结束，之后的PushAsync都能看到closing
+		kq.sendMu.Lock()
+		c.closing = true
+		kq.sendMu.Unlock()
+
+		// AsyncClose会先把缓冲中的消息发送完，再关闭Successes和Errors通道
+		c.asyncProducer.AsyncClose()
+		c.deliveries.Wait()
+	}
+
+	kq.mu.Lock()
+	for _, pc := range kq.pcs {
+		pc.AsyncClose()
 	}
+	kq.pcs = nil
+	if kq.cancelGroup != nil {
+		kq.cancelGroup()
+	}
+	group := kq.group
+	kq.group = nil
+	kq.mu.Unlock()
 
-	if kq.consumer != nil {
-		kq.consumer.Close()
+	// 消费组用的是同一个client，先关闭消费组
+	if group != nil {
+		group.Close()
 	}
+	kq.groupWG.Wait()
+
+	c.consumer.Close()
+	c.client.Close()
 }
 
 func (kq *KafkaQueue) RegisterHandler(name string, handler func(string, string)) {
+	kq.RegisterHandlerE(name, handlerE(handler))
+}
+
+func (kq *KafkaQueue) RegisterHandlerE(name string, handler HandlerE) {
 	kq.handlers[name] = handler
 }
 
 func (kq *KafkaQueue) Run() {
-	for name, _ := range kq.handlers {
-		kq.runHandler(name)
+	atomic.StoreInt32(&kq.running, 1)
+	c, err := kq.connect()
+	if err != nil {
+		clog.Errorf("connect kafka err: %v, retry in background", err)
+		go kq.reconnect()
+		return
+	}
+
+	kq.consume(c)
+}
+
+func (kq *KafkaQueue) consume(c *kafkaConn) {
+	if kq.groupID != "" {
+		kq.runGroup(c)
+		return
+	}
+	for name := range kq.handlers {
+		kq.runHandler(c, name)
 	}
 }
 
-func (kq *KafkaQueue) runHandler(name string) {
+// reconnect 后台重连，连上后启动所有handler，已经在重连时直接返回
+func (kq *KafkaQueue) reconnect() {
+	if !atomic.CompareAndSwapInt32(&kq.reconnecting, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&kq.reconnecting, 0)
+
+	ticker := time.NewTicker(kq.reconnectInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-kq.closed:
+			return
+		case <-ticker.C:
+		}
+
+		c, err := kq.connect()
+		if err != nil {
+			clog.Errorf("reconnect kafka err: %v", err)
+			continue
+		}
+
+		kq.consume(c)
+		return
+	}
+}
+
+func (kq *KafkaQueue) runHandler(c *kafkaConn, name string) {
 	//Partitions(topic):该方法返回了该topic的所有分区id
-	partitionList, err := kq.consumer.Partitions(name)
+	partitionList, err := c.consumer.Partitions(name)
 	if err != nil {
 		clog.Errorf("get partition list: %v", err)
 		return
 	}
 
-	for partition := range partitionList {
+	for _, partition := range partitionList {
 		//ConsumePartition方法根据主题，分区和给定的偏移量创建创建了相应的分区消费者
 		//如果该分区消费者已经消费了该信息将会返回error
-		//sarama.OffsetNewest:表明了为最新消息
-		pc, err := kq.consumer.ConsumePartition(name, int32(partition), sarama.OffsetNewest)
+		pc, err := c.consumer.ConsumePartition(name, partition, sarama.OffsetNewest)
 		if err != nil {
 			clog.Errorf("consume partition: %v", err)
 			return
 		}
-		defer pc.AsyncClose()
 
-		go func(sarama.PartitionConsumer) {
+		kq.mu.Lock()
+		kq.pcs = append(kq.pcs, pc)
+		kq.mu.Unlock()
+
+		go func(pc sarama.PartitionConsumer) {
+			retries, delay := retryConfig(kq.cfg.MaxRetries, kq.cfg.RetryDelay)
 			//Messages()该方法返回一个消费消息类型的只读通道，由代理产生
 			for msg := range pc.Messages() {
-				kq.handlers[name](name, string(msg.Value))
+				handleWithRetry(kq, kq.metrics, name, string(msg.Value), kq.handlers[name], retries, delay, kq.closed)
 			}
 		}(pc)
 	}
 }
+
+// runGroup 加入消费组消费所有handler的topic，rebalance或出错后重新加入，直到连接关闭
+// 连接错误时重建连接，由reconnect重新启动
+func (kq *KafkaQueue) runGroup(c *kafkaConn) {
+	group, err := sarama.NewConsumerGroupFromClient(kq.groupID, c.client)
+	if err != nil {
+		clog.Errorf("instance kafka consumer group err: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	kq.mu.Lock()
+	if kq.isClosed() {
+		kq.mu.Unlock()
+		cancel()
+		group.Close()
+		return
+	}
+	kq.group = group
+	kq.cancelGroup = cancel
+	kq.groupWG.Add(1)
+	kq.mu.Unlock()
+	atomic.StoreInt32(&kq.groupCreated, 1)
+
+	topics := kq.Names()
+	go func() {
+		defer kq.groupWG.Done()
+		for {
+			// rebalance后Consume返回，需要重新加入
+			err := group.Consume(ctx, topics, kq.groupHandler)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+					return
+				}
+				clog.Errorf("kafka consumer group %s err: %v", kq.groupID, err)
+				if isKafkaConnError(err) {
+					go kq.reset(c, err)
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(kq.reconnectInterval()):
+				}
+			}
+		}
+	}()
+}
+
+// kafkaGroupHandler 处理完成（包括进入死信）后标记offset，由sarama定时提交
+type kafkaGroupHandler struct {
+	kq *KafkaQueue
+}
+
+func (h kafkaGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h kafkaGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h kafkaGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	kq := h.kq
+	retries, delay := retryConfig(kq.cfg.MaxRetries, kq.cfg.RetryDelay)
+	for msg := range claim.Messages() {
+		handleWithRetry(kq, kq.metrics, msg.Topic, string(msg.Value), kq.handlers[msg.Topic], retries, delay, kq.closed)
+		session.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+// Names 已注册handler的topic
+func (kq *KafkaQueue) Names() []string {
+	names := make([]string, 0, len(kq.handlers))
+	for name := range kq.handlers {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (kq *KafkaQueue) Metrics() *Metrics {
+	return kq.metrics
+}
+
+// Stats 设置GroupID时各分区lag为高水位减去消费组已提交的offset，未提交过的分区不统计
+// 没有消费组时不提交offset，无法得到可靠的lag，只统计死信
+// 死信数为死信topic中保留的消息数
+func (kq *KafkaQueue) Stats(name string) (*Stats, error) {
+	c, err := kq.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Stats{
+		Name:     name,
+		InFlight: kq.metrics.InFlight(name),
+	}
+
+	if kq.cfg.GroupID != "" {
+		if err := kq.groupLag(c, s); err != nil {
+			return nil, err
+		}
+	}
+
+	dead := name + DeadLetterSuffix
+	partitions, err := c.client.Partitions(dead)
+	if err != nil {
+		// 死信topic不存在
+		return s, nil
+	}
+	for _, partition := range partitions {
+		newest, err := c.client.GetOffset(dead, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+		oldest, err := c.client.GetOffset(dead, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, err
+		}
+		s.DeadLetter += newest - oldest
+	}
+
+	return s, nil
+}
+
+// groupLag 按消费组已提交的offset计算各分区lag
+func (kq *KafkaQueue) groupLag(c *kafkaConn, s *Stats) error {
+	partitions, err := c.client.Partitions(s.Name)
+	if err != nil {
+		return err
+	}
+
+	// admin和kq共用client，不关闭admin
+	admin, err := sarama.NewClusterAdminFromClient(c.client)
+	if err != nil {
+		return err
+	}
+	committed, err := admin.ListConsumerGroupOffsets(kq.cfg.GroupID, map[string][]int32{s.Name: partitions})
+	if err != nil {
+		return err
+	}
+	if committed.Err != sarama.ErrNoError {
+		return committed.Err
+	}
+
+	s.Lag = make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		block := committed.GetBlock(s.Name, partition)
+		if block == nil || block.Offset < 0 {
+			continue
+		}
+		if block.Err != sarama.ErrNoError {
+			return block.Err
+		}
+
+		hwm, err := c.client.GetOffset(s.Name, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		lag := hwm - block.Offset
+		if lag < 0 {
+			lag = 0
+		}
+		s.Lag[partition] = lag
+		s.Pending += lag
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/yybirdcf/golib/clog"
+)
+
+// Delivery 异步发送的投递结果
+type Delivery struct {
+	Topic     string
+	Key       string
+	Value     string
+	Partition int32
+	Offset    int64
+	Err       error
+}
+
+// applyProducerConfig 根据KafkaConfig设置生产者配置，不支持的压缩方式返回错误
+func applyProducerConfig(config *sarama.Config, cfg *KafkaConfig) error {
+	// 等待服务器所有副本都保存成功后的响应
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	// 按消息key做hash分区，key为空时随机选择分区
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	// 是否等待成功和失败后的响应
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	// 批量发送
+	if cfg.Linger > 0 {
+		config.Producer.Flush.Frequency = cfg.Linger
+	}
+	if cfg.BatchBytes > 0 {
+		config.Producer.Flush.Bytes = cfg.BatchBytes
+	}
+
+	switch strings.ToLower(cfg.Compression) {
+	case "", "none":
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		// zstd需要kafka 2.1.0以上
+		config.Producer.Compression = sarama.CompressionZSTD
+		if !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+			config.Version = sarama.V2_1_0_0
+		}
+	default:
+		return errors.New("kafka compression not supported: " + cfg.Compression)
+	}
+
+	if cfg.Idempotent {
+		// 幂等生产者要求kafka 0.11以上，且单连接只能有一个在途请求
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+	return nil
+}
+
+// newProducerMessage 构建发送的消息，key为空时不设置
+func newProducerMessage(name string, key string, value string) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: name, //包含了消息的主题
+		Value: sarama.ByteEncoder(value),
+	}
+	if key != "" {
+		msg.Key = sarama.StringEncoder(key)
+	}
+	return msg
+}
+
+// PushAsync 异步发送，投递结果先回调cb，再回调KafkaConfig.OnDelivery
+// 未开启Async时退化为同步发送
+func (kq *KafkaQueue) PushAsync(name string, key string, value string, cb func(*Delivery)) {
+	c, err := kq.connect()
+	if err != nil {
+		kq.deliver(cb, &Delivery{
+			Topic: name,
+			Key:   key,
+			Value: value,
+			Err:   err,
+		})
+		return
+	}
+
+	if c.asyncProducer == nil {
+		msg := newProducerMessage(name, key, value)
+		partition, offset, err := c.producer.SendMessage(msg)
+		kq.checkConn(c, err)
+		kq.deliver(cb, &Delivery{
+			Topic:     name,
+			Key:       key,
+			Value:     value,
+			Partition: partition,
+			Offset:    offset,
+			Err:       err,
+		})
+		return
+	}
+
+	// 连接关闭后Input通道已关闭，发送会panic，检查和发送在同一个读锁内
+	kq.sendMu.RLock()
+	defer kq.sendMu.RUnlock()
+	if kq.isClosed() || c.closing {
+		err := errKafkaClosed
+		if !kq.isClosed() {
+			err = errKafkaConnReset
+		}
+		kq.deliver(cb, &Delivery{
+			Topic: name,
+			Key:   key,
+			Value: value,
+			Err:   err,
+		})
+		return
+	}
+
+	msg := newProducerMessage(name, key, value)
+	msg.Metadata = cb
+	c.asyncProducer.Input() <- msg
+}
+
+// dispatchDeliveries 消费异步生产者的成功和失败通道，直到生产者关闭
+func (kq *KafkaQueue) dispatchDeliveries(c *kafkaConn) {
+	defer c.deliveries.Done()
+
+	successes := c.asyncProducer.Successes()
+	errors := c.asyncProducer.Errors()
+	for successes != nil || errors != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			kq.deliver(metadataCallback(msg), newDelivery(msg, nil))
+		case perr, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			clog.Errorf("Send message Fail: %v", perr.Err)
+			kq.checkConn(c, perr.Err)
+			kq.deliver(metadataCallback(perr.Msg), newDelivery(perr.Msg, perr.Err))
+		}
+	}
+}
+
+func (kq *KafkaQueue) deliver(cb func(*Delivery), d *Delivery) {
+	if cb != nil {
+		cb(d)
+	}
+	if kq.onDelivery != nil {
+		kq.onDelivery(d)
+	}
+}
+
+func metadataCallback(msg *sarama.ProducerMessage) func(*Delivery) {
+	if cb, ok := msg.Metadata.(func(*Delivery)); ok {
+		return cb
+	}
+	return nil
+}
+
+func newDelivery(msg *sarama.ProducerMessage, err error) *Delivery {
+	d := &Delivery{
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Err:       err,
+	}
+	if msg.Key != nil {
+		if b, e := msg.Key.Encode(); e == nil {
+			d.Key = string(b)
+		}
+	}
+	if msg.Value != nil {
+		if b, e := msg.Value.Encode(); e == nil {
+			d.Value = string(b)
+		}
+	}
+	return d
+}
@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"os"
+	"sync/atomic"
+
+	"github.com/Shopify/sarama"
+	"github.com/yybirdcf/golib/clog"
+)
+
+// kafkaPubSubMinVersion 消费组要求0.10.2以上，Close时删除消费组的DeleteGroups请求要求1.1以上
+// 低于1.1时sarama直接返回ErrUnsupportedVersion，消费组会一直遗留在broker上
+var kafkaPubSubMinVersion = sarama.V1_1_0_0
+
+// KafkaPubSub kafka上的广播，每个实例使用唯一的消费组，都能收到topic的全部消息
+// 只消费实例启动之后的新消息，连接断开后的重连同KafkaQueue
+// 每次启动都会创建新的消费组，Close时删除；进程异常退出时遗留的消费组由kafka在
+// offsets.retention.minutes后清理，期间会出现在消费组列表和lag监控中
+// 删除消费组需要kafka 1.1以上，配置的Version更低时按kafkaPubSubMinVersion连接
+type KafkaPubSub struct {
+	kq      *KafkaQueue
+	groupID string
+}
+
+// NewKafkaPubSub groupPrefix为消费组前缀，实际消费组为前缀-主机名-随机串
+func NewKafkaPubSub(cfg *KafkaConfig, groupPrefix string) (*KafkaPubSub, error) {
+	kq, err := NewKafkaQueue(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if !kq.config.Version.IsAtLeast(kafkaPubSubMinVersion) {
+		kq.config.Version = kafkaPubSubMinVersion
+	}
+	kq.config.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	if groupPrefix == "" {
+		groupPrefix = "golib-broadcast"
+	}
+	hostname, _ := os.Hostname()
+
+	ps := &KafkaPubSub{}
+	ps.kq = kq
+	ps.groupID = groupPrefix + "-" + hostname + "-" + NewMessageID()[:8]
+	// 由kq按消费组消费，消息交给ps处理
+	kq.groupID = ps.groupID
+	kq.groupHandler = ps
+
+	return ps, nil
+}
+
+// GroupID 本实例的消费组
+func (ps *KafkaPubSub) GroupID() string {
+	return ps.groupID
+}
+
+func (ps *KafkaPubSub) Push(name string, value string) error {
+	return ps.kq.Push(name, value)
+}
+
+func (ps *KafkaPubSub) RegisterHandler(name string, handler func(string, string)) {
+	ps.RegisterHandlerE(name, handlerE(handler))
+}
+
+// RegisterHandlerE 订阅topic，广播消息不重投，handler返回的错误只记录日志
+func (ps *KafkaPubSub) RegisterHandlerE(name string, handler HandlerE) {
+	ps.kq.handlers[name] = handler
+}
+
+func (ps *KafkaPubSub) Run() {
+	if len(ps.kq.handlers) == 0 {
+		return
+	}
+	ps.kq.Run()
+}
+
+func (ps *KafkaPubSub) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (ps *KafkaPubSub) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (ps *KafkaPubSub) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		if handler, ok := ps.kq.handlers[msg.Topic]; ok {
+			// 广播消息不重投，失败只记录
+			done := ps.kq.metrics.Begin(msg.Topic)
+			if err := callHandler(handler, msg.Topic, string(msg.Value)); err != nil {
+				clog.Errorf("kafka pubsub %s handle err: %v", msg.Topic, err)
+			}
+			done()
+		}
+		session.MarkMessage(msg, "")
+	}
+	return nil
+}
+
+func (ps *KafkaPubSub) Close() {
+	ps.kq.Close()
+	if atomic.LoadInt32(&ps.kq.groupCreated) == 1 {
+		ps.deleteGroup()
+	}
+}
+
+// deleteGroup 删除本实例的消费组，kq的连接已经关闭，单独连接
+func (ps *KafkaPubSub) deleteGroup() {
+	admin, err := sarama.NewClusterAdmin(ps.kq.cfg.Addresses, ps.kq.config)
+	if err != nil {
+		clog.Errorf("kafka cluster admin err: %v", err)
+		return
+	}
+	defer admin.Close()
+	if err := admin.DeleteConsumerGroup(ps.groupID); err != nil {
+		clog.Errorf("delete kafka consumer group %s err: %v", ps.groupID, err)
+	}
+}
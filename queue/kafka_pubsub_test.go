@@ -0,0 +1,30 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestNewKafkaPubSubVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    sarama.KafkaVersion
+	}{
+		//默认版本和低于1.1的版本提升到1.1，Close时才能删除消费组
+		{"", sarama.V1_1_0_0},
+		{"0.10.2.0", sarama.V1_1_0_0},
+		{"1.0.0", sarama.V1_1_0_0},
+		{"2.1.0", sarama.V2_1_0_0},
+	}
+	for _, tt := range tests {
+		ps, err := NewKafkaPubSub(&KafkaConfig{Addresses: []string{"127.0.0.1:1"}, Version: tt.version}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ps.kq.config.Version; got != tt.want {
+			t.Fatalf("Version %q: config.Version = %s, want %s", tt.version, got, tt.want)
+		}
+		ps.Close()
+	}
+}
@@ -0,0 +1,351 @@
+package queue
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// newTestKafkaBroker orders有3个分区，orders.dead有1个分区
+func newTestKafkaBroker(t *testing.T) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+	broker.SetHandlerByMap(testKafkaResponses(t, broker))
+	return broker
+}
+
+func testKafkaResponses(t *testing.T, broker *sarama.MockBroker) map[string]sarama.MockResponse {
+	return map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetController(broker.BrokerID()).
+			SetLeader("orders", 0, broker.BrokerID()).
+			SetLeader("orders", 1, broker.BrokerID()).
+			SetLeader("orders", 2, broker.BrokerID()).
+			SetLeader("orders"+DeadLetterSuffix, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetVersion(1).
+			SetOffset("orders", 0, sarama.OffsetNewest, 100).
+			SetOffset("orders", 1, sarama.OffsetNewest, 50).
+			SetOffset("orders", 2, sarama.OffsetNewest, 10).
+			SetOffset("orders"+DeadLetterSuffix, 0, sarama.OffsetNewest, 7).
+			SetOffset("orders"+DeadLetterSuffix, 0, sarama.OffsetOldest, 3),
+		"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+			SetCoordinator(sarama.CoordinatorGroup, "workers", broker),
+		"OffsetFetchRequest": sarama.NewMockOffsetFetchResponse(t).
+			SetOffset("workers", "orders", 0, 90, "", sarama.ErrNoError).
+			SetOffset("workers", "orders", 1, 60, "", sarama.ErrNoError),
+	}
+}
+
+// newTestProduceBroker 在newTestKafkaBroker的基础上处理ProduceRequest，orders的分区1写入失败
+func newTestProduceBroker(t *testing.T) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+	setProduceResponses(t, broker)
+	return broker
+}
+
+func setProduceResponses(t *testing.T, broker *sarama.MockBroker) {
+	responses := testKafkaResponses(t, broker)
+	responses["ProduceRequest"] = sarama.NewMockProduceResponse(t).
+		SetVersion(3).
+		SetError("orders", 1, sarama.ErrMessageSizeTooLarge)
+	broker.SetHandlerByMap(responses)
+}
+
+// keyFor 返回hash到partition的key
+func keyFor(t *testing.T, partition int32) string {
+	p := sarama.NewHashPartitioner("orders")
+	for i := 0; i < 100; i++ {
+		key := string(rune('a' + i))
+		got, err := p.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder(key)}, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got == partition {
+			return key
+		}
+	}
+	t.Fatalf("no key for partition %d", partition)
+	return ""
+}
+
+func TestKafkaPushSync(t *testing.T) {
+	broker := newTestProduceBroker(t)
+	kq, err := NewKafkaQueue(&KafkaConfig{Addresses: []string{broker.Addr()}, Version: "2.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kq.Close()
+
+	if err := kq.PushWithKey("orders", keyFor(t, 0), "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kq.PushWithKey("orders", keyFor(t, 1), "v"); !errors.Is(err, sarama.ErrMessageSizeTooLarge) {
+		t.Fatalf("PushWithKey() = %v, want %v", err, sarama.ErrMessageSizeTooLarge)
+	}
+
+	// 未开启Async时PushAsync同步发送后回调
+	var d *Delivery
+	kq.PushAsync("orders", keyFor(t, 2), "v", func(got *Delivery) { d = got })
+	if d == nil || d.Err != nil || d.Partition != 2 {
+		t.Fatalf("delivery = %+v", d)
+	}
+}
+
+func TestKafkaPushAsync(t *testing.T) {
+	broker := newTestProduceBroker(t)
+	var mu sync.Mutex
+	var deliveries []*Delivery
+	kq, err := NewKafkaQueue(&KafkaConfig{
+		Addresses:   []string{broker.Addr()},
+		Version:     "2.1.0",
+		Async:       true,
+		Linger:      time.Millisecond,
+		Compression: "gzip",
+		OnDelivery: func(d *Delivery) {
+			mu.Lock()
+			deliveries = append(deliveries, d)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kq.Close()
+
+	// 异步生产者的Push也等待投递结果
+	if err := kq.PushWithKey("orders", keyFor(t, 0), "v0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kq.PushWithKey("orders", keyFor(t, 1), "v1"); !errors.Is(err, sarama.ErrMessageSizeTooLarge) {
+		t.Fatalf("PushWithKey() = %v, want %v", err, sarama.ErrMessageSizeTooLarge)
+	}
+
+	done := make(chan *Delivery, 1)
+	kq.PushAsync("orders", keyFor(t, 2), "v2", func(d *Delivery) { done <- d })
+	if d := <-done; d.Err != nil || d.Partition != 2 || d.Value != "v2" || d.Key != keyFor(t, 2) {
+		t.Fatalf("delivery = %+v", d)
+	}
+
+	// 关闭后Push返回错误，OnDelivery收到之前的所有投递结果
+	kq.Close()
+	if err := kq.Push("orders", "v3"); err != errKafkaClosed {
+		t.Fatalf("Push() after Close = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(deliveries) != 3 || deliveries[1].Err == nil {
+		t.Fatalf("deliveries = %+v", deliveries)
+	}
+}
+
+func TestApplyProducerConfig(t *testing.T) {
+	config, err := newSaramaConfig(&KafkaConfig{Addresses: []string{"127.0.0.1:1"}, Compression: "ZSTD", Linger: time.Second, BatchBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// zstd要求2.1.0以上
+	if config.Producer.Compression != sarama.CompressionZSTD || !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+		t.Fatalf("Compression = %v, Version = %s", config.Producer.Compression, config.Version)
+	}
+	if config.Producer.Flush.Frequency != time.Second || config.Producer.Flush.Bytes != 1024 || config.Producer.RequiredAcks != sarama.WaitForAll {
+		t.Fatalf("Producer = %+v", config.Producer)
+	}
+
+	// 相同key进入同一分区
+	p := config.Producer.Partitioner("orders")
+	msg := &sarama.ProducerMessage{Topic: "orders", Key: sarama.StringEncoder("user-1")}
+	first, _ := p.Partition(msg, 8)
+	for i := 0; i < 10; i++ {
+		if got, _ := p.Partition(msg, 8); got != first {
+			t.Fatalf("Partition() = %d, want %d", got, first)
+		}
+	}
+
+	config, err = newSaramaConfig(&KafkaConfig{Addresses: []string{"127.0.0.1:1"}, Idempotent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.Producer.Idempotent || config.Net.MaxOpenRequests != 1 || !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		t.Fatalf("idempotent config = %+v, %+v", config.Producer, config.Net)
+	}
+
+	if _, err := newSaramaConfig(&KafkaConfig{Addresses: []string{"127.0.0.1:1"}, Compression: "brotli"}); err == nil {
+		t.Fatal("unsupported compression should fail")
+	}
+}
+
+func TestKafkaStatsGroupLag(t *testing.T) {
+	broker := newTestKafkaBroker(t)
+	kq, err := NewKafkaQueue(&KafkaConfig{Addresses: []string{broker.Addr()}, Version: "2.1.0", GroupID: "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kq.Close()
+
+	s, err := kq.Stats("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//lag按消费组提交的offset计算，超过高水位的按0，未提交过的分区2不统计
+	if want := map[int32]int64{0: 10, 1: 0}; !reflect.DeepEqual(s.Lag, want) {
+		t.Fatalf("Lag = %v, want %v", s.Lag, want)
+	}
+	if s.Pending != 10 || s.DeadLetter != 4 {
+		t.Fatalf("Pending = %d, DeadLetter = %d", s.Pending, s.DeadLetter)
+	}
+}
+
+func TestKafkaStatsWithoutGroup(t *testing.T) {
+	broker := newTestKafkaBroker(t)
+	kq, err := NewKafkaQueue(&KafkaConfig{Addresses: []string{broker.Addr()}, Version: "2.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kq.Close()
+
+	//没有消费组时不提交offset，不统计lag，健康检查不会因为lag失败
+	s, err := kq.Stats("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Lag) != 0 || s.Pending != 0 || s.DeadLetter != 4 {
+		t.Fatalf("stats = %+v", *s)
+	}
+	if err := NewLagHealthCheck(kq, "orders", 0).Check(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewKafkaQueueGroupVersion(t *testing.T) {
+	kq, err := NewKafkaQueue(&KafkaConfig{Addresses: []string{"127.0.0.1:1"}, GroupID: "workers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !kq.config.Version.IsAtLeast(sarama.V0_10_2_0) || kq.config.Consumer.Offsets.Initial != sarama.OffsetNewest {
+		t.Fatalf("Version = %s, Initial = %d", kq.config.Version, kq.config.Consumer.Offsets.Initial)
+	}
+}
+
+func TestIsKafkaConnError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{sarama.ErrOutOfBrokers, true},
+		{sarama.ErrClosedClient, true},
+		{sarama.ErrNotConnected, true},
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{sarama.ErrMessageSizeTooLarge, false},
+		{errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := isKafkaConnError(tt.err); got != tt.want {
+			t.Errorf("isKafkaConnError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// waitConn 等待连接满足want
+func waitConn(t *testing.T, kq *KafkaQueue, want func(*kafkaConn) bool) *kafkaConn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		kq.connMu.Lock()
+		c := kq.conn
+		kq.connMu.Unlock()
+		if want(c) {
+			return c
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("connection not in wanted state")
+	return nil
+}
+
+func TestKafkaPushReconnect(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	setProduceResponses(t, broker)
+	addr := broker.Addr()
+	kq, err := NewKafkaQueue(&KafkaConfig{Addresses: []string{addr}, Version: "2.1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kq.Close()
+	kq.config.Producer.Retry.Backoff = time.Millisecond
+	kq.config.Metadata.Retry.Backoff = time.Millisecond
+
+	if err := kq.PushWithKey("orders", keyFor(t, 0), "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// broker断开后发送失败，连接被摘下
+	broker.Close()
+	if err := kq.PushWithKey("orders", keyFor(t, 0), "v"); err == nil {
+		t.Fatal("PushWithKey() should fail after broker closed")
+	}
+	waitConn(t, kq, func(c *kafkaConn) bool { return c == nil })
+
+	// broker恢复后重新连接
+	broker = sarama.NewMockBrokerAddr(t, 1, addr)
+	defer broker.Close()
+	setProduceResponses(t, broker)
+	if err := kq.PushWithKey("orders", keyFor(t, 0), "v"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafkaRunReconnect(t *testing.T) {
+	broker := newTestKafkaBroker(t)
+	responses := testKafkaResponses(t, broker)
+	// 分区消费者还会查询最旧的offset
+	offsets := sarama.NewMockOffsetResponse(t).SetVersion(1)
+	for partition, newest := range []int64{100, 50, 10} {
+		offsets.SetOffset("orders", int32(partition), sarama.OffsetNewest, newest)
+		offsets.SetOffset("orders", int32(partition), sarama.OffsetOldest, 0)
+	}
+	responses["OffsetRequest"] = offsets
+	responses["FetchRequest"] = sarama.NewMockFetchResponse(t, 1)
+	broker.SetHandlerByMap(responses)
+
+	kq, err := NewKafkaQueue(&KafkaConfig{Addresses: []string{broker.Addr()}, Version: "2.1.0", ReconnectInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kq.Close()
+	kq.RegisterHandler("orders", func(string, string) {})
+	kq.Run()
+
+	old := waitConn(t, kq, func(c *kafkaConn) bool { return c != nil })
+	pcs := func() int {
+		kq.mu.Lock()
+		defer kq.mu.Unlock()
+		return len(kq.pcs)
+	}
+	if n := pcs(); n != 3 {
+		t.Fatalf("partition consumers = %d", n)
+	}
+
+	// 连接断开后关闭旧连接，后台重连并重新启动消费
+	kq.reset(old, sarama.ErrOutOfBrokers)
+	waitConn(t, kq, func(c *kafkaConn) bool { return c != nil && c != old })
+	deadline := time.Now().Add(5 * time.Second)
+	for pcs() != 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := pcs(); n != 3 {
+		t.Fatalf("partition consumers after reconnect = %d", n)
+	}
+	// 已经摘下的连接不重复处理
+	kq.reset(old, sarama.ErrOutOfBrokers)
+}
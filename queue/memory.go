@@ -0,0 +1,384 @@
+package queue
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+)
+
+type MemoryConfig struct {
+	// 同步投递：Push时直接在调用方goroutine里执行handler，投递顺序完全确定，适合单元测试
+	Sync bool
+	// handler失败（返回错误或panic）后的重试次数，默认3，小于0不重试，重试耗尽后进入死信，和RedisQueue、KafkaQueue一致
+	MaxRetries int
+	// 重试间隔，默认1秒，同步投递时忽略
+	RetryDelay time.Duration
+}
+
+// MemoryQueue 基于内存的队列，用于单元测试和单进程场景
+// handler返回错误或panic视为消费失败，按retries重试，仍失败则进入死信
+type MemoryQueue struct {
+	cfg        MemoryConfig
+	retries    int
+	retryDelay time.Duration
+
+	mu      sync.Mutex
+	topics  map[string]*memoryTopic
+	busy    int //延迟中和处理中的消息数
+	running bool
+	metrics *Metrics
+
+	closed chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+type memoryTopic struct {
+	handler  HandlerE
+	pending  []*memoryMessage
+	dead     []string
+	failures int //注入的失败次数
+	wake     chan struct{}
+}
+
+type memoryMessage struct {
+	value    string
+	attempts int
+}
+
+func NewMemoryQueue(cfg *MemoryConfig) *MemoryQueue {
+	mq := &MemoryQueue{}
+	if cfg != nil {
+		mq.cfg = *cfg
+	}
+	mq.retries, mq.retryDelay = retryConfig(mq.cfg.MaxRetries, mq.cfg.RetryDelay)
+	mq.topics = make(map[string]*memoryTopic)
+	mq.closed = make(chan struct{})
+	mq.metrics = NewMetrics(nil)
+
+	return mq
+}
+
+func (mq *MemoryQueue) topic(name string) *memoryTopic {
+	t, ok := mq.topics[name]
+	if !ok {
+		t = &memoryTopic{
+			wake: make(chan struct{}, 1),
+		}
+		mq.topics[name] = t
+	}
+	return t
+}
+
+func (mq *MemoryQueue) Push(name string, value string) error {
+	select {
+	case <-mq.closed:
+		return fmt.Errorf("memory queue %s closed", name)
+	default:
+	}
+
+	if mq.cfg.Sync {
+		mq.mu.Lock()
+		t := mq.topic(name)
+		if !mq.running || t.handler == nil {
+			t.pending = append(t.pending, &memoryMessage{value: value})
+			mq.mu.Unlock()
+			return nil
+		}
+		mq.mu.Unlock()
+
+		mq.deliverSync(name, t, &memoryMessage{value: value})
+		return nil
+	}
+
+	mq.enqueue(name, &memoryMessage{value: value})
+	return nil
+}
+
+// PushDelay 延迟delay后才能被消费
+func (mq *MemoryQueue) PushDelay(name string, value string, delay time.Duration) error {
+	if delay <= 0 || mq.cfg.Sync {
+		return mq.Push(name, value)
+	}
+
+	mq.mu.Lock()
+	mq.busy++
+	mq.mu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		mq.enqueue(name, &memoryMessage{value: value})
+		mq.done()
+	})
+	return nil
+}
+
+func (mq *MemoryQueue) enqueue(name string, msg *memoryMessage) {
+	mq.mu.Lock()
+	t := mq.topic(name)
+	t.pending = append(t.pending, msg)
+	mq.mu.Unlock()
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (mq *MemoryQueue) done() {
+	mq.mu.Lock()
+	mq.busy--
+	mq.mu.Unlock()
+}
+
+func (mq *MemoryQueue) RegisterHandler(name string, handler func(string, string)) {
+	mq.RegisterHandlerE(name, handlerE(handler))
+}
+
+func (mq *MemoryQueue) RegisterHandlerE(name string, handler HandlerE) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.topic(name).handler = handler
+}
+
+func (mq *MemoryQueue) Run() {
+	mq.mu.Lock()
+	mq.running = true
+	names := make([]string, 0, len(mq.topics))
+	for name, t := range mq.topics {
+		if t.handler != nil {
+			names = append(names, name)
+		}
+	}
+	mq.mu.Unlock()
+
+	for _, name := range names {
+		mq.runHandler(name)
+	}
+}
+
+func (mq *MemoryQueue) runHandler(name string) {
+	mq.mu.Lock()
+	t := mq.topics[name]
+	mq.mu.Unlock()
+
+	if mq.cfg.Sync {
+		// 把Run之前积压的消息按顺序投递掉
+		for {
+			msg := mq.pop(t)
+			if msg == nil {
+				return
+			}
+			mq.deliverSync(name, t, msg)
+			mq.done()
+		}
+	}
+
+	mq.wg.Add(1)
+	go func() {
+		defer mq.wg.Done()
+		for {
+			msg := mq.pop(t)
+			if msg == nil {
+				select {
+				case <-t.wake:
+					continue
+				case <-mq.closed:
+					return
+				}
+			}
+
+			if !mq.handle(name, t, msg) {
+				mq.retry(name, t, msg)
+			}
+			mq.done()
+		}
+	}()
+}
+
+// pop 取出队首消息并计入处理中
+func (mq *MemoryQueue) pop(t *memoryTopic) *memoryMessage {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if len(t.pending) == 0 {
+		return nil
+	}
+	msg := t.pending[0]
+	t.pending = t.pending[1:]
+	mq.busy++
+	return msg
+}
+
+func (mq *MemoryQueue) deliverSync(name string, t *memoryTopic, msg *memoryMessage) {
+	for !mq.handle(name, t, msg) {
+		msg.attempts++
+		if msg.attempts > mq.retries {
+			mq.deadLetter(t, msg)
+			return
+		}
+	}
+}
+
+// handle 执行handler，注入的失败或panic都返回false
+func (mq *MemoryQueue) handle(name string, t *memoryTopic, msg *memoryMessage) bool {
+	mq.mu.Lock()
+	if t.failures > 0 {
+		t.failures--
+		mq.mu.Unlock()
+		return false
+	}
+	handler := t.handler
+	mq.mu.Unlock()
+
+	done := mq.metrics.Begin(name)
+	err := callHandler(handler, name, msg.value)
+	done()
+	if err != nil {
+		clog.Errorf("memory queue %s handle err: %v", name, err)
+		return false
+	}
+	return true
+}
+
+func (mq *MemoryQueue) retry(name string, t *memoryTopic, msg *memoryMessage) {
+	msg.attempts++
+	if msg.attempts > mq.retries {
+		mq.deadLetter(t, msg)
+		return
+	}
+
+	mq.mu.Lock()
+	mq.busy++
+	mq.mu.Unlock()
+	time.AfterFunc(mq.retryDelay, func() {
+		mq.enqueue(name, msg)
+		mq.done()
+	})
+}
+
+func (mq *MemoryQueue) deadLetter(t *memoryTopic, msg *memoryMessage) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	t.dead = append(t.dead, msg.value)
+}
+
+// Pending 返回还未被消费的消息，不包含延迟中的消息
+func (mq *MemoryQueue) Pending(name string) []string {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	t, ok := mq.topics[name]
+	if !ok {
+		return nil
+	}
+
+	values := make([]string, 0, len(t.pending))
+	for _, msg := range t.pending {
+		values = append(values, msg.value)
+	}
+	return values
+}
+
+// DeadLetters 返回重试耗尽的消息
+func (mq *MemoryQueue) DeadLetters(name string) []string {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	t, ok := mq.topics[name]
+	if !ok {
+		return nil
+	}
+	return append([]string(nil), t.dead...)
+}
+
+// DeadLetter 直接放入死信
+func (mq *MemoryQueue) DeadLetter(name string, value string) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	t := mq.topic(name)
+	t.dead = append(t.dead, value)
+	return nil
+}
+
+// InjectFailures 接下来n次投递直接判定为失败，不调用handler
+func (mq *MemoryQueue) InjectFailures(name string, n int) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.topic(name).failures += n
+}
+
+// Names 已注册handler的队列
+func (mq *MemoryQueue) Names() []string {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	names := make([]string, 0, len(mq.topics))
+	for name, t := range mq.topics {
+		if t.handler != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (mq *MemoryQueue) Metrics() *Metrics {
+	return mq.metrics
+}
+
+func (mq *MemoryQueue) Stats(name string) (*Stats, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	s := &Stats{
+		Name:     name,
+		InFlight: mq.metrics.InFlight(name),
+	}
+	if t, ok := mq.topics[name]; ok {
+		s.Pending = int64(len(t.pending))
+		s.DeadLetter = int64(len(t.dead))
+	}
+	return s, nil
+}
+
+// WaitDrained 等待所有已注册handler的队列消费完，包括延迟和重试中的消息
+// 超时返回false
+func (mq *MemoryQueue) WaitDrained(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if mq.drained() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (mq *MemoryQueue) drained() bool {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if mq.busy > 0 {
+		return false
+	}
+	for _, t := range mq.topics {
+		if t.handler != nil && len(t.pending) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (mq *MemoryQueue) Close() {
+	mq.once.Do(func() {
+		close(mq.closed)
+	})
+	mq.wg.Wait()
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder 记录handler收到的消息
+type recorder struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func (r *recorder) handle(name string, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values = append(r.values, value)
+}
+
+func (r *recorder) handleE(name string, value string) error {
+	r.handle(name, value)
+	return nil
+}
+
+func (r *recorder) got() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.values...)
+}
+
+func TestMemoryQueueSync(t *testing.T) {
+	mq := NewMemoryQueue(&MemoryConfig{Sync: true})
+	defer mq.Close()
+
+	r := &recorder{}
+	mq.RegisterHandler("q", r.handle)
+	mq.Push("q", "a")
+	mq.Push("q", "b")
+	if got := mq.Pending("q"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("Pending() before Run = %v", got)
+	}
+
+	mq.Run()
+	if got := r.got(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("after Run got %v", got)
+	}
+
+	//Run之后Push直接在调用方投递
+	mq.Push("q", "c")
+	mq.PushDelay("q", "d", time.Hour)
+	if got := r.got(); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("got %v", got)
+	}
+	if got := mq.Pending("q"); len(got) != 0 {
+		t.Fatalf("Pending() = %v", got)
+	}
+}
+
+func TestMemoryQueueSyncFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		inject     int
+		handler    func(*recorder) HandlerE
+		wantCalls  int
+		wantDead   []string
+	}{
+		{"injected failure retried", 1, 1, func(r *recorder) HandlerE { return r.handleE }, 1, nil},
+		{"injected failures exhaust retries", 1, 2, func(r *recorder) HandlerE { return r.handleE }, 0, []string{"m"}},
+		{"default retries", 0, 3, func(r *recorder) HandlerE { return r.handleE }, 1, nil},
+		{"default retries exhausted", 0, 4, func(r *recorder) HandlerE { return r.handleE }, 0, []string{"m"}},
+		{"no retries", -1, 1, func(r *recorder) HandlerE { return r.handleE }, 0, []string{"m"}},
+		{"error", 2, 0, func(r *recorder) HandlerE {
+			return func(name string, value string) error {
+				r.handle(name, value)
+				return errors.New("boom")
+			}
+		}, 3, []string{"m"}},
+		{"panic", 1, 0, func(r *recorder) HandlerE {
+			return func(name string, value string) error {
+				r.handle(name, value)
+				panic("boom")
+			}
+		}, 2, []string{"m"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mq := NewMemoryQueue(&MemoryConfig{Sync: true, MaxRetries: tt.maxRetries})
+			defer mq.Close()
+
+			r := &recorder{}
+			mq.RegisterHandlerE("q", tt.handler(r))
+			mq.Run()
+			mq.InjectFailures("q", tt.inject)
+			mq.Push("q", "m")
+
+			if got := len(r.got()); got != tt.wantCalls {
+				t.Fatalf("handler calls = %d, want %d", got, tt.wantCalls)
+			}
+			if got := mq.DeadLetters("q"); !reflect.DeepEqual(got, tt.wantDead) {
+				t.Fatalf("DeadLetters() = %v, want %v", got, tt.wantDead)
+			}
+			s, _ := mq.Stats("q")
+			if s.DeadLetter != int64(len(tt.wantDead)) {
+				t.Fatalf("Stats().DeadLetter = %d", s.DeadLetter)
+			}
+		})
+	}
+}
+
+func TestMemoryQueueAsync(t *testing.T) {
+	mq := NewMemoryQueue(&MemoryConfig{MaxRetries: 2, RetryDelay: 5 * time.Millisecond})
+	defer mq.Close()
+
+	r := &recorder{}
+	mq.RegisterHandler("q", r.handle)
+	mq.Run()
+
+	mq.InjectFailures("q", 2)
+	mq.Push("q", "a")
+	mq.PushDelay("q", "b", 20*time.Millisecond)
+	if !mq.WaitDrained(time.Second) {
+		t.Fatal("WaitDrained() timed out")
+	}
+	if got := r.got(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("got %v", got)
+	}
+	if got := mq.DeadLetters("q"); len(got) != 0 {
+		t.Fatalf("DeadLetters() = %v", got)
+	}
+
+	mq.InjectFailures("q", 3)
+	mq.Push("q", "c")
+	if !mq.WaitDrained(time.Second) {
+		t.Fatal("WaitDrained() timed out")
+	}
+	if got := mq.DeadLetters("q"); !reflect.DeepEqual(got, []string{"c"}) {
+		t.Fatalf("DeadLetters() = %v", got)
+	}
+}
+
+func TestMemoryQueueWaitDrainedTimeout(t *testing.T) {
+	mq := NewMemoryQueue(nil)
+	defer mq.Close()
+
+	release := make(chan struct{})
+	mq.RegisterHandler("q", func(string, string) { <-release })
+	mq.Run()
+	mq.Push("q", "a")
+
+	if mq.WaitDrained(10 * time.Millisecond) {
+		t.Fatal("WaitDrained() = true while handler is blocked")
+	}
+	close(release)
+	if !mq.WaitDrained(time.Second) {
+		t.Fatal("WaitDrained() timed out")
+	}
+}
+
+func TestMemoryQueueClosed(t *testing.T) {
+	mq := NewMemoryQueue(nil)
+	mq.Close()
+	if err := mq.Push("q", "a"); err == nil {
+		t.Fatal("Push() after Close should fail")
+	}
+}
@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// MessageVersion 信封格式版本，解码时只把带该标记的json当作信封
+const MessageVersion = 1
+
+// Message 队列消息信封，带唯一ID和header，用于去重和上下文传递
+// 编码为json后作为Push的value
+type Message struct {
+	// V 信封标记，Encode时设置为MessageVersion
+	V       int               `json:"v"`
+	ID      string            `json:"id"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+
+	raw string //handler收到的原始value
+}
+
+// NewMessage 生成带随机ID的消息
+func NewMessage(body string) *Message {
+	return &Message{
+		ID:   NewMessageID(),
+		Body: body,
+	}
+}
+
+// NewMessageID 生成32位16进制的随机ID
+func NewMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Encode 编码为Push使用的value
+func (m *Message) Encode() string {
+	m.V = MessageVersion
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+// DecodeMessage 解码handler收到的value
+// 不是信封格式的value原样作为Body，ID为空；带id字段的普通json没有v标记，不会被当作信封
+func DecodeMessage(value string) *Message {
+	m := &Message{}
+	if err := json.Unmarshal([]byte(value), m); err != nil || m.V != MessageVersion || m.ID == "" {
+		return &Message{Body: value, raw: value}
+	}
+	m.raw = value
+	return m
+}
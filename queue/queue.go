@@ -1,7 +1,87 @@
 package queue
 
+import (
+	"fmt"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+)
+
 type Queue interface {
 	Push(string, string) error
 	Run()
 	Close()
 }
+
+// HandlerE 返回错误的handler，返回错误表示处理失败
+type HandlerE func(string, string) error
+
+// HandlerQueue 可以注册handler的队列
+// HandlerE返回错误或handler panic表示处理失败，队列会重新投递，重试耗尽后进入死信
+type HandlerQueue interface {
+	Queue
+	RegisterHandler(string, func(string, string))
+	RegisterHandlerE(string, HandlerE)
+}
+
+// DefaultMaxRetries handler失败后默认的重试次数
+const DefaultMaxRetries = 3
+
+// retryConfig 配置的重试次数和间隔，次数为0时使用默认值，小于0不重试
+func retryConfig(maxRetries int, delay time.Duration) (int, time.Duration) {
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+	if delay <= 0 {
+		delay = time.Second
+	}
+	return maxRetries, delay
+}
+
+// handlerE 把不返回错误的handler转为HandlerE
+func handlerE(handler func(string, string)) HandlerE {
+	return func(name string, value string) error {
+		handler(name, value)
+		return nil
+	}
+}
+
+// callHandler 执行handler，panic转为错误
+func callHandler(handler HandlerE, name string, value string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+
+	return handler(name, value)
+}
+
+// handleWithRetry 执行handler，失败时间隔delay重试retries次，仍失败或队列关闭时放入死信
+func handleWithRetry(q Queue, metrics *Metrics, name string, value string, handler HandlerE,
+	retries int, delay time.Duration, closed <-chan struct{}) {
+	for attempt := 0; ; attempt++ {
+		done := metrics.Begin(name)
+		err := callHandler(handler, name, value)
+		done()
+		if err == nil {
+			return
+		}
+
+		clog.Errorf("queue %s handle err (attempt %d): %v", name, attempt+1, err)
+		if attempt < retries {
+			select {
+			case <-closed:
+			case <-time.After(delay):
+				continue
+			}
+		}
+
+		if err := DeadLetter(q, name, value); err != nil {
+			clog.Errorf("queue %s dead letter err: %v", name, err)
+		}
+		return
+	}
+}
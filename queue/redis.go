@@ -1,6 +1,8 @@
 package queue
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -11,15 +13,50 @@ type RedisConfig struct {
 	Host     string
 	Password string
 	Db       int
+	// 连接断开后的重连间隔，默认1秒
+	ReconnectInterval time.Duration
+	// handler失败（返回错误或panic）后的重试次数，默认3，小于0不重试，重试耗尽后进入死信
+	MaxRetries int
+	// 重试间隔，默认1秒
+	RetryDelay time.Duration
 }
 
+// RedisQueue 连接池是懒加载的，消费连接断开后按ReconnectInterval重连
 type RedisQueue struct {
-	pool     *redis.Pool
-	handlers map[string]func(string, string)
+	pool       *redis.Pool
+	handlers   map[string]HandlerE
+	priorities map[string]*PriorityConfig
+	metrics    *Metrics
+	reconnect  time.Duration
+	retries    int
+	retryDelay time.Duration
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewRedisQueue(cfg *RedisConfig) (*RedisQueue, error) {
+	if cfg == nil || cfg.Host == "" {
+		return nil, errors.New("redis host is empty")
+	}
+
+	rq := &RedisQueue{}
+	rq.pool = newRedisPool(cfg)
+	rq.handlers = make(map[string]HandlerE)
+	rq.priorities = make(map[string]*PriorityConfig)
+	rq.metrics = NewMetrics(nil)
+	rq.reconnect = time.Second
+	if cfg.ReconnectInterval > 0 {
+		rq.reconnect = cfg.ReconnectInterval
+	}
+	rq.retries, rq.retryDelay = retryConfig(cfg.MaxRetries, cfg.RetryDelay)
+	rq.closed = make(chan struct{})
+
+	return rq, nil
 }
 
-func NewRedisQueue(cfg *RedisConfig) *RedisQueue {
-	pool := &redis.Pool{
+func newRedisPool(cfg *RedisConfig) *redis.Pool {
+	return &redis.Pool{
 		MaxIdle:     25,
 		MaxActive:   500,
 		IdleTimeout: time.Duration(time.Second * 360),
@@ -41,13 +78,15 @@ func NewRedisQueue(cfg *RedisConfig) *RedisQueue {
 			}
 			return c, nil
 		},
+		// 空闲超过1分钟的连接借出前先ping，剔除已断开的连接
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
 	}
-
-	rq := &RedisQueue{}
-	rq.pool = pool
-	rq.handlers = make(map[string]func(string, string))
-
-	return rq
 }
 
 func (rq *RedisQueue) Push(name string, value string) error {
@@ -59,6 +98,10 @@ func (rq *RedisQueue) Push(name string, value string) error {
 }
 
 func (rq *RedisQueue) RegisterHandler(name string, handler func(string, string)) {
+	rq.RegisterHandlerE(name, handlerE(handler))
+}
+
+func (rq *RedisQueue) RegisterHandlerE(name string, handler HandlerE) {
 	rq.handlers[name] = handler
 }
 
@@ -72,24 +115,79 @@ func (rq *RedisQueue) runHandler(name string) {
 	go func(name string) {
 		clog.Info(name)
 		conn := rq.pool.Get()
-		defer conn.Close()
+		defer func() {
+			conn.Close()
+		}()
 		for {
-			res, err := redis.String(conn.Do("LPOP", name))
+			select {
+			case <-rq.closed:
+				return
+			default:
+			}
+
+			// 按优先级顺序阻塞读取，超时1秒
+			args := append(rq.keys(name), 1)
+			reply, err := redis.Strings(conn.Do("BLPOP", args...))
 			if err != nil {
-				if err == redis.ErrNil {
-					time.Sleep(time.Second * 1)
-				} else {
+				if err != redis.ErrNil {
+					// 连接出错后换一个新连接，避免在坏连接上空转
 					clog.Error(err)
+					conn.Close()
+					time.Sleep(rq.reconnect)
+					conn = rq.pool.Get()
 				}
 				continue
 			}
 
-			rq.handlers[name](name, res)
+			handleWithRetry(rq, rq.metrics, name, reply[1], rq.handlers[name], rq.retries, rq.retryDelay, rq.closed)
 		}
 	}(name)
 }
 
+// Names 已注册handler的队列
+func (rq *RedisQueue) Names() []string {
+	names := make([]string, 0, len(rq.handlers))
+	for name := range rq.handlers {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (rq *RedisQueue) Metrics() *Metrics {
+	return rq.metrics
+}
+
+// Stats 待消费数为各优先级list长度之和，死信数为死信list长度
+func (rq *RedisQueue) Stats(name string) (*Stats, error) {
+	conn := rq.pool.Get()
+	defer conn.Close()
+
+	var pending int64
+	for _, key := range rq.allKeys(name) {
+		n, err := redis.Int64(conn.Do("LLEN", key))
+		if err != nil {
+			return nil, err
+		}
+		pending += n
+	}
+	dead, err := redis.Int64(conn.Do("LLEN", name+DeadLetterSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stats{
+		Name:       name,
+		Pending:    pending,
+		InFlight:   rq.metrics.InFlight(name),
+		DeadLetter: dead,
+	}, nil
+}
+
 func (rq *RedisQueue) Close() {
+	rq.closeOnce.Do(func() {
+		close(rq.closed)
+	})
+
 	if rq.pool != nil {
 		rq.pool.Close()
 	}
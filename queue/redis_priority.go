@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// PriorityConfig 队列的优先级，Levels从高到低
+type PriorityConfig struct {
+	Levels []string
+	// 防饥饿权重，与Levels一一对应，为空时严格按优先级消费
+	// 每次取消息先按权重随机选一个起始优先级，从它往低找，都为空再找更高的
+	Weights []int
+}
+
+// SetPriority 设置队列的优先级，需在Run之前调用
+// 每个优先级存为独立的list：name:level，不带优先级Push的消息优先级最低
+func (rq *RedisQueue) SetPriority(name string, cfg *PriorityConfig) error {
+	if cfg == nil || len(cfg.Levels) == 0 {
+		delete(rq.priorities, name)
+		return nil
+	}
+	if len(cfg.Weights) != 0 && len(cfg.Weights) != len(cfg.Levels) {
+		return fmt.Errorf("queue %s priority weights not match levels", name)
+	}
+	for _, w := range cfg.Weights {
+		if w < 0 {
+			return fmt.Errorf("queue %s priority weight must not be negative", name)
+		}
+	}
+
+	rq.priorities[name] = cfg
+	return nil
+}
+
+// PushPriority 按优先级发送
+func (rq *RedisQueue) PushPriority(name string, level string, value string) error {
+	cfg, ok := rq.priorities[name]
+	if !ok {
+		return fmt.Errorf("queue %s has no priority", name)
+	}
+	for _, l := range cfg.Levels {
+		if l == level {
+			return rq.Push(priorityKey(name, level), value)
+		}
+	}
+	return fmt.Errorf("queue %s priority %s not found", name, level)
+}
+
+func priorityKey(name string, level string) string {
+	return name + ":" + level
+}
+
+// keys 本次取消息时BLPOP的key顺序
+func (rq *RedisQueue) keys(name string) []interface{} {
+	cfg, ok := rq.priorities[name]
+	if !ok {
+		return []interface{}{name}
+	}
+
+	start := pickWeighted(cfg.Weights)
+	keys := make([]interface{}, 0, len(cfg.Levels)+1)
+	for _, level := range cfg.Levels[start:] {
+		keys = append(keys, priorityKey(name, level))
+	}
+	keys = append(keys, name)
+	for _, level := range cfg.Levels[:start] {
+		keys = append(keys, priorityKey(name, level))
+	}
+	return keys
+}
+
+// allKeys 队列所有优先级的key
+func (rq *RedisQueue) allKeys(name string) []string {
+	cfg, ok := rq.priorities[name]
+	if !ok {
+		return []string{name}
+	}
+
+	keys := make([]string, 0, len(cfg.Levels)+1)
+	for _, level := range cfg.Levels {
+		keys = append(keys, priorityKey(name, level))
+	}
+	return append(keys, name)
+}
+
+// pickWeighted 按权重随机选一个下标，权重为空时返回0
+func pickWeighted(weights []int) int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	if total == 0 {
+		return 0
+	}
+
+	n := rand.Intn(total)
+	for i, w := range weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return 0
+}
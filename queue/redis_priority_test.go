@@ -0,0 +1,115 @@
+package queue
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestRedisQueue(t *testing.T, host string) *RedisQueue {
+	rq, err := NewRedisQueue(&RedisConfig{Host: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rq.Close)
+	return rq
+}
+
+func TestSetPriorityInvalid(t *testing.T) {
+	rq := newTestRedisQueue(t, "127.0.0.1:1")
+
+	tests := []struct {
+		name string
+		cfg  *PriorityConfig
+	}{
+		{"weights not match levels", &PriorityConfig{Levels: []string{"high", "low"}, Weights: []int{1}}},
+		{"negative weight", &PriorityConfig{Levels: []string{"high", "low"}, Weights: []int{1, -1}}},
+	}
+	for _, tt := range tests {
+		if err := rq.SetPriority("q", tt.cfg); err == nil {
+			t.Fatalf("%s: expected error", tt.name)
+		}
+	}
+
+	if err := rq.SetPriority("q", &PriorityConfig{Levels: []string{"high"}}); err != nil {
+		t.Fatal(err)
+	}
+	//nil取消优先级
+	if err := rq.SetPriority("q", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := rq.allKeys("q"); !reflect.DeepEqual(got, []string{"q"}) {
+		t.Fatalf("allKeys() = %v", got)
+	}
+}
+
+func TestPriorityKeys(t *testing.T) {
+	rq := newTestRedisQueue(t, "127.0.0.1:1")
+
+	if got := rq.keys("plain"); !reflect.DeepEqual(got, []interface{}{"plain"}) {
+		t.Fatalf("keys() without priority = %v", got)
+	}
+
+	tests := []struct {
+		name    string
+		weights []int
+		want    []interface{}
+	}{
+		{"strict", nil, []interface{}{"q:high", "q:mid", "q:low", "q"}},
+		{"start at mid", []int{0, 1, 0}, []interface{}{"q:mid", "q:low", "q", "q:high"}},
+		{"start at low", []int{0, 0, 5}, []interface{}{"q:low", "q", "q:high", "q:mid"}},
+	}
+	for _, tt := range tests {
+		cfg := &PriorityConfig{Levels: []string{"high", "mid", "low"}, Weights: tt.weights}
+		if err := rq.SetPriority("q", cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got := rq.keys("q"); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("%s: keys() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := rq.allKeys("q"); !reflect.DeepEqual(got, []string{"q:high", "q:mid", "q:low", "q"}) {
+		t.Fatalf("allKeys() = %v", got)
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	if i := pickWeighted(nil); i != 0 {
+		t.Fatalf("pickWeighted(nil) = %d", i)
+	}
+	if i := pickWeighted([]int{0, 0}); i != 0 {
+		t.Fatalf("pickWeighted(zero) = %d", i)
+	}
+
+	const n = 10000
+	counts := make([]int, 3)
+	for i := 0; i < n; i++ {
+		counts[pickWeighted([]int{6, 3, 1})]++
+	}
+	//按权重6:3:1分布，允许2%的偏差
+	for i, want := range []float64{0.6, 0.3, 0.1} {
+		if got := float64(counts[i]) / n; got < want-0.02 || got > want+0.02 {
+			t.Fatalf("level %d picked %.3f, want %.1f (%v)", i, got, want, counts)
+		}
+	}
+}
+
+func TestPushPriority(t *testing.T) {
+	server := newFakeRedis(t)
+	rq := newTestRedisQueue(t, server.addr())
+	if err := rq.SetPriority("q", &PriorityConfig{Levels: []string{"high", "low"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rq.PushPriority("q", "high", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.list("q:high"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("q:high = %v", got)
+	}
+	if err := rq.PushPriority("q", "urgent", "b"); err == nil {
+		t.Fatal("expected error for unknown level")
+	}
+	if err := rq.PushPriority("other", "high", "b"); err == nil {
+		t.Fatal("expected error for queue without priority")
+	}
+}
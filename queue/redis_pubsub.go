@@ -0,0 +1,207 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/yybirdcf/golib/clog"
+)
+
+// pubSubHealthCheck 订阅连接的心跳间隔，两个间隔内没有收到任何数据视为连接已断开
+const pubSubHealthCheck = 30 * time.Second
+
+// RedisPubSub 基于redis PUBLISH/SUBSCRIBE的广播，每个订阅的实例都会收到每条消息
+// 适合缓存失效、配置推送等场景；订阅断开期间的消息会丢失
+// 连接断开后按ReconnectInterval自动重连并重新订阅
+type RedisPubSub struct {
+	pool      *redis.Pool
+	handlers  map[string]HandlerE
+	patterns  map[string]HandlerE
+	metrics   *Metrics
+	reconnect time.Duration
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func NewRedisPubSub(cfg *RedisConfig) (*RedisPubSub, error) {
+	if cfg == nil || cfg.Host == "" {
+		return nil, errors.New("redis host is empty")
+	}
+
+	ps := &RedisPubSub{}
+	ps.pool = newRedisPool(cfg)
+	ps.handlers = make(map[string]HandlerE)
+	ps.patterns = make(map[string]HandlerE)
+	ps.metrics = NewMetrics(nil)
+	ps.reconnect = time.Second
+	if cfg.ReconnectInterval > 0 {
+		ps.reconnect = cfg.ReconnectInterval
+	}
+	ps.closed = make(chan struct{})
+
+	return ps, nil
+}
+
+// Push 广播到channel
+func (ps *RedisPubSub) Push(name string, value string) error {
+	conn := ps.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", name, value)
+	return err
+}
+
+// RegisterHandler 订阅channel
+func (ps *RedisPubSub) RegisterHandler(name string, handler func(string, string)) {
+	ps.RegisterHandlerE(name, handlerE(handler))
+}
+
+// RegisterHandlerE 订阅channel，广播消息不重投，handler返回的错误只记录日志
+func (ps *RedisPubSub) RegisterHandlerE(name string, handler HandlerE) {
+	ps.handlers[name] = handler
+}
+
+// RegisterPatternHandler 按模式订阅，如user.*，handler收到的name为实际的channel
+func (ps *RedisPubSub) RegisterPatternHandler(pattern string, handler func(string, string)) {
+	ps.RegisterPatternHandlerE(pattern, handlerE(handler))
+}
+
+// RegisterPatternHandlerE 按模式订阅，和RegisterHandlerE一样，handler返回的错误只记录日志
+func (ps *RedisPubSub) RegisterPatternHandlerE(pattern string, handler HandlerE) {
+	ps.patterns[pattern] = handler
+}
+
+func (ps *RedisPubSub) Run() {
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		for {
+			select {
+			case <-ps.closed:
+				return
+			default:
+			}
+
+			if err := ps.subscribe(); err != nil {
+				clog.Errorf("redis subscribe err: %v", err)
+			}
+
+			select {
+			case <-ps.closed:
+				return
+			case <-time.After(ps.reconnect):
+			}
+		}
+	}()
+}
+
+// subscribe 订阅所有channel和pattern，直到连接出错或Close后退订完成
+// 连接只在这里关闭，不和Receive、Ping并发
+func (ps *RedisPubSub) subscribe() error {
+	conn := ps.pool.Get()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if len(ps.handlers) > 0 {
+		channels := make([]interface{}, 0, len(ps.handlers))
+		for name := range ps.handlers {
+			channels = append(channels, name)
+		}
+		if err := psc.Subscribe(channels...); err != nil {
+			return err
+		}
+	}
+	if len(ps.patterns) > 0 {
+		patterns := make([]interface{}, 0, len(ps.patterns))
+		for pattern := range ps.patterns {
+			patterns = append(patterns, pattern)
+		}
+		if err := psc.PSubscribe(patterns...); err != nil {
+			return err
+		}
+	}
+
+	//订阅连接上只能发PING和退订，都由这个goroutine写：定时PING，半开的连接读超时后重连
+	//Close时退订所有channel和pattern，读循环收到退订确认后返回
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(pubSubHealthCheck)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ps.closed:
+				psc.Unsubscribe()
+				psc.PUnsubscribe()
+				return
+			case <-ticker.C:
+			}
+			if err := psc.Ping(""); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		switch v := psc.ReceiveWithTimeout(2 * pubSubHealthCheck).(type) {
+		case redis.Message:
+			handler, ok := ps.handlers[v.Channel]
+			if v.Pattern != "" {
+				handler, ok = ps.patterns[v.Pattern]
+			}
+			if !ok {
+				continue
+			}
+
+			// 广播消息不重投，失败只记录
+			done := ps.metrics.Begin(v.Channel)
+			if err := callHandler(handler, v.Channel, string(v.Data)); err != nil {
+				clog.Errorf("redis pubsub %s handle err: %v", v.Channel, err)
+			}
+			done()
+		case redis.Subscription:
+			if v.Count == 0 && ps.isClosed() {
+				return nil
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func (ps *RedisPubSub) Metrics() *Metrics {
+	return ps.metrics
+}
+
+func (ps *RedisPubSub) isClosed() bool {
+	select {
+	case <-ps.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close 通知订阅goroutine退订并关闭连接，等待它退出后返回
+// 连接已经半开时要等到读超时，最长2*pubSubHealthCheck
+func (ps *RedisPubSub) Close() {
+	ps.closeOnce.Do(func() {
+		close(ps.closed)
+	})
+	ps.wg.Wait()
+
+	if ps.pool != nil {
+		ps.pool.Close()
+	}
+}
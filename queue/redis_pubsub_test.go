@@ -0,0 +1,317 @@
+package queue
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis 只支持SELECT、RPUSH、PUBLISH和订阅相关命令的redis服务端
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	subs     map[*fakeRedisConn]bool
+	commands []string
+	lists    map[string][]string
+	//已经断开的订阅连接数
+	closedSubs int
+}
+
+type fakeRedisConn struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	channels []string
+	patterns []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{ln: ln, subs: make(map[*fakeRedisConn]bool), lists: make(map[string][]string)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedis) seen(command string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.commands {
+		if c == command {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *fakeRedis) list(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.lists[key]...)
+}
+
+func (s *fakeRedis) subscribers() (open int, closed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subs), s.closedSubs
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		//参数可能是二进制，如redigo归还订阅连接时ECHO的随机串，按长度读取
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func (c *fakeRedisConn) write(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w.WriteString(s)
+	c.w.Flush()
+}
+
+func (s *fakeRedis) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	c := &fakeRedisConn{w: bufio.NewWriter(nc)}
+	defer func() {
+		s.mu.Lock()
+		if s.subs[c] {
+			delete(s.subs, c)
+			s.closedSubs++
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+
+		switch cmd {
+		case "SELECT":
+			c.write("+OK\r\n")
+		case "RPUSH":
+			s.mu.Lock()
+			s.lists[args[1]] = append(s.lists[args[1]], args[2:]...)
+			n := len(s.lists[args[1]])
+			s.mu.Unlock()
+			c.write(fmt.Sprintf(":%d\r\n", n))
+		case "PUBLISH":
+			s.mu.Lock()
+			n := 0
+			for sub := range s.subs {
+				for _, ch := range sub.channels {
+					if ch == args[1] {
+						sub.write("*3\r\n" + bulk("message") + bulk(ch) + bulk(args[2]))
+						n++
+					}
+				}
+				for _, pattern := range sub.patterns {
+					if ok, _ := path.Match(pattern, args[1]); ok {
+						sub.write("*4\r\n" + bulk("pmessage") + bulk(pattern) + bulk(args[1]) + bulk(args[2]))
+						n++
+					}
+				}
+			}
+			s.mu.Unlock()
+			c.write(fmt.Sprintf(":%d\r\n", n))
+		case "SUBSCRIBE", "PSUBSCRIBE":
+			s.mu.Lock()
+			s.subs[c] = true
+			s.mu.Unlock()
+			for _, name := range args[1:] {
+				c.mu.Lock()
+				if cmd == "SUBSCRIBE" {
+					c.channels = append(c.channels, name)
+				} else {
+					c.patterns = append(c.patterns, name)
+				}
+				count := len(c.channels) + len(c.patterns)
+				c.mu.Unlock()
+				c.write(fmt.Sprintf("*3\r\n%s%s:%d\r\n", bulk(strings.ToLower(cmd)), bulk(name), count))
+			}
+		case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+			c.mu.Lock()
+			names := &c.channels
+			if cmd == "PUNSUBSCRIBE" {
+				names = &c.patterns
+			}
+			removed := *names
+			*names = nil
+			count := len(c.channels) + len(c.patterns)
+			c.mu.Unlock()
+			if len(removed) == 0 {
+				c.write(fmt.Sprintf("*3\r\n%s$-1\r\n:%d\r\n", bulk(strings.ToLower(cmd)), count))
+			}
+			for i, name := range removed {
+				c.write(fmt.Sprintf("*3\r\n%s%s:%d\r\n", bulk(strings.ToLower(cmd)), bulk(name), count+len(removed)-i-1))
+			}
+		case "ECHO":
+			c.write(bulk(args[1]))
+		case "PING":
+			c.write("*2\r\n" + bulk("pong") + bulk(""))
+		default:
+			c.write("-ERR unknown command\r\n")
+		}
+	}
+}
+
+func TestRedisPubSubCloseUnsubscribes(t *testing.T) {
+	server := newFakeRedis(t)
+	ps, err := NewRedisPubSub(&RedisConfig{Host: server.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 1)
+	ps.RegisterHandler("events", func(name string, value string) {
+		got <- value
+	})
+	ps.RegisterPatternHandler("user.*", func(string, string) {})
+	ps.Run()
+
+	deadline := time.Now().Add(time.Second)
+	for !server.seen("PSUBSCRIBE") || !server.seen("SUBSCRIBE") {
+		if time.Now().After(deadline) {
+			t.Fatal("not subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := ps.Push("events", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-got:
+		if v != "hello" {
+			t.Fatalf("got %q", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		ps.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() did not return after unsubscribe")
+	}
+
+	if !server.seen("UNSUBSCRIBE") || !server.seen("PUNSUBSCRIBE") {
+		t.Fatal("Close() did not unsubscribe")
+	}
+	//订阅连接由订阅goroutine归还，pool.Close后断开
+	deadline = time.Now().Add(time.Second)
+	for {
+		open, n := server.subscribers()
+		if open == 0 && n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscribers open %d closed %d", open, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRedisPubSubCloseBeforeRun(t *testing.T) {
+	ps, err := NewRedisPubSub(&RedisConfig{Host: "127.0.0.1:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.Close()
+}
+
+func TestRedisPubSubPatternHandlerE(t *testing.T) {
+	server := newFakeRedis(t)
+	ps, err := NewRedisPubSub(&RedisConfig{Host: server.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Close()
+
+	got := make(chan string, 2)
+	ps.RegisterPatternHandlerE("user.*", func(name string, value string) error {
+		got <- name + "=" + value
+		if value == "bad" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	ps.Run()
+
+	deadline := time.Now().Add(time.Second)
+	for !server.seen("PSUBSCRIBE") {
+		if time.Now().After(deadline) {
+			t.Fatal("not subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//handler收到实际的channel，返回错误后订阅继续
+	for _, v := range []string{"bad", "ok"} {
+		if err := ps.Push("user.1", v); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-got:
+			if msg != "user.1="+v {
+				t.Fatalf("got %q", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %q not delivered", v)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Package sqlstore 基于数据库表的消息去重记录，配合queue.Idempotent和IdempotentTx使用
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/yybirdcf/golib/clog"
+	"github.com/yybirdcf/golib/database"
+	"github.com/yybirdcf/golib/queue"
+)
+
+// TableSQL 去重表结构（mysql），%s为表名
+// processed_at为0表示处理中，lease_until为处理中租约的过期时间（unix纳秒）
+const TableSQL = `CREATE TABLE IF NOT EXISTS %s (
+	id VARCHAR(64) NOT NULL PRIMARY KEY,
+	processed_at BIGINT NOT NULL DEFAULT 0,
+	lease_until BIGINT NOT NULL DEFAULT 0
+)`
+
+// Store 基于数据库表的去重记录，可以和handler的写操作在同一个事务里
+// 处理中租约的token为lease_until，撤销时只删除自己的租约
+type Store struct {
+	db    *database.MRDB
+	table string
+	lease time.Duration
+}
+
+var _ queue.ProcessedStore = (*Store)(nil)
+
+// lease为处理中标记的租约，应大于handler的最长耗时
+func NewStore(db *database.MRDB, table string, lease time.Duration) *Store {
+	return &Store{
+		db:    db,
+		table: table,
+		lease: lease,
+	}
+}
+
+func (s *Store) insertSQL() string {
+	return fmt.Sprintf("INSERT IGNORE INTO %s (id, processed_at, lease_until) VALUES (?, ?, ?)", s.table)
+}
+
+func (s *Store) MarkProcessing(ctx context.Context, id string) (string, bool, error) {
+	now := time.Now()
+	leaseUntil := now.Add(s.lease).UnixNano()
+	token := strconv.FormatInt(leaseUntil, 10)
+	res, err := s.db.ExecContext(ctx, s.insertSQL(), id, 0, leaseUntil)
+	if err != nil {
+		return "", false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return token, n > 0, err
+	}
+
+	//已有记录时，只接管租约过期的处理中记录
+	res, err = s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET lease_until = ? WHERE id = ? AND processed_at = 0 AND lease_until < ?", s.table),
+		leaseUntil, id, now.UnixNano())
+	if err != nil {
+		return "", false, err
+	}
+	n, err := res.RowsAffected()
+	return token, n > 0, err
+}
+
+func (s *Store) MarkProcessed(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET processed_at = ? WHERE id = ?", s.table), time.Now().Unix(), id)
+	return err
+}
+
+// MarkProcessedTx 在tx中直接标记已处理，tx回滚时标记一起回滚，不需要处理中状态
+func (s *Store) MarkProcessedTx(ctx context.Context, tx *sql.Tx, id string) (bool, error) {
+	res, err := tx.ExecContext(ctx, s.insertSQL(), id, time.Now().Unix(), 0)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *Store) Unmark(ctx context.Context, id string, token string) error {
+	leaseUntil, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid lease token %q: %w", token, err)
+	}
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id = ? AND processed_at = 0 AND lease_until = ?", s.table), id, leaseUntil)
+	return err
+}
+
+// IdempotentTx 包装handler，标记已处理和handler的写操作在同一个主库事务里提交，用RegisterHandlerE注册
+// handler返回错误或panic时整个事务回滚，并交给队列重投
+func IdempotentTx(store *Store, handler func(*sql.Tx, string, *queue.Message) error) queue.HandlerE {
+	return func(name string, value string) error {
+		ctx := context.Background()
+		msg := queue.DecodeMessage(value)
+
+		tx, err := store.db.Begin()
+		if err != nil {
+			return fmt.Errorf("begin tx: %w", err)
+		}
+		defer tx.Rollback()
+
+		if msg.ID != "" {
+			ok, err := store.MarkProcessedTx(ctx, tx, msg.ID)
+			if err != nil {
+				return fmt.Errorf("mark %s processed: %w", msg.ID, err)
+			}
+			if !ok {
+				clog.Debugf("queue %s skip duplicate message %s", name, msg.ID)
+				return nil
+			}
+		}
+
+		if err := handler(tx, name, msg); err != nil {
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("commit %s: %w", msg.ID, err)
+		}
+		return nil
+	}
+}
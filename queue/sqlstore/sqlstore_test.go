@@ -0,0 +1,178 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yybirdcf/golib/database"
+	"github.com/yybirdcf/golib/internal/fakedb"
+	"github.com/yybirdcf/golib/queue"
+)
+
+func newStoreDB(t *testing.T) (*database.MRDB, *fakedb.Server) {
+	dsn, server := fakedb.NewServer(t, "db")
+	db, err := database.NewMRDB(&database.MRDBConfig{DN: fakedb.Driver, MasterDSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, server
+}
+
+// fakeTxState 只认识IdempotentTx和测试handler的语句，事务回滚时恢复Begin时的内容
+type fakeTxState struct {
+	mu        sync.Mutex
+	processed map[string]bool
+	orders    []string
+}
+
+func (s *fakeTxState) begin() (func() error, func() error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	savedProcessed := make(map[string]bool)
+	for id := range s.processed {
+		savedProcessed[id] = true
+	}
+	savedOrders := append([]string(nil), s.orders...)
+
+	rollback := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.processed = savedProcessed
+		s.orders = savedOrders
+		return nil
+	}
+	return func() error { return nil }, rollback
+}
+
+func (s *fakeTxState) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := args[0].(string)
+	switch {
+	case strings.HasPrefix(query, "INSERT IGNORE INTO processed "):
+		if s.processed[id] {
+			return driver.RowsAffected(0), nil
+		}
+		s.processed[id] = true
+	case strings.HasPrefix(query, "INSERT INTO orders "):
+		s.orders = append(s.orders, id)
+	default:
+		return nil, errors.New("unexpected exec: " + query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func TestIdempotentTxRollsBackMark(t *testing.T) {
+	state := &fakeTxState{processed: make(map[string]bool)}
+	db, server := newStoreDB(t)
+	server.SetHandlers(nil, state.exec)
+	server.SetBegin(state.begin)
+
+	calls := 0
+	mq := queue.NewMemoryQueue(&queue.MemoryConfig{Sync: true, MaxRetries: 2})
+	t.Cleanup(mq.Close)
+	mq.RegisterHandlerE("q", IdempotentTx(NewStore(db, "processed", time.Minute), func(tx *sql.Tx, name string, msg *queue.Message) error {
+		calls++
+		if _, err := tx.Exec("INSERT INTO orders (id) VALUES (?)", msg.Body); err != nil {
+			return err
+		}
+		if calls == 1 {
+			return errors.New("boom")
+		}
+		return nil
+	}))
+	mq.Run()
+
+	//第一次失败时业务写和已处理标记一起回滚，重投后只写入一次
+	msg := queue.NewMessage("order-1")
+	mq.Push("q", msg.Encode())
+	if calls != 2 {
+		t.Fatalf("handler calls = %d, want 2", calls)
+	}
+	if len(state.orders) != 1 || !state.processed[msg.ID] {
+		t.Fatalf("orders = %v, processed = %v", state.orders, state.processed)
+	}
+
+	mq.Push("q", msg.Encode())
+	if calls != 2 || len(state.orders) != 1 {
+		t.Fatalf("duplicate handled: calls = %d, orders = %v", calls, state.orders)
+	}
+}
+
+// fakeLeaseTable 只认识Store处理中租约相关的语句
+type fakeLeaseTable struct {
+	mu    sync.Mutex
+	lease map[string]int64
+}
+
+func (s *fakeLeaseTable) exec(ctx context.Context, query string, args []driver.Value) (driver.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "INSERT IGNORE INTO processed "):
+		id := args[0].(string)
+		if _, ok := s.lease[id]; ok {
+			return driver.RowsAffected(0), nil
+		}
+		s.lease[id] = args[2].(int64)
+	case strings.HasPrefix(query, "UPDATE processed SET lease_until "):
+		id := args[1].(string)
+		if s.lease[id] >= args[2].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		s.lease[id] = args[0].(int64)
+	case strings.HasPrefix(query, "DELETE FROM processed "):
+		id := args[0].(string)
+		if s.lease[id] != args[1].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		delete(s.lease, id)
+	default:
+		return nil, errors.New("unexpected exec: " + query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func TestUnmarkKeepsTakenOverLease(t *testing.T) {
+	table := &fakeLeaseTable{lease: make(map[string]int64)}
+	db, server := newStoreDB(t)
+	server.SetHandlers(nil, table.exec)
+	ctx := context.Background()
+
+	slow, ok, err := NewStore(db, "processed", -time.Second).MarkProcessing(ctx, "a")
+	if err != nil || !ok {
+		t.Fatalf("MarkProcessing() = %v, %v", ok, err)
+	}
+
+	//租约已过期，被另一个消费者接管，原消费者失败撤销时不能删除新的租约
+	store := NewStore(db, "processed", time.Minute)
+	owner, ok, err := store.MarkProcessing(ctx, "a")
+	if err != nil || !ok {
+		t.Fatalf("MarkProcessing() after lease = %v, %v", ok, err)
+	}
+	if err := store.Unmark(ctx, "a", slow); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.MarkProcessing(ctx, "a"); ok {
+		t.Fatal("MarkProcessing() while owner holds lease = true")
+	}
+
+	if err := store.Unmark(ctx, "a", owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := table.lease["a"]; ok {
+		t.Fatalf("lease = %v, want none after owner unmark", table.lease)
+	}
+	if err := store.Unmark(ctx, "a", "bad"); err == nil {
+		t.Fatal("Unmark() with invalid token should fail")
+	}
+}
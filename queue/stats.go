@@ -0,0 +1,201 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DeadLetterSuffix 死信队列名后缀，redis为list key，kafka为topic
+const DeadLetterSuffix = ".dead"
+
+// Stats 队列积压情况
+type Stats struct {
+	Name string
+	// 待消费的消息数，kafka为各分区lag之和
+	Pending int64
+	// handler正在处理的消息数
+	InFlight int64
+	// 死信队列中的消息数
+	DeadLetter int64
+	// kafka各分区的lag，高水位减去消费组已提交的offset
+	// 只有设置了KafkaConfig.GroupID才统计，没有消费组时不提交offset，为空
+	Lag map[int32]int64
+}
+
+// Inspector 可查询积压和消费指标的队列
+type Inspector interface {
+	Names() []string
+	Stats(string) (*Stats, error)
+	Metrics() *Metrics
+}
+
+// DefaultLatencyBuckets handler耗时直方图的默认分桶，单位秒
+var DefaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics handler吞吐和耗时统计
+type Metrics struct {
+	mu       sync.RWMutex
+	buckets  []float64
+	handlers map[string]*handlerMetrics
+}
+
+type handlerMetrics struct {
+	inFlight int64
+	count    int64
+	sumNanos int64
+	buckets  []int64
+}
+
+func NewMetrics(buckets []float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	return &Metrics{
+		buckets:  buckets,
+		handlers: make(map[string]*handlerMetrics),
+	}
+}
+
+func (m *Metrics) handler(name string) *handlerMetrics {
+	m.mu.RLock()
+	h, ok := m.handlers[name]
+	m.mu.RUnlock()
+	if ok {
+		return h
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok = m.handlers[name]; !ok {
+		h = &handlerMetrics{buckets: make([]int64, len(m.buckets))}
+		m.handlers[name] = h
+	}
+	return h
+}
+
+// Begin 开始处理一条消息，返回的函数在处理结束时调用
+func (m *Metrics) Begin(name string) func() {
+	h := m.handler(name)
+	atomic.AddInt64(&h.inFlight, 1)
+	start := time.Now()
+
+	return func() {
+		elapsed := time.Since(start)
+		atomic.AddInt64(&h.inFlight, -1)
+		atomic.AddInt64(&h.count, 1)
+		atomic.AddInt64(&h.sumNanos, int64(elapsed))
+		seconds := elapsed.Seconds()
+		for i, le := range m.buckets {
+			if seconds <= le {
+				atomic.AddInt64(&h.buckets[i], 1)
+			}
+		}
+	}
+}
+
+func (m *Metrics) InFlight(name string) int64 {
+	return atomic.LoadInt64(&m.handler(name).inFlight)
+}
+
+// WritePrometheus 以prometheus文本格式输出队列积压和handler指标
+func WritePrometheus(w io.Writer, q Inspector) error {
+	names := q.Names()
+	sort.Strings(names)
+
+	stats := make([]*Stats, 0, len(names))
+	for _, name := range names {
+		s, err := q.Stats(name)
+		if err != nil {
+			return err
+		}
+		stats = append(stats, s)
+	}
+
+	fmt.Fprintln(w, "# TYPE queue_pending gauge")
+	for _, s := range stats {
+		fmt.Fprintf(w, "queue_pending{queue=%q} %d\n", s.Name, s.Pending)
+	}
+	fmt.Fprintln(w, "# TYPE queue_in_flight gauge")
+	for _, s := range stats {
+		fmt.Fprintf(w, "queue_in_flight{queue=%q} %d\n", s.Name, s.InFlight)
+	}
+	fmt.Fprintln(w, "# TYPE queue_dead_letter gauge")
+	for _, s := range stats {
+		fmt.Fprintf(w, "queue_dead_letter{queue=%q} %d\n", s.Name, s.DeadLetter)
+	}
+	fmt.Fprintln(w, "# TYPE queue_partition_lag gauge")
+	for _, s := range stats {
+		partitions := make([]int, 0, len(s.Lag))
+		for p := range s.Lag {
+			partitions = append(partitions, int(p))
+		}
+		sort.Ints(partitions)
+		for _, p := range partitions {
+			fmt.Fprintf(w, "queue_partition_lag{queue=%q,partition=\"%d\"} %d\n", s.Name, p, s.Lag[int32(p)])
+		}
+	}
+
+	m := q.Metrics()
+	fmt.Fprintln(w, "# TYPE queue_handle_seconds histogram")
+	for _, name := range names {
+		h := m.handler(name)
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "queue_handle_seconds_bucket{queue=%q,le=%q} %d\n", name, strconv.FormatFloat(le, 'g', -1, 64), atomic.LoadInt64(&h.buckets[i]))
+		}
+		count := atomic.LoadInt64(&h.count)
+		fmt.Fprintf(w, "queue_handle_seconds_bucket{queue=%q,le=\"+Inf\"} %d\n", name, count)
+		fmt.Fprintf(w, "queue_handle_seconds_sum{queue=%q} %g\n", name, time.Duration(atomic.LoadInt64(&h.sumNanos)).Seconds())
+		_, err := fmt.Fprintf(w, "queue_handle_seconds_count{queue=%q} %d\n", name, count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetricsHandler prometheus抓取接口
+func MetricsHandler(q Inspector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WritePrometheus(w, q); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// LagHealthCheck 积压超过阈值时健康检查失败，实现httputils.HealthCheck
+// kafka需要设置GroupID才有积压数据，否则Pending始终为0
+type LagHealthCheck struct {
+	q      Inspector
+	name   string
+	maxLag int64
+}
+
+func NewLagHealthCheck(q Inspector, name string, maxLag int64) *LagHealthCheck {
+	return &LagHealthCheck{
+		q:      q,
+		name:   name,
+		maxLag: maxLag,
+	}
+}
+
+func (c *LagHealthCheck) Name() string {
+	return "queue-lag-" + c.name
+}
+
+func (c *LagHealthCheck) Check(r *http.Request) error {
+	s, err := c.q.Stats(c.name)
+	if err != nil {
+		return err
+	}
+	if s.Pending > c.maxLag {
+		return fmt.Errorf("queue %s lag %d exceeds %d", c.name, s.Pending, c.maxLag)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package queue
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// staticInspector 返回固定积压的Inspector
+type staticInspector struct {
+	stats   map[string]*Stats
+	metrics *Metrics
+	err     error
+}
+
+func (i *staticInspector) Names() []string {
+	names := make([]string, 0, len(i.stats))
+	for name := range i.stats {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (i *staticInspector) Stats(name string) (*Stats, error) {
+	return i.stats[name], i.err
+}
+
+func (i *staticInspector) Metrics() *Metrics {
+	return i.metrics
+}
+
+func TestMetricsBegin(t *testing.T) {
+	m := NewMetrics([]float64{0.001, 10})
+
+	done := m.Begin("q")
+	if n := m.InFlight("q"); n != 1 {
+		t.Fatalf("InFlight() = %d, want 1", n)
+	}
+	time.Sleep(2 * time.Millisecond)
+	done()
+
+	h := m.handler("q")
+	if n := m.InFlight("q"); n != 0 {
+		t.Fatalf("InFlight() = %d, want 0", n)
+	}
+	if h.count != 1 || h.sumNanos < int64(2*time.Millisecond) {
+		t.Fatalf("count = %d, sum = %d", h.count, h.sumNanos)
+	}
+	//直方图是累积的，只落在le大于耗时的桶里
+	if h.buckets[0] != 0 || h.buckets[1] != 1 {
+		t.Fatalf("buckets = %v", h.buckets)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	m := NewMetrics([]float64{0.5, 1})
+	h := m.handler("b")
+	h.count, h.sumNanos, h.buckets = 3, int64(1500*time.Millisecond), []int64{1, 2}
+
+	q := &staticInspector{
+		stats: map[string]*Stats{
+			"b": {Name: "b", Pending: 5, InFlight: 1, DeadLetter: 2, Lag: map[int32]int64{10: 4, 2: 1}},
+			"a": {Name: "a"},
+		},
+		metrics: m,
+	}
+
+	var sb strings.Builder
+	if err := WritePrometheus(&sb, q); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE queue_pending gauge
+queue_pending{queue="a"} 0
+queue_pending{queue="b"} 5
+# TYPE queue_in_flight gauge
+queue_in_flight{queue="a"} 0
+queue_in_flight{queue="b"} 1
+# TYPE queue_dead_letter gauge
+queue_dead_letter{queue="a"} 0
+queue_dead_letter{queue="b"} 2
+# TYPE queue_partition_lag gauge
+queue_partition_lag{queue="b",partition="2"} 1
+queue_partition_lag{queue="b",partition="10"} 4
+# TYPE queue_handle_seconds histogram
+queue_handle_seconds_bucket{queue="a",le="0.5"} 0
+queue_handle_seconds_bucket{queue="a",le="1"} 0
+queue_handle_seconds_bucket{queue="a",le="+Inf"} 0
+queue_handle_seconds_sum{queue="a"} 0
+queue_handle_seconds_count{queue="a"} 0
+queue_handle_seconds_bucket{queue="b",le="0.5"} 1
+queue_handle_seconds_bucket{queue="b",le="1"} 2
+queue_handle_seconds_bucket{queue="b",le="+Inf"} 3
+queue_handle_seconds_sum{queue="b"} 1.5
+queue_handle_seconds_count{queue="b"} 3
+`
+	if got := sb.String(); got != want {
+		t.Fatalf("WritePrometheus() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	q := &staticInspector{stats: map[string]*Stats{"a": {Name: "a"}}, metrics: NewMetrics(nil)}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(q)(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `queue_pending{queue="a"} 0`) {
+		t.Fatalf("body = %s", rec.Body.String())
+	}
+
+	q.err = errors.New("redis down")
+	rec = httptest.NewRecorder()
+	MetricsHandler(q)(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 500 {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+}
+
+func TestMemoryQueueStats(t *testing.T) {
+	mq := NewMemoryQueue(&MemoryConfig{Sync: true, MaxRetries: -1})
+	defer mq.Close()
+
+	mq.RegisterHandlerE("q", func(string, string) error { return errors.New("boom") })
+	mq.Push("q", "a")
+	mq.Push("q", "b")
+	s, err := mq.Stats("q")
+	if err != nil || s.Pending != 2 || s.DeadLetter != 0 {
+		t.Fatalf("Stats() before Run = %+v, %v", s, err)
+	}
+
+	mq.Run()
+	s, _ = mq.Stats("q")
+	if s.Pending != 0 || s.DeadLetter != 2 || s.InFlight != 0 {
+		t.Fatalf("Stats() after Run = %+v", s)
+	}
+}
+
+func TestLagHealthCheck(t *testing.T) {
+	q := &staticInspector{stats: map[string]*Stats{"q": {Name: "q", Pending: 10}}}
+
+	if err := NewLagHealthCheck(q, "q", 10).Check(nil); err != nil {
+		t.Fatalf("Check() at threshold = %v", err)
+	}
+	if err := NewLagHealthCheck(q, "q", 9).Check(nil); err == nil {
+		t.Fatal("Check() above threshold should fail")
+	}
+	if name := NewLagHealthCheck(q, "q", 9).Name(); name != "queue-lag-q" {
+		t.Fatalf("Name() = %s", name)
+	}
+
+	q.err = errors.New("redis down")
+	if err := NewLagHealthCheck(q, "q", 100).Check(nil); err == nil {
+		t.Fatal("Check() should return the Stats error")
+	}
+}
@@ -0,0 +1,144 @@
+package queue
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"unicode/utf8"
+
+	"github.com/yybirdcf/golib/clog"
+	"github.com/yybirdcf/golib/trace"
+)
+
+const (
+	HeaderContentType = "Content-Type"
+	// 编码结果不是合法utf8时body为base64
+	HeaderContentEncoding = "Content-Transfer-Encoding"
+)
+
+type messageKey struct{}
+
+// MessageFromContext 类型化handler里获取消息信封，非信封格式的消息ID和Headers为空
+func MessageFromContext(ctx context.Context) *Message {
+	msg, _ := ctx.Value(messageKey{}).(*Message)
+	return msg
+}
+
+// PushMessage 发送消息信封，ctx中的trace写入消息header
+func PushMessage(ctx context.Context, q Queue, name string, msg *Message) error {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	trace.InjectMap(ctx, msg.Headers)
+	return q.Push(name, msg.Encode())
+}
+
+// ContextHandler 把带ctx的handler适配为RegisterHandler的handler
+// ctx中带有消息信封和消息header里的trace，并开始新的span
+func ContextHandler(handler func(context.Context, string, *Message)) func(string, string) {
+	h := ContextHandlerE(func(ctx context.Context, name string, msg *Message) error {
+		handler(ctx, name, msg)
+		return nil
+	})
+	return func(name string, value string) {
+		h(name, value)
+	}
+}
+
+// ContextHandlerE 把带ctx、返回错误的handler适配为RegisterHandlerE的handler
+func ContextHandlerE(handler func(context.Context, string, *Message) error) HandlerE {
+	return func(name string, value string) error {
+		msg := DecodeMessage(value)
+		ctx := trace.ExtractMap(context.Background(), msg.Headers)
+		ctx, _ = trace.StartSpan(ctx)
+		ctx = context.WithValue(ctx, messageKey{}, msg)
+		return handler(ctx, name, msg)
+	}
+}
+
+// deadLetterer 自带死信存储的队列，如MemoryQueue
+type deadLetterer interface {
+	DeadLetter(string, string) error
+}
+
+// DeadLetter 把消息放入死信队列，默认Push到name+DeadLetterSuffix
+func DeadLetter(q Queue, name string, value string) error {
+	if d, ok := q.(deadLetterer); ok {
+		return d.DeadLetter(name, value)
+	}
+	return q.Push(name+DeadLetterSuffix, value)
+}
+
+// Publish 用DefaultCodec编码后发送
+func Publish[T any](ctx context.Context, q Queue, name string, v T) error {
+	return PublishWithCodec(ctx, q, name, DefaultCodec, v)
+}
+
+// PublishWithCodec 编码后以Message信封发送
+func PublishWithCodec[T any](ctx context.Context, q Queue, name string, codec Codec, v T) error {
+	b, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	msg := NewMessage("")
+	msg.Headers = map[string]string{
+		HeaderContentType: codec.ContentType(),
+	}
+	if utf8.Valid(b) {
+		msg.Body = string(b)
+	} else {
+		msg.Headers[HeaderContentEncoding] = "base64"
+		msg.Body = base64.StdEncoding.EncodeToString(b)
+	}
+	return PushMessage(ctx, q, name, msg)
+}
+
+// RegisterTyped 注册类型化handler，使用DefaultCodec解码
+func RegisterTyped[T any](q HandlerQueue, name string, handler func(context.Context, T) error) {
+	RegisterTypedWithCodec(q, name, DefaultCodec, handler)
+}
+
+// RegisterTypedWithCodec 注册类型化handler，解码失败的消息直接进入死信队列
+// handler返回错误时按队列的重试配置重新投递，重试耗尽后进入死信队列
+func RegisterTypedWithCodec[T any](q HandlerQueue, name string, codec Codec, handler func(context.Context, T) error) {
+	q.RegisterHandlerE(name, ContextHandlerE(func(ctx context.Context, name string, msg *Message) error {
+		v, err := decodeTyped[T](codec, msg)
+		if err != nil {
+			clog.ErrorfCtx(ctx, "queue %s decode message %s err: %v", name, msg.ID, err)
+			if err := DeadLetter(q, name, msg.raw); err != nil {
+				clog.ErrorfCtx(ctx, "queue %s dead letter err: %v", name, err)
+			}
+			return nil
+		}
+
+		if err := handler(ctx, v); err != nil {
+			clog.ErrorfCtx(ctx, "queue %s handle message %s err: %v", name, msg.ID, err)
+			return err
+		}
+		return nil
+	}))
+}
+
+func decodeTyped[T any](codec Codec, msg *Message) (T, error) {
+	var v T
+
+	body := []byte(msg.Body)
+	if msg.Headers[HeaderContentEncoding] == "base64" {
+		b, err := base64.StdEncoding.DecodeString(msg.Body)
+		if err != nil {
+			return v, err
+		}
+		body = b
+	}
+
+	// T为指针类型时先分配，protobuf等需要非nil的指针
+	target := interface{}(&v)
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem()).Interface().(T)
+		target = v
+	}
+
+	err := codec.Unmarshal(body, target)
+	return v, err
+}
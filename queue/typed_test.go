@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/yybirdcf/golib/trace"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type order struct {
+	ID    int64  `json:"id" msgpack:"id"`
+	Owner string `json:"owner" msgpack:"owner"`
+}
+
+func TestPublishRegisterTyped(t *testing.T) {
+	mq := NewMemoryQueue(&MemoryConfig{Sync: true})
+	defer mq.Close()
+
+	var got []order
+	var msgs []*Message
+	var traces []trace.SpanContext
+	RegisterTyped(mq, "orders", func(ctx context.Context, o order) error {
+		got = append(got, o)
+		msgs = append(msgs, MessageFromContext(ctx))
+		sc, _ := trace.FromContext(ctx)
+		traces = append(traces, sc)
+		return nil
+	})
+	mq.Run()
+
+	ctx, parent := trace.StartSpan(context.Background())
+	if err := Publish(ctx, mq, "orders", order{ID: 1, Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []order{{ID: 1, Owner: "alice"}}) {
+		t.Fatalf("got = %+v", got)
+	}
+
+	//信封带ID和Content-Type，trace从消息header恢复并开始新的span
+	msg := msgs[0]
+	if msg.ID == "" || msg.Headers[HeaderContentType] != "application/json" || msg.Headers[HeaderContentEncoding] != "" {
+		t.Fatalf("message = %+v", msg)
+	}
+	if traces[0].TraceID != parent.TraceID || traces[0].SpanID == parent.SpanID {
+		t.Fatalf("span = %+v, parent = %+v", traces[0], parent)
+	}
+}
+
+func TestRegisterTypedWithCodec(t *testing.T) {
+	mq := NewMemoryQueue(&MemoryConfig{Sync: true})
+	defer mq.Close()
+
+	//T为指针时解码前分配
+	var ints []int64
+	RegisterTypedWithCodec(mq, "ints", ProtoCodec{}, func(ctx context.Context, v *wrapperspb.Int64Value) error {
+		ints = append(ints, v.Value)
+		if enc := MessageFromContext(ctx).Headers[HeaderContentEncoding]; enc != "base64" {
+			t.Errorf("Content-Transfer-Encoding = %q, want base64", enc)
+		}
+		return nil
+	})
+	var orders []order
+	RegisterTypedWithCodec(mq, "orders", MsgpackCodec{}, func(ctx context.Context, o order) error {
+		orders = append(orders, o)
+		return nil
+	})
+	mq.Run()
+
+	//protobuf的varint不是合法utf8，body按base64发送
+	if err := PublishWithCodec(context.Background(), mq, "ints", ProtoCodec{}, wrapperspb.Int64(1<<40)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PublishWithCodec(context.Background(), mq, "orders", MsgpackCodec{}, order{ID: 2, Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ints, []int64{1 << 40}) || !reflect.DeepEqual(orders, []order{{ID: 2, Owner: "bob"}}) {
+		t.Fatalf("ints = %v, orders = %+v", ints, orders)
+	}
+	if dead := mq.DeadLetters("ints"); len(dead) != 0 {
+		t.Fatalf("DeadLetters() = %v", dead)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		b, err := codec.Marshal(order{ID: 3, Owner: "carol"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var o order
+		if err := codec.Unmarshal(b, &o); err != nil || o != (order{ID: 3, Owner: "carol"}) {
+			t.Fatalf("%s: Unmarshal() = %+v, %v", codec.ContentType(), o, err)
+		}
+	}
+
+	b, err := ProtoCodec{}.Marshal(wrapperspb.String("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &wrapperspb.StringValue{}
+	if err := (ProtoCodec{}).Unmarshal(b, v); err != nil || !proto.Equal(v, wrapperspb.String("x")) {
+		t.Fatalf("Unmarshal() = %v, %v", v, err)
+	}
+	//不是proto.Message
+	if _, err := (ProtoCodec{}).Marshal(order{}); err == nil {
+		t.Fatal("Marshal() should fail for non proto value")
+	}
+	if err := (ProtoCodec{}).Unmarshal(b, &order{}); err == nil {
+		t.Fatal("Unmarshal() should fail for non proto value")
+	}
+}
+
+func TestRegisterTypedDecodeFailure(t *testing.T) {
+	mq := NewMemoryQueue(&MemoryConfig{Sync: true, MaxRetries: 2})
+	defer mq.Close()
+
+	calls := 0
+	RegisterTyped(mq, "orders", func(ctx context.Context, o order) error {
+		calls++
+		return nil
+	})
+	mq.Run()
+
+	//解码失败不重试，原始value直接进入死信
+	mq.Push("orders", "not json")
+	msg := NewMessage(`{"id": "x"}`)
+	mq.Push("orders", msg.Encode())
+	if calls != 0 {
+		t.Fatalf("handler calls = %d", calls)
+	}
+	if dead := mq.DeadLetters("orders"); !reflect.DeepEqual(dead, []string{"not json", msg.Encode()}) {
+		t.Fatalf("DeadLetters() = %v", dead)
+	}
+}
+
+func TestRegisterTypedHandlerError(t *testing.T) {
+	mq := NewMemoryQueue(&MemoryConfig{Sync: true, MaxRetries: 1})
+	defer mq.Close()
+
+	calls := 0
+	RegisterTyped(mq, "orders", func(ctx context.Context, o order) error {
+		calls++
+		return errors.New("boom")
+	})
+	mq.Run()
+
+	//handler的错误按重试配置重试，耗尽后进入死信
+	if err := Publish(context.Background(), mq, "orders", order{ID: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || len(mq.DeadLetters("orders")) != 1 {
+		t.Fatalf("calls = %d, dead letters = %v", calls, mq.DeadLetters("orders"))
+	}
+
+	mq.Close()
+	if err := Publish(context.Background(), mq, "orders", order{ID: 5}); err == nil {
+		t.Fatal("Publish() to closed queue should fail")
+	}
+}
@@ -0,0 +1,148 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader W3C trace context的header名
+const TraceparentHeader = "traceparent"
+
+// SpanContext 当前调用链的trace ID和span ID
+type SpanContext struct {
+	TraceID string //32位16进制
+	SpanID  string //16位16进制
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceID) == 32 && len(sc.SpanID) == 16 &&
+		sc.TraceID != strings.Repeat("0", 32) && sc.SpanID != strings.Repeat("0", 16)
+}
+
+// Traceparent 格式化为W3C traceparent：00-traceid-spanid-flags
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// ParseTraceparent 解析W3C traceparent
+func ParseTraceparent(s string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[3]) != 2 {
+		return SpanContext{}, errors.New("invalid traceparent: " + s)
+	}
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, errors.New("invalid traceparent version: " + s)
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, err
+	}
+	for _, id := range parts[1:3] {
+		if _, err := hex.DecodeString(id); err != nil {
+			return SpanContext{}, err
+		}
+	}
+
+	sc := SpanContext{
+		TraceID: strings.ToLower(parts[1]),
+		SpanID:  strings.ToLower(parts[2]),
+		Sampled: flags[0]&1 == 1,
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New("invalid traceparent ids: " + s)
+	}
+	return sc, nil
+}
+
+type spanKey struct{}
+
+// NewContext 把SpanContext放入ctx
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanKey{}, sc)
+}
+
+// FromContext 取出ctx中的SpanContext
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(spanKey{}).(SpanContext)
+	return sc, ok
+}
+
+// StartSpan 在ctx的trace下开始一个新的span，ctx中没有trace时开始新的trace
+func StartSpan(ctx context.Context) (context.Context, SpanContext) {
+	sc, ok := FromContext(ctx)
+	if !ok || !sc.IsValid() {
+		sc = SpanContext{
+			TraceID: randomHex(16),
+			Sampled: true,
+		}
+	}
+	sc.SpanID = randomHex(8)
+	return NewContext(ctx, sc), sc
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Inject 把ctx中的trace写入http header
+func Inject(ctx context.Context, header http.Header) {
+	if sc, ok := FromContext(ctx); ok && sc.IsValid() {
+		header.Set(TraceparentHeader, sc.Traceparent())
+	}
+}
+
+// Extract 从http header中读取trace放入ctx，没有或不合法时返回原ctx
+func Extract(ctx context.Context, header http.Header) context.Context {
+	sc, err := ParseTraceparent(header.Get(TraceparentHeader))
+	if err != nil {
+		return ctx
+	}
+	return NewContext(ctx, sc)
+}
+
+// InjectMap 把ctx中的trace写入消息header
+func InjectMap(ctx context.Context, headers map[string]string) {
+	if sc, ok := FromContext(ctx); ok && sc.IsValid() {
+		headers[TraceparentHeader] = sc.Traceparent()
+	}
+}
+
+// ExtractMap 从消息header中读取trace放入ctx
+func ExtractMap(ctx context.Context, headers map[string]string) context.Context {
+	sc, err := ParseTraceparent(headers[TraceparentHeader])
+	if err != nil {
+		return ctx
+	}
+	return NewContext(ctx, sc)
+}
+
+// InjectRequest 根据请求的ctx注入traceparent，用于httputils之外的http客户端
+// httputils.Client已经默认注入，不需要再添加为拦截器
+func InjectRequest(req *http.Request) error {
+	Inject(req.Context(), req.Header)
+	return nil
+}
+
+// Middleware 从请求header中提取trace并开始新的span，没有trace时开始新的trace
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, sc := StartSpan(Extract(r.Context(), r.Header))
+		w.Header().Set(TraceparentHeader, sc.Traceparent())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
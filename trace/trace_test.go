@@ -0,0 +1,92 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    SpanContext
+		wantErr bool
+	}{
+		{"sampled", "00-" + testTraceID + "-" + testSpanID + "-01", SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true}, false},
+		{"not sampled", "00-" + testTraceID + "-" + testSpanID + "-00", SpanContext{TraceID: testTraceID, SpanID: testSpanID}, false},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01", SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true}, false},
+		{"surrounding spaces", " 00-" + testTraceID + "-" + testSpanID + "-01 ", SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true}, false},
+		{"other flag bits", "00-" + testTraceID + "-" + testSpanID + "-03", SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true}, false},
+		{"future version with extra fields", "01-" + testTraceID + "-" + testSpanID + "-01-extra", SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: true}, false},
+		{"empty", "", SpanContext{}, true},
+		{"version ff", "ff-" + testTraceID + "-" + testSpanID + "-01", SpanContext{}, true},
+		{"version 00 with extra fields", "00-" + testTraceID + "-" + testSpanID + "-01-extra", SpanContext{}, true},
+		{"short trace id", "00-4bf92f35-" + testSpanID + "-01", SpanContext{}, true},
+		{"zero trace id", "00-00000000000000000000000000000000-" + testSpanID + "-01", SpanContext{}, true},
+		{"zero span id", "00-" + testTraceID + "-0000000000000000-01", SpanContext{}, true},
+		{"non hex id", "00-" + testTraceID + "-00f067aa0ba902bz-01", SpanContext{}, true},
+		{"non hex flags", "00-" + testTraceID + "-" + testSpanID + "-zz", SpanContext{}, true},
+		{"long flags", "00-" + testTraceID + "-" + testSpanID + "-001", SpanContext{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTraceparent(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, sampled := range []bool{true, false} {
+		sc := SpanContext{TraceID: testTraceID, SpanID: testSpanID, Sampled: sampled}
+		got, err := ParseTraceparent(sc.Traceparent())
+		if err != nil || got != sc {
+			t.Fatalf("round trip %+v: got %+v, err %v", sc, got, err)
+		}
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	ctx, root := StartSpan(context.Background())
+	if !root.IsValid() || !root.Sampled {
+		t.Fatalf("root span %+v", root)
+	}
+
+	_, child := StartSpan(ctx)
+	if child.TraceID != root.TraceID || child.SpanID == root.SpanID {
+		t.Fatalf("child %+v of root %+v", child, root)
+	}
+}
+
+func TestInjectExtract(t *testing.T) {
+	ctx, sc := StartSpan(context.Background())
+
+	header := make(http.Header)
+	Inject(ctx, header)
+	got, ok := FromContext(Extract(context.Background(), header))
+	if !ok || got != sc {
+		t.Fatalf("header: got %+v, want %+v", got, sc)
+	}
+
+	headers := make(map[string]string)
+	InjectMap(ctx, headers)
+	got, ok = FromContext(ExtractMap(context.Background(), headers))
+	if !ok || got != sc {
+		t.Fatalf("map: got %+v, want %+v", got, sc)
+	}
+
+	if _, ok := FromContext(Extract(context.Background(), http.Header{})); ok {
+		t.Fatal("extract without traceparent should not set a span")
+	}
+}
@@ -73,6 +73,18 @@ func (h *HashRing) UpdateNode(nodeKey string, weight int) {
 	h.generate()
 }
 
+//所有节点
+func (h *HashRing) Nodes() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	nodes := make([]string, 0, len(h.weights))
+	for nodeKey := range h.weights {
+		nodes = append(nodes, nodeKey)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
 func (h *HashRing) generate() {
 	var totalW int
 	for _, w := range h.weights {